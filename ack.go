@@ -0,0 +1,202 @@
+package ratchet
+
+import (
+	"context"
+	"sync"
+
+	"github.com/dailyburn/ratchet/data"
+)
+
+// DataTracker is implemented by a Checkpointer whose ProcessFrom does more
+// than record positions, such as emitting headers, or cleaning up its inputs
+// once their data has been acknowledged (see Track). When TracksData returns
+// true, ProcessFrom is called instead of ProcessData even if the Pipeline
+// isn't checkpointing, with a nil position. This is an opt-in, so that a
+// DataProcessor embedding one and overriding ProcessData keeps working.
+type DataTracker interface {
+	Checkpointer
+	TracksData() bool
+}
+
+// tracksData returns true if cp is a DataTracker opting in.
+func tracksData(cp Checkpointer) bool {
+	dt, ok := cp.(DataTracker)
+	return ok && dt.TracksData()
+}
+
+// Track is used by a ContextDataProcessor (or Checkpointer) reading from
+// several inputs, such as files, that it cleans up (e.g. deletes) once their
+// data has been written. It returns an Emitter for the data read from one
+// input, and a function to call once all of it has been emitted:
+//
+//	tracked, done := ratchet.Track(out, func() { remove(file) })
+//	// ... emit the file's data with tracked
+//	done()
+//
+// acked is called once all the data emitted with tracked, and all the data
+// derived from it, has been acknowledged by the later stages: ProcessData
+// returned without error, the payload was sent to a dead letter, or it was
+// dropped by a route. DataProcessors that write their data later than that
+// acknowledge it themselves, see DeferAck and FinishAcker. acked is never
+// called if any of the data isn't acknowledged, because the Pipeline halted,
+// so the input is left as it is to be read again. It is called from the
+// goroutine acknowledging the last payload, so it shouldn't block for long.
+//
+// If out is a CheckpointEmitter, so is tracked. Outside of a Pipeline,
+// acked is called by done.
+func Track(out Emitter, acked func()) (tracked Emitter, done func()) {
+	te, ok := out.(trackingEmitter)
+	if !ok {
+		return out, acked
+	}
+	t := newTracker(acked)
+	done = func() { releaseAll([]*tracker{t}) }
+	if ce, ok := out.(trackingCheckpointEmitter); ok {
+		return trackedCheckpointEmitter{ce, t}, done
+	}
+	return trackedEmitter{te, t}, done
+}
+
+// DeferAck is called by a ContextDataProcessor that hasn't durably written
+// the payload it is processing when ProcessData returns, e.g. because it
+// writes in batches. It returns the function acknowledging the payload (see
+// Track), to be called once it has been written. A payload whose write
+// failed should never be acknowledged.
+func DeferAck(ctx context.Context) (ack func()) {
+	trackers := messageFrom(ctx).trackers
+	holdAll(trackers)
+	var once sync.Once
+	return func() {
+		once.Do(func() { releaseAll(trackers) })
+	}
+}
+
+// Buffer is used by a ContextDataProcessor holding on to the data emitted by
+// another one until it knows whether to pass it on, such as a retried call.
+// The data emitted with buffered is only emitted with out by flush, along
+// with the headers and acknowledgement tracking (see Track) it was emitted
+// with. Data that is never flushed is never acknowledged.
+func Buffer(out Emitter) (buffered Emitter, flush func() error) {
+	b := &bufferedEmitter{}
+	return b, func() error {
+		messages := b.messages
+		b.messages = nil
+		for _, m := range messages {
+			var err error
+			if te, ok := out.(trackingEmitter); ok {
+				err = te.emitTracked(m.data, m.headers, m.trackers...)
+			} else {
+				err = out.Emit(m.data)
+			}
+			releaseAll(m.trackers)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// bufferedEmitter holds the data emitted with Buffer, and the trackers it
+// was emitted with, until it is flushed.
+type bufferedEmitter struct {
+	messages []message
+}
+
+func (e *bufferedEmitter) Emit(d data.JSON) error {
+	return e.emitTracked(d, nil)
+}
+
+func (e *bufferedEmitter) emitTracked(d data.JSON, h Headers, ts ...*tracker) error {
+	// The trackers are released by the caller once this returns.
+	holdAll(ts)
+	e.messages = append(e.messages, message{data: d, headers: h, trackers: append([]*tracker(nil), ts...)})
+	return nil
+}
+
+// FinishAcker is implemented by DataProcessors that only durably write the
+// data they receive in Finish, such as S3Writer. If AckOnFinish returns true,
+// the payloads they receive are only acknowledged (see Track) once Finish
+// returns without error, or for a Committer, once it has been committed.
+type FinishAcker interface {
+	AckOnFinish() bool
+}
+
+// heldAcks holds the acknowledgements of a FinishAcker until Finish
+// (or Commit).
+type heldAcks struct {
+	acksMu sync.Mutex
+	acks   []func()
+}
+
+// deferAck defers acknowledging the payload processed with ctx until
+// Finish, if the DataProcessor is a FinishAcker.
+func (dp *dataProcessor) deferAck(ctx context.Context) {
+	if fa, ok := unwrap(dp.DataProcessor).(FinishAcker); !ok || !fa.AckOnFinish() {
+		return
+	}
+	ack := DeferAck(ctx)
+	dp.acksMu.Lock()
+	dp.acks = append(dp.acks, ack)
+	dp.acksMu.Unlock()
+}
+
+// releaseAcks acknowledges the payloads held by deferAck if ack is true.
+// Either way, they are no longer held for the next run.
+func (dp *dataProcessor) releaseAcks(ack bool) {
+	dp.acksMu.Lock()
+	acks := dp.acks
+	dp.acks = nil
+	dp.acksMu.Unlock()
+	if !ack {
+		return
+	}
+	for _, f := range acks {
+		f()
+	}
+}
+
+// trackedEmitter emits data holding the tracker returned by Track.
+type trackedEmitter struct {
+	out trackingEmitter
+	t   *tracker
+}
+
+func (e trackedEmitter) Emit(d data.JSON) error {
+	return e.emitTracked(d, nil)
+}
+
+func (e trackedEmitter) emitTracked(d data.JSON, h Headers, ts ...*tracker) error {
+	return e.out.emitTracked(d, h, append(ts, e.t)...)
+}
+
+// trackingCheckpointEmitter is implemented by the CheckpointEmitters given
+// to Checkpointers within a Pipeline.
+type trackingCheckpointEmitter interface {
+	trackingEmitter
+	// emitAt emits d at position, adding h to its headers and also
+	// holding ts.
+	emitAt(d data.JSON, position data.JSON, h Headers, ts ...*tracker) error
+}
+
+// trackedCheckpointEmitter is a trackedEmitter for a Checkpointer.
+type trackedCheckpointEmitter struct {
+	out trackingCheckpointEmitter
+	t   *tracker
+}
+
+func (e trackedCheckpointEmitter) Emit(d data.JSON) error {
+	return e.emitTracked(d, nil)
+}
+
+func (e trackedCheckpointEmitter) emitTracked(d data.JSON, h Headers, ts ...*tracker) error {
+	return e.out.emitTracked(d, h, append(ts, e.t)...)
+}
+
+func (e trackedCheckpointEmitter) EmitAt(d data.JSON, position data.JSON) error {
+	return e.emitAt(d, position, nil)
+}
+
+func (e trackedCheckpointEmitter) emitAt(d data.JSON, position data.JSON, h Headers, ts ...*tracker) error {
+	return e.out.emitAt(d, position, h, append(ts, e.t)...)
+}
@@ -0,0 +1,126 @@
+package ratchet
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// AdaptiveConcurrency configures a controller that adjusts how many
+// ProcessData calls a DataProcessor makes concurrently while the Pipeline
+// runs, instead of using a fixed Concurrency(). See Adaptive.
+//
+// The controller works like AIMD congestion control: at each Interval, it
+// adds one to the limit if payloads were kept waiting by it, and multiplies
+// the limit by Backoff if more than MaxErrorRate of the calls failed, or if
+// their average latency rose above LatencyTolerance times the lowest average
+// seen so far (a sign that whatever the DataProcessor talks to is struggling).
+// The limit always stays between Min and Max.
+type AdaptiveConcurrency struct {
+	Min              int           // defaults to 1
+	Max              int           // defaults to 32
+	Interval         time.Duration // defaults to 1s
+	MaxErrorRate     float64       // defaults to 0.05
+	LatencyTolerance float64       // defaults to 2
+	Backoff          float64       // defaults to 0.5
+}
+
+func (a AdaptiveConcurrency) withDefaults() AdaptiveConcurrency {
+	if a.Min <= 0 {
+		a.Min = 1
+	}
+	if a.Max <= 0 {
+		a.Max = 32
+	}
+	if a.Max < a.Min {
+		a.Max = a.Min
+	}
+	if a.Interval <= 0 {
+		a.Interval = time.Second
+	}
+	if a.MaxErrorRate <= 0 {
+		a.MaxErrorRate = 0.05
+	}
+	if a.LatencyTolerance <= 0 {
+		a.LatencyTolerance = 2
+	}
+	if a.Backoff <= 0 || a.Backoff >= 1 {
+		a.Backoff = 0.5
+	}
+	return a
+}
+
+// Adaptive makes the DataProcessor's concurrency adapt to the backlog of
+// payloads, and to the latency and error rate of its ProcessData calls:
+//
+//	ratchet.Do(writer).Adaptive(ratchet.AdaptiveConcurrency{Min: 2, Max: 16})
+//
+// The concurrency starts at Concurrency() for a ConcurrentDataProcessor, and
+// at Min otherwise. Either way the DataProcessor must be safe for concurrent
+// use. The current limit is reported in ProcessorStats.Concurrency. Output is
+// kept in order as usual, unless it is an UnorderedDataProcessor.
+func (dp *dataProcessor) Adaptive(a AdaptiveConcurrency) *dataProcessor {
+	a = a.withDefaults()
+	limit := a.Min
+	if dp.concurrency > a.Max {
+		limit = a.Max
+	} else if dp.concurrency > a.Min {
+		limit = dp.concurrency
+	}
+	dp.adaptive = &a
+	dp.initialLimit = limit
+	atomic.StoreInt64(&dp.limit, int64(limit))
+	dp.concurrency = a.Max
+	return dp
+}
+
+// poolSample holds what happened in a workerPool since the last adjustment.
+type poolSample struct {
+	calls     int
+	errors    int
+	latency   time.Duration // total
+	saturated bool          // whether payloads waited for the limit
+}
+
+// adapt adjusts the worker pool's limit at each interval until stop is closed.
+func (dp *dataProcessor) adapt(pool *workerPool, stop chan struct{}) {
+	a := dp.adaptive
+	ticker := time.NewTicker(a.Interval)
+	defer ticker.Stop()
+	var baseline time.Duration // lowest average latency seen
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		buffered := dp.buffered()
+		pool.mu.Lock()
+		s := pool.sample
+		pool.sample = poolSample{}
+		limit := pool.limit
+		if s.calls > 0 {
+			avg := s.latency / time.Duration(s.calls)
+			if baseline == 0 || avg < baseline {
+				baseline = avg
+			}
+			switch {
+			case float64(s.errors)/float64(s.calls) > a.MaxErrorRate,
+				float64(avg) > float64(baseline)*a.LatencyTolerance:
+				limit = int(float64(limit) * a.Backoff)
+			case s.saturated || buffered > 0:
+				limit++
+			}
+		}
+		if limit < a.Min {
+			limit = a.Min
+		}
+		if limit > a.Max {
+			limit = a.Max
+		}
+		pool.limit = limit
+		pool.mu.Unlock()
+		pool.cond.Broadcast()
+		atomic.StoreInt64(&dp.limit, int64(limit))
+	}
+}
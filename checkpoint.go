@@ -0,0 +1,212 @@
+package ratchet
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dailyburn/ratchet/data"
+	"github.com/dailyburn/ratchet/logger"
+)
+
+// CheckpointStore saves how far the sources of a Pipeline have read, so that
+// an interrupted run can be resumed. See Checkpointing, and the checkpoint
+// package for implementations. It must be safe for concurrent use.
+type CheckpointStore interface {
+	// Load returns the position saved for the source in the run,
+	// or nil if there is none.
+	Load(runID, source string) (position data.JSON, err error)
+	// Save records the position reached by the source in the run.
+	Save(runID, source string, position data.JSON) error
+}
+
+// Checkpointer is implemented by DataProcessors reading from somewhere that
+// reading can be resumed from, such as a file or a SQL query.
+type Checkpointer interface {
+	// ProcessFrom is called instead of ProcessData when the Pipeline is
+	// checkpointing (or see DataTracker), with the position saved by the
+	// last run (or nil). It
+	// is called like ContextDataProcessor.ProcessData, except that data is
+	// emitted along with the position to resume reading from once it has
+	// been processed, using out.EmitAt.
+	ProcessFrom(ctx context.Context, d data.JSON, from data.JSON, out CheckpointEmitter) error
+}
+
+// CheckpointEmitter is the Emitter given to Checkpointer.ProcessFrom.
+type CheckpointEmitter interface {
+	Emitter
+	// EmitAt emits d, and records that reading can resume from position
+	// once d has been processed.
+	EmitAt(d data.JSON, position data.JSON) error
+}
+
+// Checkpointing configures a Pipeline to record how far its initial stage
+// DataProcessors have read, so that a run that fails at 90% can be resumed
+// from there instead of from scratch:
+//
+//	pipeline.Checkpoints = &ratchet.Checkpointing{RunID: "import-2016-05-01", Store: checkpoint.NewFileStore("/var/lib/etl")}
+//
+// Each DataProcessor in the initial stage implementing Checkpointer emits its
+// data along with positions. A position is confirmed once every payload
+// emitted up to it, and all the data derived from them, has been
+// acknowledged by the later stages, as described for Track (so a FinishAcker
+// such as S3Writer holds it back until its Finish succeeds). The latest
+// confirmed positions are saved every Interval and when the run ends,
+// whether it succeeded or not, and a later run with the same RunID resumes
+// from them. Once a run has completed, a rerun with the same RunID has
+// nothing left to read.
+//
+// Positions are saved for each DataProcessor under its String(), with a "#n"
+// suffix for duplicates within the initial stage. ProcessFrom gets the same
+// position for every payload the initial stage receives, so checkpointing is
+// meant for Pipelines started with Run or RunContext.
+type Checkpointing struct {
+	RunID    string
+	Store    CheckpointStore
+	Interval time.Duration // defaults to 1s
+}
+
+// checkpointLog tracks the positions emitted by a Checkpointer during a run,
+// and the latest confirmed one.
+type checkpointLog struct {
+	source string
+	from   data.JSON // the position loaded when the run started
+
+	mu        sync.Mutex
+	next      uint64               // sequence number of the next position
+	confirmed uint64               // positions before this have all been confirmed
+	pending   map[uint64]data.JSON // confirmed positions after those
+	position  data.JSON            // the latest confirmed position
+
+	saveMu sync.Mutex
+	saved  uint64 // the value of confirmed when position was last saved
+}
+
+// track returns a tracker for data emitted at position.
+func (l *checkpointLog) track(position data.JSON) *tracker {
+	l.mu.Lock()
+	seq := l.next
+	l.next++
+	l.mu.Unlock()
+	return newTracker(func() { l.confirm(seq, position) })
+}
+
+func (l *checkpointLog) confirm(seq uint64, position data.JSON) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pending[seq] = position
+	for {
+		p, ok := l.pending[l.confirmed]
+		if !ok {
+			return
+		}
+		delete(l.pending, l.confirmed)
+		l.confirmed++
+		l.position = p
+	}
+}
+
+// save saves the latest confirmed position, if it hasn't been already.
+func (l *checkpointLog) save(c *Checkpointing) error {
+	l.saveMu.Lock()
+	defer l.saveMu.Unlock()
+	l.mu.Lock()
+	position, confirmed := l.position, l.confirmed
+	l.mu.Unlock()
+	if confirmed == l.saved {
+		return nil
+	}
+	logger.Debug("Checkpointing:", c.RunID, l.source, "at", string(position))
+	if err := c.Store.Save(c.RunID, l.source, position); err != nil {
+		return fmt.Errorf("saving the checkpoint of %s: %v", l.source, err)
+	}
+	l.saved = confirmed
+	return nil
+}
+
+// checkpointEmitter is the CheckpointEmitter for a Checkpointer's
+// ProcessFrom calls. Without a log, positions are ignored.
+type checkpointEmitter struct {
+	trackingEmitter
+	log *checkpointLog
+}
+
+func (e checkpointEmitter) EmitAt(d data.JSON, position data.JSON) error {
+	return e.emitAt(d, position, nil)
+}
+
+func (e checkpointEmitter) emitAt(d data.JSON, position data.JSON, h Headers, ts ...*tracker) error {
+	if e.log == nil {
+		return e.emitTracked(d, h, ts...)
+	}
+	t := e.log.track(position)
+	defer releaseAll([]*tracker{t})
+	return e.emitTracked(d, h, append(ts, t)...)
+}
+
+// loadCheckpoints sets up a checkpointLog for each Checkpointer in the
+// initial stage, loading the positions saved by the last run.
+func (p *Pipeline) loadCheckpoints() ([]*checkpointLog, error) {
+	var logs []*checkpointLog
+	seen := make(map[string]int)
+	for _, dp := range p.layout.stages[0].processors {
+		dp.checkpoints = nil
+		if p.Checkpoints == nil {
+			continue
+		}
+		if _, ok := unwrap(dp.DataProcessor).(Checkpointer); !ok {
+			continue
+		}
+		source := dp.String()
+		seen[source]++
+		if n := seen[source]; n > 1 {
+			source = fmt.Sprintf("%s #%d", source, n)
+		}
+		from, err := p.Checkpoints.Store.Load(p.Checkpoints.RunID, source)
+		if err != nil {
+			return nil, fmt.Errorf("loading the checkpoint of %s: %v", source, err)
+		}
+		if from != nil {
+			logger.Info(p.Name, ": resuming", source, "from", string(from))
+		}
+		dp.checkpoints = &checkpointLog{source: source, from: from, pending: make(map[uint64]data.JSON)}
+		logs = append(logs, dp.checkpoints)
+	}
+	return logs, nil
+}
+
+// saveCheckpoints saves the latest confirmed positions.
+func (p *Pipeline) saveCheckpoints(logs []*checkpointLog) error {
+	for _, l := range logs {
+		if err := l.save(p.Checkpoints); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkpoint saves the latest confirmed positions every Interval, until done
+// is closed. Errors halt the Pipeline.
+func (p *Pipeline) checkpoint(logs []*checkpointLog, errChan chan error, done chan struct{}) {
+	interval := p.Checkpoints.Interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.saveCheckpoints(logs); err != nil {
+				select {
+				case errChan <- err:
+				case <-done:
+				}
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
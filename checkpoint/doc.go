@@ -0,0 +1,11 @@
+// Package checkpoint provides ratchet.CheckpointStore implementations, which
+// save how far the sources of a Pipeline have read so that an interrupted run
+// can be resumed:
+//
+//	pipeline.Checkpoints = &ratchet.Checkpointing{
+//	        RunID: "import-" + day,
+//	        Store: checkpoint.NewFileStore("/var/lib/etl/checkpoints"),
+//	}
+//
+// See ratchet.Checkpointing for details.
+package checkpoint
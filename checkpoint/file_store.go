@@ -0,0 +1,94 @@
+package checkpoint
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/dailyburn/ratchet/data"
+)
+
+// FileStore saves the positions of each run in a JSON file in a directory,
+// named after the run ID. Files are replaced atomically, so a crash while
+// saving leaves the previous positions in place.
+type FileStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewFileStore returns a FileStore saving its files in dir, which
+// is created if it doesn't exist.
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{dir: dir}
+}
+
+func (s *FileStore) path(runID string) string {
+	return filepath.Join(s.dir, url.PathEscape(runID)+".json")
+}
+
+// read returns the positions saved for the run, by source.
+func (s *FileStore) read(runID string) (map[string]json.RawMessage, error) {
+	positions := make(map[string]json.RawMessage)
+	b, err := ioutil.ReadFile(s.path(runID))
+	if os.IsNotExist(err) {
+		return positions, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return positions, json.Unmarshal(b, &positions)
+}
+
+// Load defers to ratchet.CheckpointStore.
+func (s *FileStore) Load(runID, source string) (data.JSON, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	positions, err := s.read(runID)
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := positions[source]; ok {
+		return data.JSON(p), nil
+	}
+	return nil, nil
+}
+
+// Save defers to ratchet.CheckpointStore.
+func (s *FileStore) Save(runID, source string, position data.JSON) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	positions, err := s.read(runID)
+	if err != nil {
+		return err
+	}
+	positions[source] = json.RawMessage(position)
+	b, err := json.Marshal(positions)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(s.dir, ".checkpoint")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), s.path(runID))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
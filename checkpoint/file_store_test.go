@@ -0,0 +1,48 @@
+package checkpoint
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dailyburn/ratchet/data"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := NewFileStore(filepath.Join(dir, "runs"))
+	if p, err := s.Load("run/1", "IoReader"); err != nil || p != nil {
+		t.Fatalf("Expected no position before saving, got %s (%v)", p, err)
+	}
+	for _, save := range []struct{ source, position string }{
+		{"IoReader", `{"offset":4}`},
+		{"SQLReader", `{"rows":10}`},
+		{"IoReader", `{"offset":8}`},
+	} {
+		if err := s.Save("run/1", save.source, data.JSON(save.position)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Positions survive a new FileStore, and runs are kept apart.
+	s = NewFileStore(filepath.Join(dir, "runs"))
+	for _, load := range []struct{ runID, source, position string }{
+		{"run/1", "IoReader", `{"offset":8}`},
+		{"run/1", "SQLReader", `{"rows":10}`},
+		{"run/2", "IoReader", ""},
+	} {
+		p, err := s.Load(load.runID, load.source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(p) != load.position {
+			t.Errorf("Expected %s to load %q for %s, got %q", load.source, load.position, load.runID, p)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package checkpoint
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/dailyburn/ratchet/data"
+)
+
+// SQLStore saves positions in a SQL table, which must have been created with
+// (at least) these columns:
+//
+//	CREATE TABLE ratchet_checkpoints (
+//	        run_id   VARCHAR(255) NOT NULL,
+//	        source   VARCHAR(255) NOT NULL,
+//	        position TEXT NOT NULL,
+//	        PRIMARY KEY (run_id, source)
+//	)
+//
+// Like SQLWriter, it uses "?" placeholders, as MySQL does.
+type SQLStore struct {
+	db    *sql.DB
+	table string
+}
+
+// NewSQLStore returns a SQLStore saving positions in the given table.
+func NewSQLStore(db *sql.DB, table string) *SQLStore {
+	return &SQLStore{db: db, table: table}
+}
+
+// Load defers to ratchet.CheckpointStore.
+func (s *SQLStore) Load(runID, source string) (data.JSON, error) {
+	var position string
+	q := fmt.Sprintf("SELECT position FROM %s WHERE run_id = ? AND source = ?", s.table)
+	err := s.db.QueryRow(q, runID, source).Scan(&position)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return data.JSON(position), nil
+}
+
+// Save defers to ratchet.CheckpointStore. The previous position is replaced
+// within a transaction.
+func (s *SQLStore) Save(runID, source string, position data.JSON) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE run_id = ? AND source = ?", s.table), runID, source)
+	if err == nil {
+		_, err = tx.Exec(fmt.Sprintf("INSERT INTO %s (run_id, source, position) VALUES (?, ?, ?)", s.table), runID, source, string(position))
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,156 @@
+package ratchet
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/dailyburn/ratchet/logger"
+)
+
+// Committer is implemented by DataProcessors writing somewhere that their
+// data can be staged, such as a transaction or a temporary file, so that
+// nothing is published unless the whole Pipeline succeeds. Otherwise, a
+// failed run would leave half-written tables and files behind for the next
+// consumers to pick up.
+//
+// Once every stage has finished successfully, Prepare is called on each
+// Committer, in stage order (dead letters last), and should check that its
+// data is ready to be published. If they all succeed, Commit is called on
+// each of them in the same order, publishing the data (e.g. committing the
+// transaction or renaming the file). This includes a run drained by a
+// signal (see SignalHandling), which then returns ErrInterrupted. If the
+// run failed, or any Prepare or Commit call fails, Abort is called on the
+// Committers that haven't been committed, and should discard the staged
+// data. The failure is returned by the Pipeline, and note that the
+// Committers committed before it remain so.
+//
+// Abort is only called once every stage goroutine has exited, in the
+// background if the Pipeline was halted, so it can't run concurrently with
+// ProcessData or Finish. A new run using the same Committer (e.g. an
+// immediate retry with a new Pipeline) waits for that Abort to return
+// before starting. It is called with a context that is never cancelled.
+// Committers within a SubPipeline are committed along with the outer
+// Pipeline's.
+//
+// The payloads received by a Committer that implements FinishAcker are only
+// acknowledged (see Track) once it has been committed.
+type Committer interface {
+	Prepare(ctx context.Context) error
+	Commit(ctx context.Context) error
+	Abort(ctx context.Context) error
+}
+
+// committers returns the dataProcessors implementing Committer, including
+// those within SubPipelines.
+func (p *Pipeline) committers() []*dataProcessor {
+	p.mu.Lock()
+	processors := p.processors()
+	p.mu.Unlock()
+	var dps []*dataProcessor
+	for _, dp := range processors {
+		if sp, ok := unwrap(dp.DataProcessor).(*subPipeline); ok {
+			dps = append(dps, sp.pipeline.committers()...)
+		}
+		if _, ok := unwrap(dp.DataProcessor).(Committer); ok {
+			dps = append(dps, dp)
+		}
+	}
+	return dps
+}
+
+// commit prepares and then commits every Committer, returning the first
+// error. The Committers left uncommitted are returned, to be aborted.
+func (p *Pipeline) commit(ctx context.Context, committers []*dataProcessor) (uncommitted []*dataProcessor, err error) {
+	for _, dp := range committers {
+		logger.Debug(p.Name, ": preparing", dp)
+		if err := unwrap(dp.DataProcessor).(Committer).Prepare(ctx); err != nil {
+			return committers, fmt.Errorf("%v: preparing to commit: %v", dp, err)
+		}
+	}
+	for i, dp := range committers {
+		logger.Debug(p.Name, ": committing", dp)
+		if err := unwrap(dp.DataProcessor).(Committer).Commit(ctx); err != nil {
+			dp.releaseAcks(false)
+			return committers[i+1:], fmt.Errorf("%v: committing: %v", dp, err)
+		}
+		dp.releaseAcks(true)
+	}
+	return nil, nil
+}
+
+// abort aborts the given Committers, logging any error.
+func (p *Pipeline) abort(committers []*dataProcessor) {
+	for _, dp := range committers {
+		logger.Info(p.Name, ": aborting", dp)
+		dp.releaseAcks(false)
+		if err := unwrap(dp.DataProcessor).(Committer).Abort(context.Background()); err != nil {
+			logger.Error(dp, "error aborting:", err.Error())
+		}
+		pendingAborts.done(dp)
+	}
+}
+
+// pendingAborts holds a channel for each Committer that a halted run is
+// going to abort in the background, closed once it has been aborted.
+var pendingAborts = abortLog{pending: map[interface{}]chan struct{}{}}
+
+type abortLog struct {
+	mu      sync.Mutex
+	pending map[interface{}]chan struct{}
+}
+
+// key returns the Committer of dp, or nil if it can't be told apart from
+// other Committers.
+func (l *abortLog) key(dp *dataProcessor) interface{} {
+	c := unwrap(dp.DataProcessor)
+	if !reflect.TypeOf(c).Comparable() {
+		return nil
+	}
+	return c
+}
+
+// add records that the given Committers are going to be aborted.
+func (l *abortLog) add(committers []*dataProcessor) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, dp := range committers {
+		if k := l.key(dp); k != nil && l.pending[k] == nil {
+			l.pending[k] = make(chan struct{})
+		}
+	}
+}
+
+// done records that dp has been aborted.
+func (l *abortLog) done(dp *dataProcessor) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if k := l.key(dp); k != nil && l.pending[k] != nil {
+		close(l.pending[k])
+		delete(l.pending, k)
+	}
+}
+
+// wait waits until none of the given Committers is going to be aborted,
+// or until ctx is done.
+func (l *abortLog) wait(ctx context.Context, committers []*dataProcessor) error {
+	for _, dp := range committers {
+		l.mu.Lock()
+		var aborted chan struct{}
+		if k := l.key(dp); k != nil {
+			aborted = l.pending[k]
+		}
+		l.mu.Unlock()
+		if aborted == nil {
+			continue
+		}
+		logger.Info("waiting for", dp, "to be aborted by the previous run")
+		select {
+		case <-aborted:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -1,8 +1,10 @@
 package ratchet
 
 import (
-	"container/list"
+	"context"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dailyburn/ratchet/data"
 	"github.com/dailyburn/ratchet/logger"
@@ -16,111 +18,242 @@ import (
 // Note that the order of data processing is maintained, meaning that
 // when a DataProcessor receives ProcessData calls d1, d2, ..., the resulting data
 // payloads sent on the outputChan will be sent in the same order as received.
+// See UnorderedDataProcessor for DataProcessors that don't need this.
 type ConcurrentDataProcessor interface {
 	DataProcessor
 	Concurrency() int
 }
 
+// UnorderedDataProcessor is a ConcurrentDataProcessor that doesn't need its
+// output sent in the order its input was received. Data is sent on as soon as
+// each ProcessData call emits it, instead of waiting for the calls for earlier
+// payloads to return, so one slow payload doesn't hold up the ones behind it.
+//
+// ReorderWindow bounds how far out of order the output can get: ProcessData
+// isn't called for a payload until the calls for all payloads received
+// ReorderWindow() or more places before it have returned. Zero means
+// there is no bound.
+type UnorderedDataProcessor interface {
+	ConcurrentDataProcessor
+	ReorderWindow() int
+}
+
+// concurrent is the part of ConcurrentDataProcessor that a
+// ContextDataProcessor can implement as well.
+type concurrent interface {
+	Concurrency() int
+}
+
+// unordered is the part of UnorderedDataProcessor that a
+// ContextDataProcessor can implement as well.
+type unordered interface {
+	ReorderWindow() int
+}
+
 // IsConcurrent returns true if the given DataProcessor implements ConcurrentDataProcessor
+// (or is a wrapped ContextDataProcessor implementing Concurrency).
 func isConcurrent(p DataProcessor) bool {
-	_, ok := interface{}(p).(ConcurrentDataProcessor)
+	_, ok := unwrap(p).(concurrent)
 	return ok
 }
 
 // dataProcessor embeds concurrentDataProcessor
 type concurrentDataProcessor struct {
 	concurrency  int
-	workThrottle chan workSignal
-	workList     *list.List
-	doneChan     chan bool
-	inputClosed  bool
-	sync.Mutex
+	unordered    bool
+	window       int                  // see UnorderedDataProcessor.ReorderWindow
+	adaptive     *AdaptiveConcurrency // set by Adaptive
+	initialLimit int
+	limit        int64 // current limit, for the stats
+	pool         *workerPool
 }
 
-type workSignal struct{}
+// workerPool runs ProcessData calls on a fixed number of goroutines.
+type workerPool struct {
+	jobs chan job
+	wg   sync.WaitGroup
 
-type result struct {
-	done       bool
-	data       []data.JSON
-	outputChan chan data.JSON
-	open       bool
+	mu       sync.Mutex
+	cond     *sync.Cond // signalled when oldest, inFlight or limit change
+	next     uint64     // sequence number of the next job
+	inFlight int        // jobs queued or being processed
+	limit    int        // maximum inFlight, if adaptive
+	sample   poolSample
+	stop     chan struct{} // closed to stop the adaptive controller
+	// ordered output
+	results map[uint64][]message // output of finished jobs, until it can be sent
+	sent    uint64               // sequence number of the next job to send output for
+	sending bool                 // whether a worker is sending output
+	// unordered output
+	finished map[uint64]bool // finished jobs, after oldest
+	oldest   uint64          // sequence number of the oldest unfinished job
 }
 
-func (dp *dataProcessor) processData(d data.JSON, killChan chan error) chan bool {
-	logger.Debug("dataProcessor: processData", dp, "with concurrency =", dp.concurrency)
-	exit := make(chan bool, 1)
-	// If no concurrency is needed, simply call stage.ProcessData and return...
+type job struct {
+	ctx      context.Context
+	seq      uint64
+	d        data.JSON
+	killChan chan error
+}
+
+// startWorkers starts the worker pool for a run of the Pipeline.
+func (dp *dataProcessor) startWorkers() {
 	if dp.concurrency <= 1 {
+		return
+	}
+	pool := &workerPool{
+		jobs:     make(chan job),
+		results:  make(map[uint64][]message),
+		finished: make(map[uint64]bool),
+	}
+	pool.cond = sync.NewCond(&pool.mu)
+	if dp.adaptive != nil {
+		pool.limit = dp.initialLimit
+		atomic.StoreInt64(&dp.limit, int64(pool.limit))
+		pool.stop = make(chan struct{})
+		go dp.adapt(pool, pool.stop)
+	}
+	pool.wg.Add(dp.concurrency)
+	for i := 0; i < dp.concurrency; i++ {
+		go func() {
+			defer pool.wg.Done()
+			for j := range pool.jobs {
+				dp.work(j)
+			}
+		}()
+	}
+	dp.pool = pool
+}
+
+// processData calls ProcessData for d. Without concurrency, the call is
+// made directly; otherwise it is queued for the worker pool, waiting for a
+// free worker (and, for an UnorderedDataProcessor, for the reorder window,
+// or for the limit set by Adaptive).
+func (dp *dataProcessor) processData(ctx context.Context, d data.JSON, killChan chan error) {
+	logger.Debug("dataProcessor: processData", dp, "with concurrency =", dp.concurrency)
+	if dp.pool == nil {
 		dp.recordExecution(func() {
-			dp.ProcessData(d, dp.outputChan, killChan)
-			exit <- true
+			ctx, span := dp.startSpan(ctx)
+			err := dp.callProcessData(ctx, d, outputEmitter{dp.outputChan, ctx})
+			span.end(err)
+			dp.handleErr(ctx, d, err, killChan)
 		})
-		return exit
+		return
 	}
-	// ... otherwise process the data in a concurrent queue/pool of goroutines
-	logger.Debug("dataProcessor: processData", dp, "waiting for work")
-	// wait for room in the queue
-	dp.workThrottle <- workSignal{}
-	logger.Debug("dataProcessor: processData", dp, "work obtained")
-	rc := make(chan data.JSON)
-	done := make(chan bool)
-	// setup goroutine to handle result
-	go func() {
-		res := result{outputChan: dp.outputChan, data: []data.JSON{}, open: true}
-		dp.Lock()
-		dp.workList.PushBack(&res)
-		dp.Unlock()
-		logger.Debug("dataProcessor: processData", dp, "waiting to receive data on result chan")
-		for {
-			select {
-			case d, open := <-rc:
-				logger.Debug("dataProcessor: processData", dp, "received data on result chan")
-				res.data = append(res.data, d)
-				// outputChan will need to be closed if the rc chan was closed
-				res.open = open
-			case <-done:
-				res.done = true
-				logger.Debug("dataProcessor: processData", dp, "done, releasing work")
-				<-dp.workThrottle
-				dp.sendResults()
-				exit <- true
-				return
-			}
+
+	pool := dp.pool
+	pool.mu.Lock()
+	for {
+		if pool.limit > 0 && pool.inFlight >= pool.limit {
+			pool.sample.saturated = true
+		} else if !dp.unordered || dp.window == 0 || pool.next-pool.oldest < uint64(dp.window) {
+			break
 		}
-	}()
-	// do normal data processing, passing in new result chan
-	// instead of the original outputChan
-	go dp.recordExecution(func() {
-		dp.ProcessData(d, rc, killChan)
-		done <- true
+		pool.cond.Wait()
+	}
+	seq := pool.next
+	pool.next++
+	pool.inFlight++
+	pool.mu.Unlock()
+	logger.Debug("dataProcessor: processData", dp, "waiting for a worker")
+	pool.jobs <- job{ctx, seq, d, killChan}
+}
+
+// waitForWorkers waits until all the queued ProcessData calls have returned,
+// and their output has been sent.
+func (dp *dataProcessor) waitForWorkers() {
+	if dp.pool == nil {
+		return
+	}
+	close(dp.pool.jobs)
+	dp.pool.wg.Wait()
+	if dp.pool.stop != nil {
+		close(dp.pool.stop)
+	}
+	dp.pool = nil
+}
+
+func (dp *dataProcessor) work(j job) {
+	ctx, span := dp.startSpan(j.ctx)
+	var out trackingEmitter = outputEmitter{dp.outputChan, ctx}
+	if !dp.unordered {
+		out = &sliceEmitter{ctx: ctx}
+	}
+	var err error
+	start := time.Now()
+	dp.recordExecution(func() {
+		err = dp.callProcessData(ctx, j.d, out)
+		span.end(err)
+		dp.handleErr(ctx, j.d, err, j.killChan)
 	})
+	dp.pool.finish(j.seq, time.Since(start), err != nil)
+	if !dp.unordered {
+		dp.sendResults(j.ctx, j.seq, out.(*sliceEmitter).messages)
+	}
+}
 
-	// wait on processing to complete
-	return exit
-}
-
-// sendResults handles sending work that is completed, as well as
-// guaranteeing a FIFO order of the resulting data sent over the
-// original outputChan.
-func (dp *dataProcessor) sendResults() {
-	dp.Lock()
-	logger.Debug("dataProcessor: sendResults checking for valid data to send")
-	e := dp.workList.Front()
-	for e != nil && e.Value.(*result).done {
-		logger.Debug("dataHandler: sendResults sending data")
-		res := dp.workList.Remove(e).(*result)
-		for _, d := range res.data {
-			res.outputChan <- d
+// finish records a finished job, moving the reorder window on
+// for unordered jobs.
+func (pool *workerPool) finish(seq uint64, latency time.Duration, failed bool) {
+	pool.mu.Lock()
+	pool.inFlight--
+	pool.sample.calls++
+	pool.sample.latency += latency
+	if failed {
+		pool.sample.errors++
+	}
+	pool.finished[seq] = true
+	for pool.finished[pool.oldest] {
+		delete(pool.finished, pool.oldest)
+		pool.oldest++
+	}
+	pool.mu.Unlock()
+	pool.cond.Broadcast()
+}
+
+// sendResults stores the output of an ordered job, and sends on the output
+// of every job that is next in line, guaranteeing a FIFO order of the data
+// sent over outputChan. Only one worker sends at a time, and the lock isn't
+// held while sending, so other workers can keep storing their output.
+func (dp *dataProcessor) sendResults(ctx context.Context, seq uint64, output []message) {
+	pool := dp.pool
+	pool.mu.Lock()
+	pool.results[seq] = output
+	if pool.sending {
+		pool.mu.Unlock()
+		return
+	}
+	pool.sending = true
+	for {
+		output, ok := pool.results[pool.sent]
+		if !ok {
+			break
 		}
-		if !res.open {
-			logger.Debug("dataProcessor: sendResults closing outputChan")
-			close(res.outputChan)
+		delete(pool.results, pool.sent)
+		pool.sent++
+		pool.mu.Unlock()
+		logger.Debug("dataProcessor: sendResults", dp, "sending data")
+		for _, m := range output {
+			outputEmitter{dp.outputChan, ctx}.send(m)
 		}
-		e = dp.workList.Front()
+		pool.mu.Lock()
 	}
-	dp.Unlock()
+	pool.sending = false
+	pool.mu.Unlock()
+}
 
-	if dp.inputClosed && dp.workList.Len() == 0 {
-		dp.doneChan <- true
-	}
+// sliceEmitter stores the data emitted by a ProcessData call, so that it
+// can be sent on in order.
+type sliceEmitter struct {
+	ctx      context.Context
+	messages []message
+}
+
+func (e *sliceEmitter) Emit(d data.JSON) error {
+	return e.emitTracked(d, nil)
+}
+
+func (e *sliceEmitter) emitTracked(d data.JSON, h Headers, ts ...*tracker) error {
+	e.messages = append(e.messages, derive(e.ctx, d, h, ts...))
+	return nil
 }
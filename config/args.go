@@ -0,0 +1,91 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// Args holds the parameters given to a DataProcessor in a pipeline
+// definition, already checked against the Params of its Factory. The
+// accessors return the zero value for parameters that were not set.
+type Args struct {
+	pos       Position
+	values    map[string]interface{}
+	positions map[string]Position
+}
+
+// Has reports whether the named parameter was set.
+func (a *Args) Has(name string) bool {
+	_, ok := a.values[name]
+	return ok
+}
+
+// String returns the value of a String parameter.
+func (a *Args) String(name string) string {
+	v, _ := a.values[name].(string)
+	return v
+}
+
+// Int returns the value of an Int parameter.
+func (a *Args) Int(name string) int {
+	v, _ := a.values[name].(int)
+	return v
+}
+
+// Float returns the value of a Float parameter.
+func (a *Args) Float(name string) float64 {
+	v, _ := a.values[name].(float64)
+	return v
+}
+
+// Bool returns the value of a Bool parameter.
+func (a *Args) Bool(name string) bool {
+	v, _ := a.values[name].(bool)
+	return v
+}
+
+// Duration returns the value of a Duration parameter.
+func (a *Args) Duration(name string) time.Duration {
+	v, _ := a.values[name].(time.Duration)
+	return v
+}
+
+// StringList returns the value of a StringList parameter.
+func (a *Args) StringList(name string) []string {
+	v, _ := a.values[name].([]string)
+	return v
+}
+
+// Resource stores the value of a Resource parameter in the variable target
+// points to, returning an error if the resource has a different type:
+//
+//	var db *sql.DB
+//	if err := args.Resource("db", &db); err != nil {
+//		return nil, err
+//	}
+func (a *Args) Resource(name string, target interface{}) error {
+	v := reflect.ValueOf(target)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		panic("config: Args.Resource target must be a non-nil pointer")
+	}
+	r, ok := a.values[name]
+	if !ok {
+		return nil
+	}
+	if r == nil || !reflect.TypeOf(r).AssignableTo(v.Elem().Type()) {
+		return a.Errorf(name, "resource is a %T, expected %s", r, v.Elem().Type())
+	}
+	v.Elem().Set(reflect.ValueOf(r))
+	return nil
+}
+
+// Errorf returns an error pointing at the named parameter in the pipeline
+// definition, or at the DataProcessor definition if the parameter was not set.
+func (a *Args) Errorf(name string, format string, args ...interface{}) error {
+	pos, ok := a.positions[name]
+	if !ok {
+		pos = a.pos
+	}
+	return errorf(pos, "%s: %s", name, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,85 @@
+/*
+Package config builds ratchet PipelineLayouts from declarative pipeline
+definitions, so that pipelines can be described in a file rather than in Go code.
+
+A definition is a JSON (or YAML) document listing the DataProcessors, by the
+type name they were registered under, along with their parameters and outputs:
+
+	{
+	  "processors": [
+	    {
+	      "id": "read",
+	      "type": "SQLReader",
+	      "params": {"db": "source", "query": "SELECT * FROM users"},
+	      "outputs": ["match"]
+	    },
+	    {
+	      "id": "match",
+	      "type": "RegexpMatcher",
+	      "params": {"pattern": "@example.com"},
+	      "outputs": ["csv", "table"]
+	    },
+	    {"id": "csv", "type": "CSVWriter", "params": {"writer": "out"}},
+	    {
+	      "id": "table",
+	      "type": "SQLWriter",
+	      "params": {"db": "target", "table": "users"},
+	      "on_error": {"dead_letter": "quarantine"}
+	    },
+	    {"id": "quarantine", "type": "IoWriter", "params": {"writer": "errors", "add_newline": true}}
+	  ]
+	}
+
+The same definition can be written in YAML, in a file ending in .yaml or .yml:
+
+	processors:
+	  - id: read
+	    type: SQLReader
+	    params: {db: source, query: "SELECT * FROM users"}
+	    outputs: [match]
+	  - id: match
+	    type: RegexpMatcher
+	    params:
+	      pattern: "@example.com"
+	    outputs: [csv, table]
+	  # ...
+
+YAML documents are decoded with gopkg.in/yaml.v3, and validated the same way
+as JSON ones, so anchors, aliases, merge keys and block scalars can be used,
+but mapping keys must be strings, and a file holds a single document.
+
+Stages are inferred from the outputs, the same way as with ratchet.NewGraph.
+A processor named as a dead_letter (see ratchet.DeadLetter) is not part of
+the layout, and can not have outputs or be an output itself.
+
+Values that can't be written down in a document, such as database
+connections or files, are passed to Load as Resources and referred to by name:
+
+	layout, err := config.Load("pipeline.json", config.Resources{
+		"source": db1,
+		"target": db2,
+		"out":    os.Stdout,
+		"errors": os.Stderr,
+	})
+	if err != nil {
+		// e.g. "pipeline.json:9:23: unknown parameter "patern" for processor type RegexpMatcher"
+	}
+	err = <-ratchet.NewBranchingPipeline(layout).Run()
+
+The built-in DataProcessors in the processors package register themselves when
+that package is imported. Custom DataProcessors are registered the same way,
+usually from an init function:
+
+	func init() {
+		config.Register("Geocoder", config.Factory{
+			Params: []config.Param{
+				{Name: "api_key", Type: config.String, Required: true},
+				{Name: "timeout", Type: config.Duration},
+			},
+			New: func(args *config.Args) (ratchet.DataProcessor, error) {
+				return NewGeocoder(args.String("api_key"), args.Duration("timeout")), nil
+			},
+		})
+	}
+*/
+package config
@@ -0,0 +1,146 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// node is a parsed JSON value along with its position in the document,
+// so that validation errors can point at the offending value.
+type node struct {
+	pos   Position
+	value interface{} // string, json.Number, bool, nil, []*node or *object
+}
+
+// object is a parsed JSON object, keeping its keys in document order.
+type object struct {
+	keys   []string
+	keyPos map[string]Position
+	values map[string]*node
+}
+
+// Position is a location within a pipeline definition document.
+type Position struct {
+	File   string
+	Line   int
+	Column int
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+}
+
+// parser builds a tree of nodes from a JSON document.
+type parser struct {
+	file string
+	doc  []byte
+	dec  *json.Decoder
+}
+
+func parseJSON(file string, doc []byte) (*node, error) {
+	p := &parser{file: file, doc: doc, dec: json.NewDecoder(bytes.NewReader(doc))}
+	p.dec.UseNumber()
+	n, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.dec.Token(); err != io.EOF {
+		return nil, errorf(p.position(p.dec.InputOffset()), "unexpected data after the end of the document")
+	}
+	return n, nil
+}
+
+func (p *parser) value() (*node, error) {
+	pos := p.position(p.dec.InputOffset())
+	tok, err := p.dec.Token()
+	if err != nil {
+		return nil, p.syntaxErr(err)
+	}
+	switch tok {
+	case json.Delim('{'):
+		obj := &object{keyPos: make(map[string]Position), values: make(map[string]*node)}
+		for p.dec.More() {
+			keyPos := p.position(p.dec.InputOffset())
+			key, err := p.dec.Token()
+			if err != nil {
+				return nil, p.syntaxErr(err)
+			}
+			k := key.(string)
+			if _, ok := obj.values[k]; ok {
+				return nil, errorf(keyPos, "duplicate key %q", k)
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			obj.keys = append(obj.keys, k)
+			obj.keyPos[k] = keyPos
+			obj.values[k] = v
+		}
+		if _, err := p.dec.Token(); err != nil {
+			return nil, p.syntaxErr(err)
+		}
+		return &node{pos, obj}, nil
+	case json.Delim('['):
+		arr := []*node{}
+		for p.dec.More() {
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		if _, err := p.dec.Token(); err != nil {
+			return nil, p.syntaxErr(err)
+		}
+		return &node{pos, arr}, nil
+	}
+	return &node{pos, tok}, nil
+}
+
+func (p *parser) syntaxErr(err error) error {
+	if err == io.EOF {
+		return errorf(p.position(int64(len(p.doc))), "unexpected end of document")
+	}
+	if serr, ok := err.(*json.SyntaxError); ok {
+		return errorf(p.position(serr.Offset), "%s", serr.Error())
+	}
+	return errorf(p.position(p.dec.InputOffset()), "%s", err.Error())
+}
+
+// position returns the Position of the first value at or after the given
+// byte offset, skipping whitespace and separators.
+func (p *parser) position(offset int64) Position {
+	for offset < int64(len(p.doc)) && bytes.IndexByte([]byte(" \t\r\n:,"), p.doc[offset]) >= 0 {
+		offset++
+	}
+	pos := Position{File: p.file, Line: 1, Column: 1}
+	for _, b := range p.doc[:offset] {
+		if b == '\n' {
+			pos.Line++
+			pos.Column = 1
+		} else {
+			pos.Column++
+		}
+	}
+	return pos
+}
+
+// typeName describes the JSON type of a node in error messages.
+func (n *node) typeName() string {
+	switch n.value.(type) {
+	case string:
+		return "string"
+	case json.Number:
+		return "number"
+	case bool:
+		return "boolean"
+	case []*node:
+		return "array"
+	case *object:
+		return "object"
+	}
+	return "null"
+}
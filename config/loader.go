@@ -0,0 +1,403 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dailyburn/ratchet"
+)
+
+// Resources holds values that DataProcessors can refer to by name from a
+// pipeline definition, through a Resource parameter.
+type Resources map[string]interface{}
+
+// Error is a problem with a pipeline definition, pointing at the location
+// in the document that caused it.
+type Error struct {
+	Position
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return e.Position.String() + ": " + e.Msg
+}
+
+func errorf(pos Position, format string, args ...interface{}) error {
+	return &Error{pos, fmt.Sprintf(format, args...)}
+}
+
+// definition is a single entry in the "processors" list.
+type definition struct {
+	pos        Position
+	id         string
+	typeName   string
+	typePos    Position
+	params     *node
+	outputs    []string
+	outputPos  []Position
+	deadLetter string
+	dlPos      Position
+	inputs     int
+}
+
+// Load reads the pipeline definition in the given file and builds the
+// PipelineLayout it describes. See Parse.
+func Load(filename string, resources Resources) (*ratchet.PipelineLayout, error) {
+	doc, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(filename, doc, resources)
+}
+
+// Parse builds the PipelineLayout described by a pipeline definition document,
+// using the registered Factory for each DataProcessor type. The document is
+// parsed as YAML if the filename ends in .yaml or .yml, and as JSON otherwise;
+// the filename is also used in error messages. Any problem with the document
+// is returned as an *Error.
+func Parse(filename string, doc []byte, resources Resources) (*ratchet.PipelineLayout, error) {
+	parse := parseJSON
+	if ext := strings.ToLower(filepath.Ext(filename)); ext == ".yaml" || ext == ".yml" {
+		parse = parseYAML
+	}
+	root, err := parse(filename, doc)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := expectObject(root, "processors")
+	if err != nil {
+		return nil, err
+	}
+	list, ok := obj.values["processors"]
+	if !ok {
+		return nil, errorf(root.pos, "missing \"processors\"")
+	}
+	items, ok := list.value.([]*node)
+	if !ok {
+		return nil, errorf(list.pos, "\"processors\" must be an array, got %s", list.typeName())
+	}
+	if len(items) == 0 {
+		return nil, errorf(list.pos, "\"processors\" must not be empty")
+	}
+
+	defs := []*definition{}
+	byID := make(map[string]*definition)
+	for _, item := range items {
+		def, err := parseDefinition(item)
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := byID[def.id]; dup {
+			return nil, errorf(def.pos, "duplicate processor id %q", def.id)
+		}
+		defs = append(defs, def)
+		byID[def.id] = def
+	}
+	if err := validateConnections(defs, byID); err != nil {
+		return nil, err
+	}
+
+	processors := make(map[string]ratchet.DataProcessor)
+	for _, def := range defs {
+		p, err := newProcessor(def, resources)
+		if err != nil {
+			return nil, err
+		}
+		processors[def.id] = p
+	}
+
+	g := ratchet.NewGraph()
+	for _, def := range defs {
+		if isDeadLetter(def, defs) {
+			continue
+		}
+		outputs := []ratchet.DataProcessor{}
+		for _, id := range def.outputs {
+			outputs = append(outputs, processors[id])
+		}
+		g.Connect(processors[def.id], outputs...)
+		if def.deadLetter != "" {
+			g.OnError(processors[def.id], ratchet.DeadLetter(processors[def.deadLetter]))
+		}
+	}
+	layout, err := g.Layout()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return layout, nil
+}
+
+func parseDefinition(n *node) (*definition, error) {
+	obj, err := expectObject(n, "id", "type", "params", "outputs", "on_error")
+	if err != nil {
+		return nil, err
+	}
+	def := &definition{pos: n.pos}
+	if def.id, _, err = requireString(n, obj, "id"); err != nil {
+		return nil, err
+	}
+	if def.typeName, def.typePos, err = requireString(n, obj, "type"); err != nil {
+		return nil, err
+	}
+	if params, ok := obj.values["params"]; ok {
+		if _, err := expectObject(params); err != nil {
+			return nil, err
+		}
+		def.params = params
+	}
+	if outputs, ok := obj.values["outputs"]; ok {
+		items, ok := outputs.value.([]*node)
+		if !ok {
+			return nil, errorf(outputs.pos, "\"outputs\" must be an array of processor ids, got %s", outputs.typeName())
+		}
+		for _, item := range items {
+			id, ok := item.value.(string)
+			if !ok {
+				return nil, errorf(item.pos, "output must be a processor id, got %s", item.typeName())
+			}
+			def.outputs = append(def.outputs, id)
+			def.outputPos = append(def.outputPos, item.pos)
+		}
+	}
+	if onError, ok := obj.values["on_error"]; ok {
+		policy, err := expectObject(onError, "dead_letter")
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := policy.values["dead_letter"]; ok {
+			if def.deadLetter, def.dlPos, err = requireString(onError, policy, "dead_letter"); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return def, nil
+}
+
+// validateConnections checks that outputs and dead letters refer to known
+// processors, and that the processors form a single graph without cycles.
+func validateConnections(defs []*definition, byID map[string]*definition) error {
+	for _, def := range defs {
+		for i, id := range def.outputs {
+			out, ok := byID[id]
+			if !ok {
+				return errorf(def.outputPos[i], "unknown processor id %q", id)
+			}
+			if id == def.id {
+				return errorf(def.outputPos[i], "processor %q can not output to itself", id)
+			}
+			out.inputs++
+		}
+		if def.deadLetter != "" {
+			if _, ok := byID[def.deadLetter]; !ok {
+				return errorf(def.dlPos, "unknown processor id %q", def.deadLetter)
+			}
+		}
+	}
+
+	connected := 0
+	for _, def := range defs {
+		if isDeadLetter(def, defs) {
+			if def.inputs > 0 || len(def.outputs) > 0 {
+				return errorf(def.pos, "processor %q is used as a dead letter, so it can not have inputs or outputs", def.id)
+			}
+			continue
+		}
+		connected++
+	}
+	for _, def := range defs {
+		if connected > 1 && !isDeadLetter(def, defs) && def.inputs == 0 && len(def.outputs) == 0 {
+			return errorf(def.pos, "processor %q is dangling, it is not connected to any other processor", def.id)
+		}
+	}
+
+	// Depth-first search for cycles, so they can be reported by id.
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	var path []string
+	var visit func(def *definition) error
+	visit = func(def *definition) error {
+		state[def.id] = visiting
+		path = append(path, def.id)
+		for _, id := range def.outputs {
+			switch state[id] {
+			case visiting:
+				for i := range path {
+					if path[i] == id {
+						return errorf(byID[id].pos, "processors form a cycle: %s -> %s", strings.Join(path[i:], " -> "), id)
+					}
+				}
+			case unvisited:
+				if err := visit(byID[id]); err != nil {
+					return err
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[def.id] = visited
+		return nil
+	}
+	for _, def := range defs {
+		if state[def.id] == unvisited {
+			if err := visit(def); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func isDeadLetter(def *definition, defs []*definition) bool {
+	for _, d := range defs {
+		if d.deadLetter == def.id {
+			return true
+		}
+	}
+	return false
+}
+
+// newProcessor checks the definition's params against its Factory, and calls it.
+func newProcessor(def *definition, resources Resources) (ratchet.DataProcessor, error) {
+	f, ok := lookup(def.typeName)
+	if !ok {
+		return nil, errorf(def.typePos, "unknown processor type %q (registered types are %s)", def.typeName, strings.Join(Types(), ", "))
+	}
+
+	args := &Args{pos: def.pos, values: make(map[string]interface{}), positions: make(map[string]Position)}
+	specs := make(map[string]Param)
+	for _, spec := range f.Params {
+		specs[spec.Name] = spec
+	}
+	if def.params != nil {
+		params := def.params.value.(*object)
+		for _, name := range params.keys {
+			spec, ok := specs[name]
+			if !ok {
+				return nil, errorf(params.keyPos[name], "unknown parameter %q for processor type %s", name, def.typeName)
+			}
+			v, err := convert(spec, params.values[name], resources)
+			if err != nil {
+				return nil, err
+			}
+			args.values[name] = v
+			args.positions[name] = params.values[name].pos
+		}
+	}
+	for _, spec := range f.Params {
+		if spec.Required && !args.Has(spec.Name) {
+			return nil, errorf(def.pos, "processor %q is missing required parameter %q", def.id, spec.Name)
+		}
+	}
+
+	p, err := f.New(args)
+	if err != nil {
+		if _, ok := err.(*Error); ok {
+			return nil, err
+		}
+		return nil, errorf(def.pos, "processor %q: %v", def.id, err)
+	}
+	return p, nil
+}
+
+// convert returns the Go value of a parameter, checking it against its Param.
+func convert(spec Param, n *node, resources Resources) (interface{}, error) {
+	mismatch := func() error {
+		return errorf(n.pos, "parameter %q must be a %s, got %s", spec.Name, spec.Type, n.typeName())
+	}
+	switch spec.Type {
+	case String:
+		if s, ok := n.value.(string); ok {
+			return s, nil
+		}
+	case Int:
+		if num, ok := n.value.(json.Number); ok {
+			i, err := num.Int64()
+			if err != nil {
+				return nil, errorf(n.pos, "parameter %q must be an integer, got %s", spec.Name, num)
+			}
+			return int(i), nil
+		}
+	case Float:
+		if num, ok := n.value.(json.Number); ok {
+			f, err := num.Float64()
+			if err != nil {
+				return nil, errorf(n.pos, "parameter %q: %v", spec.Name, err)
+			}
+			return f, nil
+		}
+	case Bool:
+		if b, ok := n.value.(bool); ok {
+			return b, nil
+		}
+	case Duration:
+		if s, ok := n.value.(string); ok {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return nil, errorf(n.pos, "parameter %q: %v", spec.Name, err)
+			}
+			return d, nil
+		}
+	case StringList:
+		if items, ok := n.value.([]*node); ok {
+			list := []string{}
+			for _, item := range items {
+				s, ok := item.value.(string)
+				if !ok {
+					return nil, errorf(item.pos, "parameter %q must be a %s, got %s in list", spec.Name, spec.Type, item.typeName())
+				}
+				list = append(list, s)
+			}
+			return list, nil
+		}
+	case Resource:
+		if name, ok := n.value.(string); ok {
+			r, ok := resources[name]
+			if !ok {
+				return nil, errorf(n.pos, "parameter %q refers to unknown resource %q", spec.Name, name)
+			}
+			return r, nil
+		}
+	}
+	return nil, mismatch()
+}
+
+// expectObject returns the object held by n, checking that it only
+// uses the given keys (if any are given).
+func expectObject(n *node, keys ...string) (*object, error) {
+	obj, ok := n.value.(*object)
+	if !ok {
+		return nil, errorf(n.pos, "expected an object, got %s", n.typeName())
+	}
+	if len(keys) == 0 {
+		return obj, nil
+	}
+	for _, k := range obj.keys {
+		known := false
+		for _, key := range keys {
+			known = known || k == key
+		}
+		if !known {
+			return nil, errorf(obj.keyPos[k], "unknown key %q (expected one of %s)", k, strings.Join(keys, ", "))
+		}
+	}
+	return obj, nil
+}
+
+func requireString(n *node, obj *object, key string) (string, Position, error) {
+	v, ok := obj.values[key]
+	if !ok {
+		return "", n.pos, errorf(n.pos, "missing %q", key)
+	}
+	s, ok := v.value.(string)
+	if !ok || s == "" {
+		return "", v.pos, errorf(v.pos, "%q must be a non-empty string, got %s", key, v.typeName())
+	}
+	return s, v.pos, nil
+}
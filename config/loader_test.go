@@ -0,0 +1,165 @@
+package config_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/dailyburn/ratchet"
+	"github.com/dailyburn/ratchet/config"
+	"github.com/dailyburn/ratchet/data"
+	"github.com/dailyburn/ratchet/logger"
+	"github.com/dailyburn/ratchet/processors"
+)
+
+func init() {
+	config.Register("Upper", config.Factory{
+		Params: []config.Param{
+			{Name: "suffix", Type: config.String},
+		},
+		New: func(args *config.Args) (ratchet.DataProcessor, error) {
+			suffix := args.String("suffix")
+			return processors.NewFuncTransformer(func(d data.JSON) data.JSON {
+				return data.JSON(strings.ToUpper(string(d)) + suffix)
+			}), nil
+		},
+	})
+}
+
+func TestParse(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	doc := `{
+  "processors": [
+    {"id": "read", "type": "IoReader", "params": {"reader": "in"}, "outputs": ["match"]},
+    {"id": "match", "type": "RegexpMatcher", "params": {"pattern": "^h"}, "outputs": ["upper", "write"]},
+    {"id": "upper", "type": "Upper", "params": {"suffix": "!"}, "outputs": ["write"]},
+    {"id": "write", "type": "IoWriter", "params": {"writer": "out", "add_newline": true}}
+  ]
+}`
+	out := &bytes.Buffer{}
+	layout, err := config.Parse("pipeline.json", []byte(doc), config.Resources{
+		"in":  strings.NewReader("hello\nworld"),
+		"out": out,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-ratchet.NewBranchingPipeline(layout).Run(); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !(lines[0] == "hello" && lines[1] == "HELLO!" || lines[0] == "HELLO!" && lines[1] == "hello") {
+		t.Errorf("Expected hello and HELLO! to be written, got %q", out.String())
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		doc string
+		err string
+	}{
+		{`{"processors": [`, `pipeline.json:1:17: unexpected end of JSON input`},
+		{`{"stages": []}`, `pipeline.json:1:2: unknown key "stages" (expected one of processors)`},
+		{`{"processors": [
+  {"id": "read", "type": "Nope"}
+]}`, `pipeline.json:2:26: unknown processor type "Nope"`},
+		{`{"processors": [
+  {"id": "match", "type": "RegexpMatcher", "params": {"patern": "x"}}
+]}`, `pipeline.json:2:55: unknown parameter "patern" for processor type RegexpMatcher`},
+		{`{"processors": [
+  {"id": "match", "type": "RegexpMatcher", "params": {"pattern": 5}}
+]}`, `pipeline.json:2:66: parameter "pattern" must be a string, got number`},
+		{`{"processors": [
+  {"id": "match", "type": "RegexpMatcher"}
+]}`, `pipeline.json:2:3: processor "match" is missing required parameter "pattern"`},
+		{`{"processors": [
+  {"id": "write", "type": "IoWriter", "params": {"writer": "missing"}}
+]}`, `pipeline.json:2:60: parameter "writer" refers to unknown resource "missing"`},
+		{`{"processors": [
+  {"id": "write", "type": "IoWriter", "params": {"writer": "number"}}
+]}`, `pipeline.json:2:60: writer: resource is a int, expected io.Writer`},
+		{`{"processors": [
+  {"id": "a", "type": "Passthrough", "outputs": ["b"]},
+  {"id": "b", "type": "Passthrough", "outputs": ["c"]}
+]}`, `pipeline.json:3:50: unknown processor id "c"`},
+		{`{"processors": [
+  {"id": "a", "type": "Passthrough", "outputs": ["b"]},
+  {"id": "b", "type": "Passthrough", "outputs": ["a"]}
+]}`, `pipeline.json:2:3: processors form a cycle: a -> b -> a`},
+		{`{"processors": [
+  {"id": "a", "type": "Passthrough", "outputs": ["b"]},
+  {"id": "b", "type": "Passthrough"},
+  {"id": "c", "type": "Passthrough"}
+]}`, `pipeline.json:4:3: processor "c" is dangling`},
+	}
+	for _, test := range tests {
+		_, err := config.Parse("pipeline.json", []byte(test.doc), config.Resources{"number": 5})
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("Expected error %q, got %v", test.err, err)
+		}
+	}
+}
+
+func TestParseYAML(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	doc := `# the same pipeline as in TestParse
+processors:
+  - id: read
+    type: IoReader
+    params: {reader: in}
+    outputs: [match]
+  - id: match
+    type: RegexpMatcher
+    params:
+      pattern: >-  # lines starting with h
+        ^h
+    outputs:
+    - upper
+    - write
+  - {id: upper, type: Upper, params: {suffix: "!"}, outputs: [write]}
+  - id: write
+    type: IoWriter
+    params:
+      <<: {writer: out, add_newline: false}
+      add_newline: true
+`
+	out := &bytes.Buffer{}
+	layout, err := config.Parse("pipeline.yaml", []byte(doc), config.Resources{
+		"in":  strings.NewReader("hello\nworld"),
+		"out": out,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-ratchet.NewBranchingPipeline(layout).Run(); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !(lines[0] == "hello" && lines[1] == "HELLO!" || lines[0] == "HELLO!" && lines[1] == "hello") {
+		t.Errorf("Expected hello and HELLO! to be written, got %q", out.String())
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	tests := []struct {
+		doc string
+		err string
+	}{
+		{"processors:\n\t- id: a", `pipeline.yml:2:1: found character that cannot start any token`},
+		{"processors: [", `pipeline.yml:1:1: did not find expected node content`},
+		{"processors:\n  - id: a\n     type: Passthrough", `pipeline.yml:3:1: mapping values are not allowed in this context`},
+		{"processors:\n  - id: a\n    id: b", `pipeline.yml:3:5: duplicate key "id"`},
+		{"processors: []\n---\nprocessors: []", `pipeline.yml:2:1: multiple documents are not supported`},
+		{"processors:\n  - id: a\n    type: !custom Passthrough", `pipeline.yml:3:11: unsupported tag !custom`},
+		{"processors:\n  - id: match\n    type: RegexpMatcher\n    params:\n      patern: x", `pipeline.yml:5:7: unknown parameter "patern" for processor type RegexpMatcher`},
+		{"processors:\n  - id: match\n    type: RegexpMatcher\n    params: {pattern: 5}", `pipeline.yml:4:23: parameter "pattern" must be a string, got number`},
+	}
+	for _, test := range tests {
+		_, err := config.Parse("pipeline.yml", []byte(test.doc), nil)
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("Expected error %q, got %v", test.err, err)
+		}
+	}
+}
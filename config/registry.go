@@ -0,0 +1,105 @@
+package config
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/dailyburn/ratchet"
+)
+
+// ParamType is the type of value a Param accepts.
+type ParamType int
+
+const (
+	// String accepts a JSON string.
+	String ParamType = iota
+	// Int accepts a JSON number without a fraction.
+	Int
+	// Float accepts any JSON number.
+	Float
+	// Bool accepts true or false.
+	Bool
+	// Duration accepts a string understood by time.ParseDuration, such as "30s".
+	Duration
+	// StringList accepts an array of JSON strings.
+	StringList
+	// Resource accepts the name of a value in the Resources passed to Load,
+	// for things that can't be described in a document such as a *sql.DB
+	// or an io.Writer.
+	Resource
+)
+
+func (t ParamType) String() string {
+	switch t {
+	case String:
+		return "string"
+	case Int:
+		return "integer"
+	case Float:
+		return "number"
+	case Bool:
+		return "boolean"
+	case Duration:
+		return "duration"
+	case StringList:
+		return "list of strings"
+	case Resource:
+		return "resource name"
+	}
+	return "unknown"
+}
+
+// Param describes a parameter accepted by a Factory.
+type Param struct {
+	Name     string
+	Type     ParamType
+	Required bool
+}
+
+// Factory creates DataProcessors of a registered type from the parameters
+// given in a pipeline definition. The parameters are checked against Params
+// before New is called, so New only needs to validate their values.
+type Factory struct {
+	Params []Param
+	New    func(args *Args) (ratchet.DataProcessor, error)
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+// Register makes a DataProcessor type available to pipeline definitions
+// under the given name. It is meant to be called from an init function,
+// the same way as database/sql drivers register themselves, and panics
+// if the name is already taken.
+func Register(typeName string, f Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if f.New == nil {
+		panic("config: Register factory for " + typeName + " is missing New")
+	}
+	if _, dup := registry[typeName]; dup {
+		panic("config: Register called twice for type " + typeName)
+	}
+	registry[typeName] = f
+}
+
+// Types returns the sorted names of all registered DataProcessor types.
+func Types() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := []string{}
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookup(typeName string) (Factory, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	f, ok := registry[typeName]
+	return f, ok
+}
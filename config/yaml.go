@@ -0,0 +1,197 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// yamlErrLine extracts the line number from the errors of the yaml package.
+var yamlErrLine = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// parseYAML builds a tree of nodes from a YAML document, which then goes
+// through the same validation as a JSON one.
+func parseYAML(file string, doc []byte) (*node, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(doc))
+	var root yaml.Node
+	if err := dec.Decode(&root); err != nil {
+		if err == io.EOF {
+			return &node{Position{file, 1, 1}, nil}, nil
+		}
+		return nil, yamlErr(file, err)
+	}
+	var next yaml.Node
+	if err := dec.Decode(&next); err != io.EOF {
+		if err != nil {
+			return nil, yamlErr(file, err)
+		}
+		return nil, errorf(yamlPos(file, &next), "multiple documents are not supported")
+	}
+	c := &yamlConverter{file: file, expanding: make(map[*yaml.Node]bool)}
+	return c.convert(&root)
+}
+
+// yamlErr turns an error of the yaml package into one pointing at its line.
+func yamlErr(file string, err error) error {
+	if m := yamlErrLine.FindStringSubmatch(err.Error()); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		return errorf(Position{file, line, 1}, "%s", m[2])
+	}
+	return errorf(Position{file, 1, 1}, "%s", err.Error())
+}
+
+func yamlPos(file string, n *yaml.Node) Position {
+	return Position{file, n.Line, n.Column}
+}
+
+// yamlConverter converts yaml.Nodes to nodes.
+type yamlConverter struct {
+	file      string
+	expanding map[*yaml.Node]bool // the anchors of the aliases being expanded
+}
+
+func (c *yamlConverter) convert(n *yaml.Node) (*node, error) {
+	pos := yamlPos(c.file, n)
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) == 0 {
+			return &node{pos, nil}, nil
+		}
+		return c.convert(n.Content[0])
+	case yaml.AliasNode:
+		if c.expanding[n.Alias] {
+			return nil, errorf(pos, "alias %q refers to itself", n.Value)
+		}
+		c.expanding[n.Alias] = true
+		defer delete(c.expanding, n.Alias)
+		v, err := c.convert(n.Alias)
+		if err != nil {
+			return nil, err
+		}
+		return &node{pos, v.value}, nil
+	case yaml.SequenceNode:
+		arr := []*node{}
+		for _, item := range n.Content {
+			v, err := c.convert(item)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, v)
+		}
+		return &node{pos, arr}, nil
+	case yaml.MappingNode:
+		obj, err := c.mapping(n)
+		if err != nil {
+			return nil, err
+		}
+		return &node{pos, obj}, nil
+	}
+	v, err := c.scalar(n)
+	if err != nil {
+		return nil, err
+	}
+	return &node{pos, v}, nil
+}
+
+// mapping converts a mapping, including the keys merged into it with "<<",
+// unless they are set explicitly.
+func (c *yamlConverter) mapping(n *yaml.Node) (*object, error) {
+	obj := &object{keyPos: make(map[string]Position), values: make(map[string]*node)}
+	var merged []*object
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+		if key.Kind != yaml.ScalarNode {
+			return nil, errorf(yamlPos(c.file, key), "mapping keys must be strings")
+		}
+		if key.ShortTag() == "!!merge" {
+			m, err := c.merge(value)
+			if err != nil {
+				return nil, err
+			}
+			merged = append(merged, m...)
+			continue
+		}
+		if _, ok := obj.values[key.Value]; ok {
+			return nil, errorf(yamlPos(c.file, key), "duplicate key %q", key.Value)
+		}
+		v, err := c.convert(value)
+		if err != nil {
+			return nil, err
+		}
+		obj.keys = append(obj.keys, key.Value)
+		obj.keyPos[key.Value] = yamlPos(c.file, key)
+		obj.values[key.Value] = v
+	}
+	for _, m := range merged {
+		for _, k := range m.keys {
+			if _, ok := obj.values[k]; ok {
+				continue
+			}
+			obj.keys = append(obj.keys, k)
+			obj.keyPos[k] = m.keyPos[k]
+			obj.values[k] = m.values[k]
+		}
+	}
+	return obj, nil
+}
+
+// merge returns the mappings merged with "<<": a mapping, or a sequence
+// of them, the first ones taking precedence.
+func (c *yamlConverter) merge(n *yaml.Node) ([]*object, error) {
+	items := []*yaml.Node{n}
+	if n.Kind == yaml.SequenceNode {
+		items = n.Content
+	}
+	var objs []*object
+	for _, item := range items {
+		v, err := c.convert(item)
+		if err != nil {
+			return nil, err
+		}
+		obj, ok := v.value.(*object)
+		if !ok {
+			return nil, errorf(v.pos, "only mappings can be merged, got %s", v.typeName())
+		}
+		objs = append(objs, obj)
+	}
+	return objs, nil
+}
+
+// scalar converts a scalar to the value JSON would give it.
+func (c *yamlConverter) scalar(n *yaml.Node) (interface{}, error) {
+	pos := yamlPos(c.file, n)
+	switch n.ShortTag() {
+	case "!!str", "!!timestamp", "!!binary":
+		return n.Value, nil
+	case "!!null":
+		return nil, nil
+	case "!!bool":
+		var b bool
+		if err := n.Decode(&b); err != nil {
+			return nil, errorf(pos, "%s", err.Error())
+		}
+		return b, nil
+	case "!!int":
+		var i interface{}
+		if err := n.Decode(&i); err != nil {
+			return nil, errorf(pos, "%s", err.Error())
+		}
+		return json.Number(fmt.Sprint(i)), nil
+	case "!!float":
+		var f float64
+		if err := n.Decode(&f); err != nil {
+			return nil, errorf(pos, "%s", err.Error())
+		}
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return nil, errorf(pos, "%s is not a valid number", n.Value)
+		}
+		return json.Number(strconv.FormatFloat(f, 'g', -1, 64)), nil
+	}
+	return nil, errorf(pos, "unsupported tag %s", n.Tag)
+}
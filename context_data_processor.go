@@ -0,0 +1,201 @@
+package ratchet
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/dailyburn/ratchet/data"
+	"github.com/dailyburn/ratchet/util"
+)
+
+// Emitter is used by a ContextDataProcessor to send data on to the next
+// stage of processing.
+type Emitter interface {
+	// Emit sends the data to the next stage. If the Pipeline is halted
+	// before the data could be sent, the data is dropped and an error
+	// is returned.
+	Emit(d data.JSON) error
+}
+
+// ContextDataProcessor is an alternative to DataProcessor for implementations
+// that want to report failures by returning an error instead of sending it
+// to a killChan. Returning an error halts execution of the Pipeline, and
+// since ProcessData returns right away no code runs after a fatal error.
+//
+// The given context is cancelled when the Pipeline is halted, so any
+// long-running work should be aborted once ctx is done.
+//
+// A ContextDataProcessor is used within a Pipeline by passing it through
+// Wrap, and an existing DataProcessor can be called as a ContextDataProcessor
+// by passing it through Adapt. A ContextDataProcessor can also implement
+// Concurrency() (see ConcurrentDataProcessor).
+type ContextDataProcessor interface {
+	// ProcessData will be called for each data sent from the previous stage.
+	// Resulting data should be sent on using out.Emit.
+	ProcessData(ctx context.Context, d data.JSON, out Emitter) error
+
+	// Finish will be called after the previous stage has finished sending data,
+	// and no more data will be received by this ContextDataProcessor.
+	Finish(ctx context.Context, out Emitter) error
+}
+
+// ContextAwareDataProcessor is a DataProcessor that can also process data as
+// a ContextDataProcessor, for the context of each payload (e.g. its headers,
+// see HeadersFrom and TraceParent). Within a Pipeline, and when passed
+// through Adapt, ProcessDataContext is called instead of ProcessData.
+type ContextAwareDataProcessor interface {
+	DataProcessor
+	ProcessDataContext(ctx context.Context, d data.JSON, out Emitter) error
+}
+
+// Wrap returns a DataProcessor for the given ContextDataProcessor, so that it
+// can be used with NewPipeline, Do and Outputs. The returned DataProcessor
+// should be used for all of those calls, since layouts compare DataProcessors
+// by identity.
+//
+// When the returned DataProcessor is used outside of a Pipeline, errors
+// returned by the ContextDataProcessor are sent to the killChan.
+func Wrap(p ContextDataProcessor) DataProcessor {
+	if a, ok := p.(*dataProcessorAdapter); ok {
+		return a.DataProcessor
+	}
+	return &wrappedDataProcessor{p}
+}
+
+// Adapt returns a ContextDataProcessor for the given DataProcessor. Errors
+// the DataProcessor sends to its killChan are returned, and once an error
+// is returned anything else the DataProcessor sends is discarded.
+//
+// Note that a DataProcessor has no way of being interrupted, so when ctx is
+// cancelled the adapter returns right away but the underlying ProcessData
+// or Finish call may still be running in the background.
+func Adapt(p DataProcessor) ContextDataProcessor {
+	if w, ok := p.(*wrappedDataProcessor); ok {
+		return w.ContextDataProcessor
+	}
+	return &dataProcessorAdapter{p}
+}
+
+// unwrap returns the ContextDataProcessor behind a Wrap call, or the given
+// DataProcessor itself. It is used to check for optional interfaces such
+// as ConcurrentDataProcessor.
+func unwrap(p DataProcessor) interface{} {
+	if w, ok := p.(*wrappedDataProcessor); ok {
+		return w.ContextDataProcessor
+	}
+	return p
+}
+
+type wrappedDataProcessor struct {
+	ContextDataProcessor
+}
+
+func (w *wrappedDataProcessor) ProcessData(d data.JSON, outputChan chan data.JSON, killChan chan error) {
+	err := w.ContextDataProcessor.ProcessData(context.Background(), d, chanEmitter{outputChan, context.Background()})
+	util.KillPipelineIfErr(err, killChan)
+}
+
+func (w *wrappedDataProcessor) Finish(outputChan chan data.JSON, killChan chan error) {
+	err := w.ContextDataProcessor.Finish(context.Background(), chanEmitter{outputChan, context.Background()})
+	util.KillPipelineIfErr(err, killChan)
+}
+
+func (w *wrappedDataProcessor) String() string {
+	return fmt.Sprintf("%v", w.ContextDataProcessor)
+}
+
+type dataProcessorAdapter struct {
+	DataProcessor
+}
+
+func (a *dataProcessorAdapter) ProcessData(ctx context.Context, d data.JSON, out Emitter) error {
+	if cp, ok := a.DataProcessor.(ContextAwareDataProcessor); ok {
+		return cp.ProcessDataContext(ctx, d, out)
+	}
+	if sp, ok := a.DataProcessor.(SourceAwareDataProcessor); ok {
+		return runDataProcessor(ctx, out, func(outputChan chan data.JSON, killChan chan error) {
+			sp.ProcessDataFrom(d, Source(ctx), outputChan, killChan)
+		})
+	}
+	return runDataProcessor(ctx, out, func(outputChan chan data.JSON, killChan chan error) {
+		a.DataProcessor.ProcessData(d, outputChan, killChan)
+	})
+}
+
+func (a *dataProcessorAdapter) Finish(ctx context.Context, out Emitter) error {
+	return runDataProcessor(ctx, out, a.DataProcessor.Finish)
+}
+
+func (a *dataProcessorAdapter) String() string {
+	return fmt.Sprintf("%v", a.DataProcessor)
+}
+
+// runDataProcessor makes the given ProcessData or Finish call with a private
+// outputChan and killChan, emitting the data sent to outputChan and returning
+// the first error sent to killChan.
+func runDataProcessor(ctx context.Context, out Emitter, call func(outputChan chan data.JSON, killChan chan error)) error {
+	outputChan := make(chan data.JSON)
+	killChan := make(chan error)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var err error
+		defer func() {
+			if err != nil {
+				killChan <- err
+			}
+		}()
+		defer recoverPanic(&err)
+		call(outputChan, killChan)
+	}()
+
+	var err error
+	for err == nil {
+		select {
+		case d, open := <-outputChan:
+			if !open {
+				outputChan = nil
+				continue
+			}
+			err = out.Emit(d)
+		case err = <-killChan:
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			err = ctx.Err()
+			abandon(ctx, done)
+		}
+	}
+
+	// The DataProcessor may keep running after reporting an error,
+	// so discard anything else it sends until it returns.
+	go func() {
+		for {
+			select {
+			case _, open := <-outputChan:
+				if !open {
+					outputChan = nil
+				}
+			case <-killChan:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return err
+}
+
+// chanEmitter emits data on a channel, giving up once ctx is done.
+type chanEmitter struct {
+	c   chan data.JSON
+	ctx context.Context
+}
+
+func (e chanEmitter) Emit(d data.JSON) error {
+	select {
+	case e.c <- d:
+		return nil
+	case <-e.ctx.Done():
+		return e.ctx.Err()
+	}
+}
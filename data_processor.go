@@ -1,11 +1,14 @@
 package ratchet
 
 import (
-	"container/list"
+	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dailyburn/ratchet/data"
+	"github.com/dailyburn/ratchet/logger"
 )
 
 // DataProcessor is the interface that should be implemented to perform data-related
@@ -25,6 +28,41 @@ type DataProcessor interface {
 	Finish(outputChan chan data.JSON, killChan chan error)
 }
 
+// See ContextDataProcessor for an alternative interface that receives a
+// context.Context and reports failures by returning an error.
+
+// CancelableDataProcessor is a DataProcessor that can abort in-flight work,
+// such as a running query or HTTP request, when the pipeline is halted.
+// SetContext is called with the pipeline's context before any data is
+// sent to the DataProcessor, and that context is cancelled when the
+// Pipeline is halted (see Pipeline.RunContext).
+//
+// A ContextDataProcessor wrapping other DataProcessors can implement
+// SetContext as well, in order to pass the context on to them.
+type CancelableDataProcessor interface {
+	DataProcessor
+	SetContext(ctx context.Context)
+}
+
+type contextSetter interface {
+	SetContext(ctx context.Context)
+}
+
+// isCancelable returns true if the given DataProcessor implements CancelableDataProcessor
+// (or is a wrapped ContextDataProcessor implementing SetContext).
+func isCancelable(p DataProcessor) bool {
+	_, ok := unwrap(p).(contextSetter)
+	return ok
+}
+
+// CounterProvider is implemented by DataProcessors that keep counters of
+// their own, such as the number of retried calls. The counters are
+// included in Pipeline.Stats. Counters may be called while the DataProcessor
+// is running, so it must be safe for concurrent use.
+type CounterProvider interface {
+	Counters() map[string]int64
+}
+
 // dataProcessor is a type used internally to the Pipeline management
 // code, and wraps a DataProcessor instance. DataProcessor is the main
 // interface that should be implemented to perform work within the data
@@ -32,60 +70,101 @@ type DataProcessor interface {
 // helpful channel management and other attributes.
 type dataProcessor struct {
 	DataProcessor
+	proc ContextDataProcessor // DataProcessor, adapted to ContextDataProcessor
 	executionStat
 	concurrentDataProcessor
+	activity
+	abandonedCalls
+	heldAcks
 	chanBrancher
 	chanMerger
-	outputs    []DataProcessor
-	inputChan  chan data.JSON
-	outputChan chan data.JSON
+	outputs     []DataProcessor
+	inputChan   chan message
+	outputChan  chan message
+	stage       int // set when the Pipeline is run
+	errorPolicy ErrorPolicy
+	deadLetter  *dataProcessor // set when errorPolicy has a dead letter DataProcessor
+	routes      []*route
+	routingMode RoutingMode
+	unrouted    int64 // payloads that didn't match any route
+	partitioner Partitioner
+	partitions  []*route       // set by Partition, one for each replica
+	checkpoints *checkpointLog // set when the Pipeline is checkpointing a Checkpointer
+	tracer      *tracer        // set when the Pipeline is tracing, see Tracing
+	// set by Timeout
+	processDataTimeout time.Duration
+	finishTimeout      time.Duration
 }
 
 type chanBrancher struct {
-	branchOutChans []chan data.JSON
+	branchOutChans  []chan message
+	branchOutCounts []int64      // payloads sent on each of branchOutChans
+	sink            chan message // receives the output of a SubPipeline's final DataProcessors
+	sinkWait        *sync.WaitGroup
 }
 
-func (dp *dataProcessor) branchOut() {
+func (dp *dataProcessor) branchOut(ctx context.Context, wg *sync.WaitGroup) {
+	wg.Add(1)
 	go func() {
-		for d := range dp.outputChan {
-			for _, out := range dp.branchOutChans {
+		defer wg.Done()
+		for m := range dp.outputChan {
+			d := m.data
+			send := dp.routeTo(d)
+			for i, out := range dp.branchOutChans {
+				if send != nil && !send[i] {
+					continue
+				}
 				// Make a copy to ensure concurrent stages
 				// can alter data as needed.
 				dc := make(data.JSON, len(d))
 				copy(dc, d)
-				out <- dc
+				holdAll(m.trackers)
+				// Once the pipeline is halted the data is discarded,
+				// but outputChan is still drained until it's closed.
+				select {
+				case out <- message{data: dc, headers: m.headers, trackers: m.trackers}:
+					atomic.AddInt64(&dp.branchOutCounts[i], 1)
+				case <-ctx.Done():
+				}
+			}
+			if dp.sink != nil {
+				holdAll(m.trackers)
+				select {
+				case dp.sink <- m:
+				case <-ctx.Done():
+				}
 			}
 			dp.recordDataSent(d)
+			// Each copy sent on holds the trackers, so the data emitted
+			// itself is done with.
+			releaseAll(m.trackers)
 		}
 		// Once all data is received, also close all the outputs
 		for _, out := range dp.branchOutChans {
 			close(out)
 		}
+		if dp.sink != nil {
+			dp.sinkWait.Done()
+		}
 	}()
 }
 
 type chanMerger struct {
-	mergeInChans []chan data.JSON
+	mergeInChans []chan message
+	mergeFrom    []DataProcessor // the upstream DataProcessor for each of mergeInChans
 	mergeWait    sync.WaitGroup
+	mergeMode    MergeMode
+	mergeKey     func(d data.JSON) string // set by MergeSorted
+	mergeQueued  int64                    // the payloads held by mergeQueue
 }
 
-func (dp *dataProcessor) mergeIn() {
-	// Start a merge goroutine for each input channel.
-	mergeData := func(c chan data.JSON) {
-		for d := range c {
-			dp.inputChan <- d
-		}
-		dp.mergeWait.Done()
-	}
-	dp.mergeWait.Add(len(dp.mergeInChans))
-	for _, in := range dp.mergeInChans {
-		go mergeData(in)
+// buffered returns the number of payloads waiting to be processed.
+func (m *chanMerger) buffered() int {
+	n := int(atomic.LoadInt64(&m.mergeQueued))
+	for _, c := range m.mergeInChans {
+		n += len(c)
 	}
-
-	go func() {
-		dp.mergeWait.Wait()
-		close(dp.inputChan)
-	}()
+	return n
 }
 
 // Do takes a DataProcessor instance and returns the dataProcessor
@@ -96,29 +175,120 @@ func (dp *dataProcessor) mergeIn() {
 // See the ratchet package documentation for code examples of creating
 // a new branching pipeline layout.
 func Do(processor DataProcessor) *dataProcessor {
-	dp := dataProcessor{DataProcessor: processor}
-	dp.outputChan = make(chan data.JSON)
-	dp.inputChan = make(chan data.JSON)
+	dp := dataProcessor{DataProcessor: processor, proc: Adapt(processor)}
+	dp.outputChan = make(chan message)
+	dp.inputChan = make(chan message)
 
 	if isConcurrent(processor) {
-		dp.concurrency = processor.(ConcurrentDataProcessor).Concurrency()
-		dp.workThrottle = make(chan workSignal, dp.concurrency)
-		dp.workList = list.New()
-		dp.doneChan = make(chan bool)
-		dp.inputClosed = false
+		dp.concurrency = unwrap(processor).(concurrent).Concurrency()
+	}
+	if u, ok := unwrap(processor).(unordered); ok {
+		dp.unordered = true
+		dp.window = u.ReorderWindow()
 	}
 
 	return &dp
 }
 
+// DoAll calls Do for each of the given DataProcessors, which is handy
+// for putting Replicas in a PipelineStage:
+//
+//	ratchet.NewPipelineStage(ratchet.DoAll(writers...)...)
+func DoAll(processors ...DataProcessor) []*dataProcessor {
+	dps := make([]*dataProcessor, len(processors))
+	for i, p := range processors {
+		dps[i] = Do(p)
+	}
+	return dps
+}
+
 // Outputs should be called to specify which DataProcessor instances the current
 // processor should send it's output to. See the ratchet package
 // documentation for code examples and diagrams.
 func (dp *dataProcessor) Outputs(processors ...DataProcessor) *dataProcessor {
 	dp.outputs = processors
+	if len(dp.routes) > 0 || len(dp.partitions) > 0 {
+		// keep the outputs added by Route, Default and Partition
+		dp.outputs = append([]DataProcessor{}, processors...)
+		for _, r := range dp.allRoutes() {
+			dp.addOutput(r.to)
+		}
+	}
 	return dp
 }
 
+// finish calls Finish on the wrapped DataProcessor, sending any
+// returned error to killChan.
+func (dp *dataProcessor) finish(ctx context.Context, killChan chan error) {
+	// Finish has no payload, so the data it emits starts new traces.
+	ctx, _ = dp.startSpan(ctx)
+	err := dp.callFinish(ctx, outputEmitter{dp.outputChan, ctx})
+	if _, ok := unwrap(dp.DataProcessor).(Committer); !ok || err != nil {
+		// A Committer's acks are held until it's committed.
+		dp.releaseAcks(err == nil)
+	}
+	if err != nil {
+		dp.recordError()
+	}
+	dp.reportErr(ctx, err, killChan)
+}
+
+// reportErr sends err to killChan, unless the pipeline has already been
+// halted, or its initial stage stopped for a drain (in which case err is
+// most likely a consequence of that).
+func (dp *dataProcessor) reportErr(ctx context.Context, err error, killChan chan error) {
+	if err == nil {
+		return
+	}
+	if ctx.Err() != nil {
+		logger.Info(dp, "error after halting:", err.Error())
+		return
+	}
+	logger.Error(dp, "error:", err.Error())
+	select {
+	case killChan <- err:
+	case <-ctx.Done():
+	}
+}
+
+// OnError sets the ErrorPolicy used when the DataProcessor fails to process
+// a payload. The default is HaltOnError. See the ErrorPolicy documentation.
+func (dp *dataProcessor) OnError(policy ErrorPolicy) *dataProcessor {
+	dp.errorPolicy = policy
+	return dp
+}
+
+// handleErr applies the ErrorPolicy to an error returned while processing d,
+// and releases the trackers of d once it has been processed successfully.
+func (dp *dataProcessor) handleErr(ctx context.Context, d data.JSON, err error, killChan chan error) {
+	if err == nil {
+		dp.deferAck(ctx)
+		releaseAll(messageFrom(ctx).trackers)
+		return
+	}
+	dp.recordError()
+	if he, ok := err.(*haltError); ok {
+		dp.reportErr(ctx, he.err, killChan)
+		return
+	}
+	if dp.deadLetter == nil {
+		dp.reportErr(ctx, err, killChan)
+		return
+	}
+	logger.Error(dp, "error:", err.Error(), "- sending data to dead letter", dp.deadLetter)
+	dd, err := newDeadLetterData(dp, d, err)
+	if err != nil {
+		dp.reportErr(ctx, err, killChan)
+		return
+	}
+	// The dead letter takes over the trackers of d, and keeps its headers.
+	m := messageFrom(ctx)
+	select {
+	case dp.deadLetter.inputChan <- message{data: dd, from: dp.DataProcessor, headers: m.headers, trackers: m.trackers}:
+	case <-ctx.Done():
+	}
+}
+
 // pass through String output to the DataProcessor
 func (dp *dataProcessor) String() string {
 	return fmt.Sprintf("%v", dp.DataProcessor)
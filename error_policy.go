@@ -0,0 +1,74 @@
+package ratchet
+
+import (
+	"encoding/json"
+
+	"github.com/dailyburn/ratchet/data"
+)
+
+// ErrorPolicy determines what happens when a DataProcessor fails to process
+// a payload, i.e. sends an error to its killChan (or returns one, in the case
+// of a ContextDataProcessor). It is set per DataProcessor when creating a
+// PipelineLayout:
+//
+//	ratchet.Do(writer).OnError(ratchet.DeadLetter(quarantine))
+//
+// Errors from Finish always halt the Pipeline, since there is no payload
+// that could be set aside.
+type ErrorPolicy struct {
+	deadLetter DataProcessor
+}
+
+// HaltOnError is the default ErrorPolicy. The Pipeline is halted and the
+// error is sent on the killChan returned by Run.
+var HaltOnError = ErrorPolicy{}
+
+// DeadLetter returns an ErrorPolicy that sends failed payloads to the given
+// DataProcessor instead of halting the Pipeline. It receives a DeadLetterData
+// object for each failure, so any DataProcessor able to store JSON (such as
+// an IoWriter or SQLWriter) can be used to quarantine bad records.
+//
+// The dead-letter DataProcessor runs in its own goroutine alongside the
+// Pipeline, and should not be part of the PipelineLayout itself. The same
+// instance can be shared by several DataProcessors, and Finish is called on
+// it once all stages are done. Data it sends is discarded, and errors it
+// reports halt the Pipeline.
+func DeadLetter(p DataProcessor) ErrorPolicy {
+	return ErrorPolicy{deadLetter: p}
+}
+
+// haltError is returned from ProcessData for an error that can't be tied to
+// the payload being processed, so that it halts the Pipeline regardless of
+// the ErrorPolicy.
+type haltError struct {
+	err error
+}
+
+func (e *haltError) Error() string {
+	return e.err.Error()
+}
+
+// DeadLetterData is sent to the dead-letter DataProcessor for each payload
+// that failed processing.
+type DeadLetterData struct {
+	Error     string          `json:"error"`
+	Processor string          `json:"processor"`
+	Stage     int             `json:"stage"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// newDeadLetterData builds the DeadLetterData JSON for a failed payload. The
+// payload is embedded as-is if it is valid JSON, and as a string otherwise.
+func newDeadLetterData(dp *dataProcessor, d data.JSON, err error) (data.JSON, error) {
+	dd := DeadLetterData{Error: err.Error(), Processor: dp.String(), Stage: dp.stage}
+	if json.Valid(d) {
+		dd.Data = json.RawMessage(d)
+	} else {
+		s, err := data.NewJSON(string(d))
+		if err != nil {
+			return nil, err
+		}
+		dd.Data = json.RawMessage(s)
+	}
+	return data.NewJSON(dd)
+}
@@ -1,48 +1,78 @@
 package ratchet
 
 import (
+	"sync"
 	"time"
 
 	"github.com/dailyburn/ratchet/data"
 )
 
+// executionStat gathers the stats for a dataProcessor. The record methods
+// are called from several goroutines (e.g. for a ConcurrentDataProcessor),
+// so every field is guarded by mu.
 type executionStat struct {
-	dataSentCounter     int
-	dataReceivedCounter int
-	executionsCounter   int
-	totalExecutionTime  float64
-	avgExecutionTime    float64
-	totalBytesReceived  int
-	avgBytesReceived    int
-	totalBytesSent      int
-	avgBytesSent        int
+	mu             sync.Mutex
+	executionTimes histogram // nanoseconds per ProcessData call
+	bytesReceived  histogram // size of each payload received
+	bytesSent      histogram // size of each payload sent
+	errorCounter   int
+	startTime      time.Time // when the first payload was received
+	finishTime     time.Time // when the output was closed
 }
 
 func (s *executionStat) recordExecution(foo func()) {
-	s.executionsCounter++
 	st := time.Now()
 	foo()
-	s.totalExecutionTime += time.Now().Sub(st).Seconds()
+	d := time.Now().Sub(st)
+	s.mu.Lock()
+	s.executionTimes.record(int64(d))
+	s.mu.Unlock()
 }
 
 func (s *executionStat) recordDataSent(d data.JSON) {
-	s.dataSentCounter++
-	s.totalBytesSent += len(d)
+	s.mu.Lock()
+	s.bytesSent.record(int64(len(d)))
+	s.mu.Unlock()
 }
 
 func (s *executionStat) recordDataReceived(d data.JSON) {
-	s.dataReceivedCounter++
-	s.totalBytesReceived += len(d)
+	s.mu.Lock()
+	if s.startTime.IsZero() {
+		s.startTime = time.Now()
+	}
+	s.bytesReceived.record(int64(len(d)))
+	s.mu.Unlock()
 }
 
-func (s *executionStat) calculate() {
-	if s.executionsCounter > 0 {
-		s.avgExecutionTime = (s.totalExecutionTime / float64(s.executionsCounter))
-	}
-	if s.dataReceivedCounter > 0 {
-		s.avgBytesReceived = (s.totalBytesReceived / s.dataReceivedCounter)
-	}
-	if s.dataSentCounter > 0 {
-		s.avgBytesSent = (s.totalBytesSent / s.dataSentCounter)
-	}
+func (s *executionStat) recordError() {
+	s.mu.Lock()
+	s.errorCounter++
+	s.mu.Unlock()
+}
+
+func (s *executionStat) recordFinish() {
+	s.mu.Lock()
+	s.finishTime = time.Now()
+	s.mu.Unlock()
+}
+
+// report fills in the stats gathered so far.
+func (s *executionStat) report(ps *ProcessorStats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ps.PayloadsSent = int(s.bytesSent.count)
+	ps.PayloadsReceived = int(s.bytesReceived.count)
+	ps.BytesSent = int(s.bytesSent.sum)
+	ps.BytesReceived = int(s.bytesReceived.sum)
+	ps.AvgBytesSent = int(s.bytesSent.avg())
+	ps.AvgBytesReceived = int(s.bytesReceived.avg())
+	ps.Executions = int(s.executionTimes.count)
+	ps.TotalExecutionTime = time.Duration(s.executionTimes.sum)
+	ps.AvgExecutionTime = time.Duration(s.executionTimes.avg())
+	ps.ExecutionTimes = s.executionTimes.distribution()
+	ps.PayloadSizesSent = s.bytesSent.distribution()
+	ps.PayloadSizesReceived = s.bytesReceived.distribution()
+	ps.Errors = s.errorCounter
+	ps.Started = s.startTime
+	ps.Finished = s.finishTime
 }
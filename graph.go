@@ -0,0 +1,221 @@
+package ratchet
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Graph builds a PipelineLayout from the connections between DataProcessors,
+// rather than from explicit PipelineStages. Stages are inferred from the
+// connections, so a DataProcessor can send data to another DataProcessor any
+// number of stages later without padding the layout with Passthroughs:
+//
+//	layout, err := ratchet.NewGraph().
+//	        Connect(reader, transformer, writer).
+//	        Connect(transformer, writer).
+//	        Layout()
+//
+// DataProcessors without inputs make up the first stage and receive the
+// StartSignal. Every other DataProcessor is placed in the stage after the
+// latest of its inputs, so a DataProcessor starts receiving data as soon as
+// it would have in an equivalent hand-written PipelineLayout.
+type Graph struct {
+	nodes    []DataProcessor
+	outputs  map[DataProcessor][]DataProcessor
+	inputs   map[DataProcessor][]DataProcessor
+	policies map[DataProcessor]ErrorPolicy
+	err      error
+}
+
+// NewGraph returns an empty Graph.
+func NewGraph() *Graph {
+	return &Graph{
+		outputs:  make(map[DataProcessor][]DataProcessor),
+		inputs:   make(map[DataProcessor][]DataProcessor),
+		policies: make(map[DataProcessor]ErrorPolicy),
+	}
+}
+
+// Add adds DataProcessors to the Graph without connecting them. This is only
+// needed for a single DataProcessor Graph, since every other DataProcessor
+// must be connected to the rest of the Graph.
+func (g *Graph) Add(processors ...DataProcessor) *Graph {
+	for _, p := range processors {
+		g.add(p)
+	}
+	return g
+}
+
+// Connect sends the output of the from DataProcessor to each of the
+// given DataProcessors. Connecting the same DataProcessors more than
+// once has no further effect.
+func (g *Graph) Connect(from DataProcessor, to ...DataProcessor) *Graph {
+	g.add(from)
+	for _, p := range to {
+		if !g.add(p) || from == nil {
+			continue
+		}
+		if from == p {
+			g.setErr(fmt.Errorf("DataProcessor (%v) can not be connected to itself", from))
+			continue
+		}
+		if !hasDataProcessor(g.outputs[from], p) {
+			g.outputs[from] = append(g.outputs[from], p)
+			g.inputs[p] = append(g.inputs[p], from)
+		}
+	}
+	return g
+}
+
+// OnError sets the ErrorPolicy for the given DataProcessor, the same as
+// Do(p).OnError(policy) does when creating a PipelineLayout by hand.
+func (g *Graph) OnError(p DataProcessor, policy ErrorPolicy) *Graph {
+	if g.add(p) {
+		g.policies[p] = policy
+	}
+	return g
+}
+
+// add adds p as a node, returning false if p is nil.
+func (g *Graph) add(p DataProcessor) bool {
+	if p == nil {
+		g.setErr(errors.New("can not add a nil DataProcessor to a Graph"))
+		return false
+	}
+	if !hasDataProcessor(g.nodes, p) {
+		g.nodes = append(g.nodes, p)
+	}
+	return true
+}
+
+func (g *Graph) setErr(err error) {
+	if g.err == nil {
+		g.err = err
+	}
+}
+
+// Layout validates the Graph and returns the equivalent PipelineLayout,
+// to be run with NewBranchingPipeline. An error is returned if:
+//  1. The Graph is empty.
+//  2. A DataProcessor is not connected to any other DataProcessor.
+//  3. The connections form a cycle.
+//  4. A DataProcessor is unreachable, because it is fed by a cycle.
+func (g *Graph) Layout() (*PipelineLayout, error) {
+	if g.err != nil {
+		return nil, g.err
+	}
+	if len(g.nodes) == 0 {
+		return nil, errors.New("Graph does not have any DataProcessors")
+	}
+	if len(g.nodes) > 1 {
+		for _, p := range g.nodes {
+			if len(g.inputs[p]) == 0 && len(g.outputs[p]) == 0 {
+				return nil, fmt.Errorf("DataProcessor (%v) is dangling, it is not connected to any other DataProcessor", p)
+			}
+		}
+	}
+
+	// Assign stages in topological order (Kahn's algorithm), placing each
+	// DataProcessor one stage after the latest of its inputs.
+	stageNums := make(map[DataProcessor]int)
+	pending := make(map[DataProcessor]int)
+	queue := []DataProcessor{}
+	for _, p := range g.nodes {
+		pending[p] = len(g.inputs[p])
+		if pending[p] == 0 {
+			queue = append(queue, p)
+		}
+	}
+	sorted := []DataProcessor{}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		sorted = append(sorted, p)
+		for _, out := range g.outputs[p] {
+			if stageNums[p]+1 > stageNums[out] {
+				stageNums[out] = stageNums[p] + 1
+			}
+			pending[out]--
+			if pending[out] == 0 {
+				queue = append(queue, out)
+			}
+		}
+	}
+	if len(sorted) < len(g.nodes) {
+		return nil, g.cycleErr(pending)
+	}
+
+	// Build the stages, keeping the order DataProcessors were added in.
+	numStages := 0
+	for _, p := range g.nodes {
+		if stageNums[p]+1 > numStages {
+			numStages = stageNums[p] + 1
+		}
+	}
+	stages := make([]*PipelineStage, numStages)
+	for i := range stages {
+		stages[i] = NewPipelineStage()
+	}
+	for _, p := range g.nodes {
+		dp := Do(p)
+		if len(g.outputs[p]) > 0 {
+			dp.Outputs(g.outputs[p]...)
+		}
+		if policy, ok := g.policies[p]; ok {
+			dp.OnError(policy)
+		}
+		stages[stageNums[p]].processors = append(stages[stageNums[p]].processors, dp)
+	}
+	return &PipelineLayout{stages}, nil
+}
+
+// cycleErr describes why the remaining (pending) DataProcessors could not be
+// sorted: either they are part of a cycle, or they are fed by one.
+func (g *Graph) cycleErr(pending map[DataProcessor]int) error {
+	// Walk backwards through unsorted inputs until a DataProcessor repeats.
+	var p DataProcessor
+	for _, n := range g.nodes {
+		if pending[n] > 0 {
+			p = n
+			break
+		}
+	}
+	start := p
+	visited := make(map[DataProcessor]int)
+	path := []DataProcessor{}
+	for {
+		if i, ok := visited[p]; ok {
+			path = path[i:]
+			break
+		}
+		visited[p] = len(path)
+		path = append(path, p)
+		for _, in := range g.inputs[p] {
+			if pending[in] > 0 {
+				p = in
+				break
+			}
+		}
+	}
+
+	names := []string{}
+	for i := len(path) - 1; i >= 0; i-- {
+		names = append(names, fmt.Sprintf("%v", path[i]))
+	}
+	names = append(names, names[0])
+	cycle := strings.Join(names, " -> ")
+	if !hasDataProcessor(path, start) {
+		return fmt.Errorf("DataProcessor (%v) is unreachable, it is fed by the cycle %s", start, cycle)
+	}
+	return fmt.Errorf("Graph has a cycle: %s", cycle)
+}
+
+func hasDataProcessor(processors []DataProcessor, p DataProcessor) bool {
+	for i := range processors {
+		if processors[i] == p {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package ratchet
+
+import (
+	"context"
+
+	"github.com/dailyburn/ratchet/data"
+)
+
+// Headers are metadata about a payload, such as where it was read from,
+// that travel alongside it through a Pipeline rather than being mixed into
+// the data itself. The data emitted while processing a payload inherits its
+// headers, so they reach the later stages (and dead letters) through any
+// DataProcessor, including those that know nothing about them.
+//
+// A ContextDataProcessor reads the headers of the payload it is processing
+// with HeadersFrom, and adds to the headers of the data it emits with
+// WithHeaders. Since they are shared by the payloads derived from one
+// another, Headers must not be modified once emitted.
+type Headers map[string]string
+
+// Well-known header keys. The readers in the processors package set the
+// provenance of the data they read in ProcessFrom (see DataTracker).
+const (
+	HeaderFile        = "file"        // the file or S3 object the payload was read from
+	HeaderLine        = "line"        // the line number within it, counting from 1
+	HeaderQuery       = "query"       // the SQL query that returned the payload
+	HeaderReadAt      = "read-at"     // when the payload was read, in RFC 3339 format
+	HeaderTraceParent = "traceparent" // the W3C trace context the payload belongs to
+)
+
+// Envelope is a payload along with its Headers, e.g. to send a payload to a
+// Pipeline with Input.EmitEnvelope.
+type Envelope struct {
+	Headers Headers
+	Data    data.JSON
+}
+
+// HeadersFrom returns the headers of the payload being processed, for use in
+// ContextDataProcessor.ProcessData. It returns nil outside of a Pipeline, or
+// if the payload has no headers. The returned Headers must not be modified.
+func HeadersFrom(ctx context.Context) Headers {
+	return messageFrom(ctx).headers
+}
+
+// WithHeaders returns an Emitter adding h to the headers of the data emitted
+// with it, on top of (and replacing) those inherited from the payload being
+// processed:
+//
+//	out = ratchet.WithHeaders(out, ratchet.Headers{ratchet.HeaderFile: path})
+//
+// If out is a CheckpointEmitter, so is the returned Emitter. Outside of a
+// Pipeline, the headers are dropped.
+func WithHeaders(out Emitter, h Headers) Emitter {
+	te, ok := out.(trackingEmitter)
+	if !ok {
+		return out
+	}
+	h = Headers(nil).with(h)
+	if ce, ok := out.(trackingCheckpointEmitter); ok {
+		return headersCheckpointEmitter{ce, h}
+	}
+	return headersEmitter{te, h}
+}
+
+// with returns h along with more, replacing the values of the same keys,
+// without modifying either of them.
+func (h Headers) with(more Headers) Headers {
+	if len(more) == 0 {
+		return h
+	}
+	merged := make(Headers, len(h)+len(more))
+	for k, v := range h {
+		merged[k] = v
+	}
+	for k, v := range more {
+		merged[k] = v
+	}
+	return merged
+}
+
+// headersEmitter emits data adding the headers given to WithHeaders.
+type headersEmitter struct {
+	out trackingEmitter
+	h   Headers
+}
+
+func (e headersEmitter) Emit(d data.JSON) error {
+	return e.emitTracked(d, nil)
+}
+
+func (e headersEmitter) emitTracked(d data.JSON, h Headers, ts ...*tracker) error {
+	return e.out.emitTracked(d, e.h.with(h), ts...)
+}
+
+// headersCheckpointEmitter is a headersEmitter for a Checkpointer.
+type headersCheckpointEmitter struct {
+	out trackingCheckpointEmitter
+	h   Headers
+}
+
+func (e headersCheckpointEmitter) Emit(d data.JSON) error {
+	return e.emitTracked(d, nil)
+}
+
+func (e headersCheckpointEmitter) emitTracked(d data.JSON, h Headers, ts ...*tracker) error {
+	return e.out.emitTracked(d, e.h.with(h), ts...)
+}
+
+func (e headersCheckpointEmitter) EmitAt(d data.JSON, position data.JSON) error {
+	return e.emitAt(d, position, nil)
+}
+
+func (e headersCheckpointEmitter) emitAt(d data.JSON, position data.JSON, h Headers, ts ...*tracker) error {
+	return e.out.emitAt(d, position, e.h.with(h), ts...)
+}
@@ -0,0 +1,120 @@
+package ratchet
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// histogramSubBuckets is the number of buckets each power of two is split
+// into, so quantiles are accurate to within 1/histogramSubBuckets (~3%).
+const (
+	subBucketBits       = 5
+	histogramSubBuckets = 1 << subBucketBits
+)
+
+// histogram records the distribution of non-negative values in log-linear
+// buckets, using memory proportional to the range of values rather than
+// their number. It is not safe for concurrent use; see executionStat.
+type histogram struct {
+	buckets map[int]int64
+	count   int64
+	sum     int64
+	min     int64
+	max     int64
+}
+
+// Distribution summarizes the values recorded for a stat, such as the
+// execution time of ProcessData calls or the size of payloads. The
+// quantiles are approximate, but never off by more than 3%.
+type Distribution struct {
+	Count int64 `json:"count"`
+	Min   int64 `json:"min"`
+	Max   int64 `json:"max"`
+	P50   int64 `json:"p50"`
+	P95   int64 `json:"p95"`
+	P99   int64 `json:"p99"`
+}
+
+func (h *histogram) record(v int64) {
+	if v < 0 {
+		v = 0
+	}
+	if h.buckets == nil {
+		h.buckets = make(map[int]int64)
+	}
+	h.buckets[bucketOf(v)]++
+	if h.count == 0 || v < h.min {
+		h.min = v
+	}
+	if v > h.max {
+		h.max = v
+	}
+	h.count++
+	h.sum += v
+}
+
+// avg returns the mean of the recorded values, or 0 if there are none.
+func (h *histogram) avg() int64 {
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / h.count
+}
+
+func (h *histogram) distribution() Distribution {
+	return Distribution{
+		Count: h.count,
+		Min:   h.min,
+		Max:   h.max,
+		P50:   h.quantile(0.5),
+		P95:   h.quantile(0.95),
+		P99:   h.quantile(0.99),
+	}
+}
+
+// quantile returns the upper bound of the bucket holding the q-th quantile,
+// capped to the largest recorded value.
+func (h *histogram) quantile(q float64) int64 {
+	if h.count == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(h.count)))
+	indexes := make([]int, 0, len(h.buckets))
+	for i := range h.buckets {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	var seen int64
+	for _, i := range indexes {
+		seen += h.buckets[i]
+		if seen >= rank {
+			if upper := bucketUpperBound(i); upper < h.max {
+				return upper
+			}
+			break
+		}
+	}
+	return h.max
+}
+
+// bucketOf returns the bucket for v. Values below histogramSubBuckets get a
+// bucket each, after that every power of two is split into
+// histogramSubBuckets buckets of equal width.
+func bucketOf(v int64) int {
+	if v < histogramSubBuckets {
+		return int(v)
+	}
+	exp := bits.Len64(uint64(v)) - 1
+	shift := uint(exp - subBucketBits)
+	return (exp-subBucketBits+1)*histogramSubBuckets + int(v>>shift) - histogramSubBuckets
+}
+
+func bucketUpperBound(i int) int64 {
+	if i < histogramSubBuckets {
+		return int64(i)
+	}
+	shift := uint(i/histogramSubBuckets - 1)
+	sub := int64(i%histogramSubBuckets + histogramSubBuckets)
+	return (sub+1)<<shift - 1
+}
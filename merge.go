@@ -0,0 +1,229 @@
+package ratchet
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/dailyburn/ratchet/data"
+)
+
+// MergeMode determines the order in which a DataProcessor with more than one
+// input receives the payloads sent by its upstream DataProcessors.
+// See Merge.
+type MergeMode int
+
+const (
+	// MergeInterleaved passes payloads on as soon as they arrive from any
+	// input, so their order is nondeterministic. This is the default.
+	MergeInterleaved MergeMode = iota
+	// MergeRoundRobin takes one payload from each input in turn, skipping
+	// inputs once they are closed.
+	MergeRoundRobin
+	// MergeSequential passes on every payload from the first input, then
+	// every payload from the second, and so on.
+	MergeSequential
+	// mergeSorted is set by MergeSorted.
+	mergeSorted
+)
+
+// message is a payload sent between DataProcessors.
+type message struct {
+	data     data.JSON
+	from     DataProcessor // the upstream DataProcessor, nil for the StartSignal
+	headers  Headers       // see Headers
+	trackers []*tracker    // see tracker
+}
+
+// Source returns the upstream DataProcessor that sent the payload being
+// processed, for use in ContextDataProcessor.ProcessData when a DataProcessor
+// has more than one input. For payloads sent to a dead-letter DataProcessor,
+// it returns the DataProcessor that failed. It returns nil for the StartSignal.
+// A DataProcessor can implement SourceAwareDataProcessor instead.
+func Source(ctx context.Context) DataProcessor {
+	return messageFrom(ctx).from
+}
+
+// SourceAwareDataProcessor is a DataProcessor that is given the upstream
+// DataProcessor that sent each payload, as a ContextDataProcessor can get it
+// with Source. Within a Pipeline, and when passed through Adapt,
+// ProcessDataFrom is called instead of ProcessData.
+type SourceAwareDataProcessor interface {
+	DataProcessor
+	ProcessDataFrom(d data.JSON, from DataProcessor, outputChan chan data.JSON, killChan chan error)
+}
+
+// Merge sets the MergeMode used to combine the payloads from each input.
+// Inputs are ordered by the position of the upstream DataProcessors in the
+// PipelineLayout.
+//
+// Any mode other than MergeInterleaved waits on a specific input, so the
+// payloads arriving on the other inputs meanwhile are held in memory until
+// their turn, however many there are. This keeps upstream DataProcessors
+// from blocking, e.g. one sending to two inputs through different paths,
+// but a large input that is not read first is held in its entirety.
+func (dp *dataProcessor) Merge(mode MergeMode) *dataProcessor {
+	dp.mergeMode = mode
+	return dp
+}
+
+// MergeSorted merges the inputs with a k-way merge on the given key (see
+// JSONKey), always passing on the payload with the lowest key next. Each
+// input must already be sorted by the key for the result to be sorted. Keys
+// that are both numbers are compared numerically, other keys as strings,
+// and ties go to the earlier input. The caveat in Merge applies.
+func (dp *dataProcessor) MergeSorted(key func(d data.JSON) string) *dataProcessor {
+	dp.mergeMode = mergeSorted
+	dp.mergeKey = key
+	return dp
+}
+
+func (dp *dataProcessor) mergeIn(ctx context.Context) {
+	send := func(i int, m message) {
+		m.from = dp.mergeFrom[i]
+		select {
+		case dp.inputChan <- m:
+		case <-ctx.Done():
+		}
+	}
+
+	if dp.mergeMode == MergeInterleaved {
+		// Start a merge goroutine for each input channel.
+		mergeData := func(i int, c chan message) {
+			for m := range c {
+				send(i, m)
+			}
+			dp.mergeWait.Done()
+		}
+		dp.mergeWait.Add(len(dp.mergeInChans))
+		for i, in := range dp.mergeInChans {
+			go mergeData(i, in)
+		}
+
+		go func() {
+			dp.mergeWait.Wait()
+			close(dp.inputChan)
+		}()
+		return
+	}
+
+	ins := make([]chan message, len(dp.mergeInChans))
+	for i, c := range dp.mergeInChans {
+		ins[i] = dp.mergeQueue(c)
+	}
+	go func() {
+		switch dp.mergeMode {
+		case MergeRoundRobin:
+			mergeRoundRobin(ins, send)
+		case MergeSequential:
+			for i, c := range ins {
+				for m := range c {
+					send(i, m)
+				}
+			}
+		case mergeSorted:
+			dp.mergeSorted(ins, send)
+		}
+		close(dp.inputChan)
+	}()
+}
+
+// mergeQueue receives the payloads sent to c as soon as they arrive, and
+// queues them until they are received from the returned channel, which is
+// closed once c is closed and the queue is empty.
+func (dp *dataProcessor) mergeQueue(c chan message) chan message {
+	out := make(chan message)
+	go func() {
+		defer close(out)
+		var queue []message
+		for c != nil || len(queue) > 0 {
+			var next chan message
+			var head message
+			if len(queue) > 0 {
+				next, head = out, queue[0]
+			}
+			select {
+			case m, ok := <-c:
+				if !ok {
+					c = nil
+					continue
+				}
+				queue = append(queue, m)
+				atomic.AddInt64(&dp.mergeQueued, 1)
+			case next <- head:
+				queue[0] = message{}
+				queue = queue[1:]
+				atomic.AddInt64(&dp.mergeQueued, -1)
+			}
+		}
+	}()
+	return out
+}
+
+func mergeRoundRobin(ins []chan message, send func(int, message)) {
+	open := make([]int, len(ins))
+	for i := range open {
+		open[i] = i
+	}
+	for len(open) > 0 {
+		for n := 0; n < len(open); {
+			m, ok := <-ins[open[n]]
+			if !ok {
+				open = append(open[:n], open[n+1:]...)
+				continue
+			}
+			send(open[n], m)
+			n++
+		}
+	}
+}
+
+func (dp *dataProcessor) mergeSorted(ins []chan message, send func(int, message)) {
+	type head struct {
+		m   message
+		key string
+		ok  bool
+	}
+	heads := make([]head, len(ins))
+	next := func(i int) {
+		m, ok := <-ins[i]
+		heads[i] = head{m: m, ok: ok}
+		if ok {
+			heads[i].key = dp.mergeKey(m.data)
+		}
+	}
+	for i := range heads {
+		next(i)
+	}
+	for {
+		min := -1
+		for i, h := range heads {
+			if h.ok && (min < 0 || compareKeys(h.key, heads[min].key) < 0) {
+				min = i
+			}
+		}
+		if min < 0 {
+			return
+		}
+		send(min, heads[min].m)
+		next(min)
+	}
+}
+
+// compareKeys compares keys numerically if they are both numbers,
+// and as strings otherwise.
+func compareKeys(a, b string) int {
+	x, errx := strconv.ParseFloat(a, 64)
+	y, erry := strconv.ParseFloat(b, 64)
+	if errx != nil || erry != nil {
+		return strings.Compare(a, b)
+	}
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,119 @@
+// Package metrics publishes the stats of running ratchet Pipelines to
+// monitoring systems, so that long-running or streaming pipelines can be
+// observed while they run rather than only through Pipeline.Stats once
+// they are done.
+//
+// Stats are published for each DataProcessor, labelled by the Pipeline's
+// Name (and, where the monitoring system allows it, its StatsReport.ID, so
+// that Pipelines left with the same Name don't collide), the stage and the
+// DataProcessor's String():
+//
+//	prom := metrics.NewPrometheus()
+//	http.Handle("/metrics", prom)
+//
+//	stop := metrics.Publish(pipeline, 10*time.Second, prom)
+//	err := <-pipeline.Run()
+//	stop()
+package metrics
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dailyburn/ratchet"
+	"github.com/dailyburn/ratchet/logger"
+)
+
+// maxFinishedRuns is the number of finished runs a Sink keeps track of, so
+// that a process running many short-lived Pipelines doesn't accumulate them.
+const maxFinishedRuns = 100
+
+// Sink receives the stats of running Pipelines. Implementations must be
+// safe for concurrent use, since a Sink can be shared by several Pipelines.
+type Sink interface {
+	Publish(r *ratchet.StatsReport) error
+}
+
+// Publish sends the StatsReport of the Pipeline to each Sink every interval,
+// until the returned stop function is called. stop publishes once more
+// before returning, so the final stats of a completed run are included.
+// Errors returned by a Sink are logged.
+func Publish(p *ratchet.Pipeline, interval time.Duration, sinks ...Sink) (stop func()) {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				publish(p, sinks)
+			case <-done:
+				publish(p, sinks)
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+		})
+	}
+}
+
+func publish(p *ratchet.Pipeline, sinks []Sink) {
+	r := p.StatsReport()
+	for _, s := range sinks {
+		if err := s.Publish(r); err != nil {
+			logger.Error("metrics: publishing", r.Name, "stats failed:", err.Error())
+		}
+	}
+}
+
+// series is the stats of a single DataProcessor, along with
+// the labels identifying it.
+type series struct {
+	pipeline  string
+	id        string
+	stage     string
+	processor string
+	stats     ratchet.ProcessorStats
+}
+
+// flatten lists the stats of every DataProcessor in the report. Dead letters
+// are given the stage "dead_letter", and DataProcessors with the same name
+// in a stage are told apart by a "#n" suffix. The DataProcessors inside a
+// SubPipeline are listed after it, named "<SubPipeline>/<name>" in the
+// stage "<outer stage>.<inner stage>".
+func flatten(r *ratchet.StatsReport) []series {
+	return flattenNested(r.Name, r.ID, "", "", r)
+}
+
+func flattenNested(pipeline, id, stagePrefix, namePrefix string, r *ratchet.StatsReport) []series {
+	all := []series{}
+	add := func(stage string, processors []ratchet.ProcessorStats) {
+		seen := make(map[string]int)
+		for _, ps := range processors {
+			name := ps.Name
+			seen[name]++
+			if n := seen[name]; n > 1 {
+				name = fmt.Sprintf("%s #%d", name, n)
+			}
+			all = append(all, series{pipeline, id, stagePrefix + stage, namePrefix + name, ps})
+			if ps.SubPipeline != nil {
+				all = append(all, flattenNested(pipeline, id, stagePrefix+stage+".", namePrefix+name+"/", ps.SubPipeline)...)
+			}
+		}
+	}
+	for _, s := range r.Stages {
+		add(strconv.Itoa(s.Stage), s.Processors)
+	}
+	add("dead_letter", r.DeadLetters)
+	return all
+}
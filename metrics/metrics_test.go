@@ -0,0 +1,171 @@
+package metrics_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dailyburn/ratchet"
+	"github.com/dailyburn/ratchet/logger"
+	"github.com/dailyburn/ratchet/metrics"
+	"github.com/dailyburn/ratchet/processors"
+)
+
+func runPipeline(t *testing.T, sinks ...metrics.Sink) *ratchet.Pipeline {
+	logger.LogLevel = logger.LevelSilent
+
+	pipeline := ratchet.NewPipeline(
+		processors.NewIoReader(strings.NewReader("hello\nworld")),
+		processors.NewIoWriter(ioutil.Discard),
+	)
+	pipeline.Name = "test"
+	stop := metrics.Publish(pipeline, time.Millisecond, sinks...)
+	if err := <-pipeline.Run(); err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	return pipeline
+}
+
+// finishedReport returns the StatsReport of a Pipeline that finished the
+// given number of seconds after the first one.
+func finishedReport(name string, seconds int) *ratchet.StatsReport {
+	started := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	return &ratchet.StatsReport{
+		Name:     name,
+		ID:       name,
+		Started:  started,
+		Finished: started.Add(time.Duration(seconds) * time.Second),
+		Stages: []ratchet.StageStats{
+			{Stage: 1, Processors: []ratchet.ProcessorStats{{Name: "p", PayloadsSent: 1}}},
+		},
+	}
+}
+
+func TestPrometheus(t *testing.T) {
+	prom := metrics.NewPrometheus()
+	id := runPipeline(t, prom).StatsReport().ID
+
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		prom.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		return rec.Body.String()
+	}
+	body := scrape()
+	for _, expected := range []string{
+		"# TYPE ratchet_payloads_sent_total counter\n",
+		`ratchet_payloads_sent_total{pipeline="test",id="` + id + `",stage="1",processor="IoReader"} 2` + "\n",
+		`ratchet_payloads_received_total{pipeline="test",id="` + id + `",stage="2",processor="IoWriter"} 2` + "\n",
+		`ratchet_errors_total{pipeline="test",id="` + id + `",stage="2",processor="IoWriter"} 0` + "\n",
+		`ratchet_processing_seconds_count{pipeline="test",id="` + id + `",stage="2",processor="IoWriter"} 2` + "\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", expected, body)
+		}
+	}
+
+	// Running Pipelines with the same Name are told apart by their ID,
+	// while a finished one is replaced.
+	prom.Publish(&ratchet.StatsReport{Name: "test", ID: "a"})
+	prom.Publish(&ratchet.StatsReport{Name: "test", ID: "b"})
+	body = scrape()
+	for _, expected := range []string{`{pipeline="test",id="a"}`, `{pipeline="test",id="b"}`} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", expected, body)
+		}
+	}
+	if strings.Contains(body, `id="`+id+`"`) {
+		t.Errorf("Expected the finished Pipeline's metrics to be replaced, got:\n%s", body)
+	}
+
+	// Only the last 100 finished Pipelines are kept.
+	for i := 0; i <= 100; i++ {
+		prom.Publish(finishedReport(fmt.Sprintf("run%d", i), i))
+	}
+	body = scrape()
+	if strings.Contains(body, `pipeline="run0"`) {
+		t.Errorf("Expected the first finished Pipeline's metrics to be removed, got:\n%s", body)
+	}
+	for _, expected := range []string{`pipeline="run1"`, `pipeline="run100"`, `id="a"`, `id="b"`} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", expected, body)
+		}
+	}
+}
+
+func TestStatsD(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	statsd, err := metrics.NewStatsD(conn.LocalAddr().String(), "etl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer statsd.Close()
+
+	pipeline := runPipeline(t)
+	read := func() string {
+		b := make([]byte, 65536)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b[:n])
+	}
+
+	if err := statsd.Publish(pipeline.StatsReport()); err != nil {
+		t.Fatal(err)
+	}
+	packet := read()
+	for _, expected := range []string{
+		"etl.test.stage1.IoReader.payloads_sent:2|c\n",
+		"etl.test.stage2.IoWriter.buffered:0|g\n",
+	} {
+		if !strings.Contains(packet, expected) {
+			t.Errorf("Expected packet to contain %q, got:\n%s", expected, packet)
+		}
+	}
+
+	// Counters only send the increase since the last Publish.
+	if err := statsd.Publish(pipeline.StatsReport()); err != nil {
+		t.Fatal(err)
+	}
+	if packet := read(); strings.Contains(packet, "payloads_sent") {
+		t.Errorf("Expected unchanged counters not to be sent again, got:\n%s", packet)
+	}
+
+	// Another Pipeline with the same Name counts from zero again.
+	if err := statsd.Publish(runPipeline(t).StatsReport()); err != nil {
+		t.Fatal(err)
+	}
+	if packet, expected := read(), "etl.test.stage1.IoReader.payloads_sent:2|c\n"; !strings.Contains(packet, expected) {
+		t.Errorf("Expected packet to contain %q, got:\n%s", expected, packet)
+	}
+
+	// Only the counters of the last 100 finished runs are remembered.
+	for i := 0; i <= 100; i++ {
+		if err := statsd.Publish(finishedReport(fmt.Sprintf("run%d", i), i)); err != nil {
+			t.Fatal(err)
+		}
+		read()
+	}
+	if err := statsd.Publish(finishedReport("run100", 100)); err != nil {
+		t.Fatal(err)
+	}
+	if packet := read(); strings.Contains(packet, "payloads_sent") {
+		t.Errorf("Expected the last run's counters not to be sent again, got:\n%s", packet)
+	}
+	if err := statsd.Publish(finishedReport("run0", 0)); err != nil {
+		t.Fatal(err)
+	}
+	if packet := read(); !strings.Contains(packet, "etl.run0.stage1.p.payloads_sent:1|c\n") {
+		t.Errorf("Expected the first run's counters to be sent again, got:\n%s", packet)
+	}
+}
@@ -0,0 +1,167 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dailyburn/ratchet"
+)
+
+// Prometheus is a Sink that serves the latest stats of each Pipeline in the
+// Prometheus text exposition format. It is an http.Handler, to be mounted
+// at the path Prometheus scrapes (usually /metrics).
+//
+// Each series is labelled with the Pipeline's StatsReport.ID as well as its
+// Name. The stats of a finished Pipeline are served until another Pipeline
+// with the same Name publishes its stats, or until 100 other Pipelines have
+// finished since.
+type Prometheus struct {
+	mu      sync.Mutex
+	reports map[string]*ratchet.StatsReport // by StatsReport.ID
+}
+
+// NewPrometheus returns a new Prometheus Sink.
+func NewPrometheus() *Prometheus {
+	return &Prometheus{reports: make(map[string]*ratchet.StatsReport)}
+}
+
+// Publish stores the report, replacing the previous one for the same Pipeline
+// and those of finished Pipelines with the same Name.
+func (p *Prometheus) Publish(r *ratchet.StatsReport) error {
+	p.mu.Lock()
+	for id, prev := range p.reports {
+		if id != r.ID && prev.Name == r.Name && !prev.Finished.IsZero() {
+			delete(p.reports, id)
+		}
+	}
+	p.reports[r.ID] = r
+	if !r.Finished.IsZero() {
+		p.evictFinished()
+	}
+	p.mu.Unlock()
+	return nil
+}
+
+// evictFinished removes the reports of the Pipelines that finished first,
+// beyond maxFinishedRuns.
+func (p *Prometheus) evictFinished() {
+	for {
+		n := 0
+		oldest := ""
+		for id, r := range p.reports {
+			if r.Finished.IsZero() {
+				continue
+			}
+			n++
+			if oldest == "" || r.Finished.Before(p.reports[oldest].Finished) {
+				oldest = id
+			}
+		}
+		if n <= maxFinishedRuns {
+			return
+		}
+		delete(p.reports, oldest)
+	}
+}
+
+// ServeHTTP writes the stats of every published Pipeline.
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	p.mu.Lock()
+	reports := []*ratchet.StatsReport{}
+	for _, r := range p.reports {
+		reports = append(reports, r)
+	}
+	p.mu.Unlock()
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].Name != reports[j].Name {
+			return reports[i].Name < reports[j].Name
+		}
+		return reports[i].ID < reports[j].ID
+	})
+	all := []series{}
+	for _, r := range reports {
+		all = append(all, flatten(r)...)
+	}
+
+	var b bytes.Buffer
+	family(&b, "ratchet_pipeline_duration_seconds", "gauge", "Time the pipeline has been running for.")
+	for _, r := range reports {
+		fmt.Fprintf(&b, "ratchet_pipeline_duration_seconds{pipeline=%s,id=%s} %g\n", labelValue(r.Name), labelValue(r.ID), r.Duration.Seconds())
+	}
+
+	counters := []struct {
+		name, help string
+		value      func(ratchet.ProcessorStats) int
+	}{
+		{"ratchet_payloads_sent_total", "Payloads sent by the processor.", func(s ratchet.ProcessorStats) int { return s.PayloadsSent }},
+		{"ratchet_payloads_received_total", "Payloads received by the processor.", func(s ratchet.ProcessorStats) int { return s.PayloadsReceived }},
+		{"ratchet_bytes_sent_total", "Bytes sent by the processor.", func(s ratchet.ProcessorStats) int { return s.BytesSent }},
+		{"ratchet_bytes_received_total", "Bytes received by the processor.", func(s ratchet.ProcessorStats) int { return s.BytesReceived }},
+		{"ratchet_errors_total", "Errors reported by the processor.", func(s ratchet.ProcessorStats) int { return s.Errors }},
+	}
+	for _, c := range counters {
+		family(&b, c.name, "counter", c.help)
+		for _, s := range all {
+			fmt.Fprintf(&b, "%s{%s} %d\n", c.name, s.labels(), c.value(s.stats))
+		}
+	}
+
+	family(&b, "ratchet_buffered_payloads", "gauge", "Payloads waiting in the processor's input channels.")
+	for _, s := range all {
+		fmt.Fprintf(&b, "ratchet_buffered_payloads{%s} %d\n", s.labels(), s.stats.Buffered)
+	}
+
+	family(&b, "ratchet_concurrency", "gauge", "Concurrent ProcessData calls allowed, for concurrent processors.")
+	for _, s := range all {
+		if s.stats.Concurrency > 0 {
+			fmt.Fprintf(&b, "ratchet_concurrency{%s} %d\n", s.labels(), s.stats.Concurrency)
+		}
+	}
+
+	family(&b, "ratchet_processing_seconds", "summary", "Time taken by each ProcessData call.")
+	for _, s := range all {
+		d := s.stats.ExecutionTimes
+		for _, q := range []struct {
+			quantile string
+			value    int64
+		}{{"0.5", d.P50}, {"0.95", d.P95}, {"0.99", d.P99}} {
+			fmt.Fprintf(&b, "ratchet_processing_seconds{%s,quantile=%q} %g\n", s.labels(), q.quantile, time.Duration(q.value).Seconds())
+		}
+		fmt.Fprintf(&b, "ratchet_processing_seconds_sum{%s} %g\n", s.labels(), s.stats.TotalExecutionTime.Seconds())
+		fmt.Fprintf(&b, "ratchet_processing_seconds_count{%s} %d\n", s.labels(), d.Count)
+	}
+
+	family(&b, "ratchet_processor_counter_total", "counter", "Counters reported by processors implementing ratchet.CounterProvider.")
+	for _, s := range all {
+		names := []string{}
+		for name := range s.stats.Counters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(&b, "ratchet_processor_counter_total{%s,counter=%s} %d\n", s.labels(), labelValue(name), s.stats.Counters[name])
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b.Bytes())
+}
+
+func family(b *bytes.Buffer, name, typ, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func (s series) labels() string {
+	return fmt.Sprintf("pipeline=%s,id=%s,stage=%s,processor=%s", labelValue(s.pipeline), labelValue(s.id), labelValue(s.stage), labelValue(s.processor))
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelValue(v string) string {
+	return `"` + labelReplacer.Replace(v) + `"`
+}
@@ -0,0 +1,197 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dailyburn/ratchet"
+)
+
+// maxPacketSize keeps StatsD packets within a typical network MTU.
+const maxPacketSize = 1432
+
+// StatsD is a Sink that sends stats to a StatsD server over UDP. Metrics are
+// named <prefix>.<pipeline>.stage<n>.<processor>.<stat>, with any characters
+// StatsD doesn't allow replaced by underscores.
+//
+// Payload, byte and error counts are sent as counters (only the increase
+// since the previous Publish of the same run), while buffered payloads,
+// concurrency and the p50/p95/p99 and max processing time (in milliseconds)
+// are sent as gauges.
+//
+// Pipelines with the same Name share their metrics: their counters add up,
+// and their gauges overwrite each other. Give Pipelines running at the same
+// time distinct Names to tell them apart. Only the counters of the last 100
+// finished runs are remembered, so publishing the final stats of an older
+// run again sends its counters again.
+type StatsD struct {
+	conn   net.Conn
+	prefix string
+	mu     sync.Mutex
+	sent   map[string]*sentCounters // by StatsReport.ID
+}
+
+// sentCounters holds the counter values sent so far for a run of a Pipeline.
+type sentCounters struct {
+	name     string
+	started  time.Time
+	finished time.Time // zero while the run is still going
+	values   map[string]int64
+}
+
+// NewStatsD returns a StatsD Sink sending to the server at addr (host:port).
+// The prefix is prepended to every metric name, and may be empty.
+func NewStatsD(addr, prefix string) (*StatsD, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsD{conn: conn, prefix: prefix, sent: make(map[string]*sentCounters)}, nil
+}
+
+// Publish sends the stats in the report.
+func (s *StatsD) Publish(r *ratchet.StatsReport) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sent := s.sent[r.ID]
+	if sent == nil || !sent.started.Equal(r.Started) {
+		// a new run, whose counters start from zero again
+		for id, prev := range s.sent {
+			if id != r.ID && prev.name == r.Name && !prev.finished.IsZero() {
+				delete(s.sent, id)
+			}
+		}
+		sent = &sentCounters{name: r.Name, started: r.Started, values: make(map[string]int64)}
+		s.sent[r.ID] = sent
+	}
+	if sent.finished.IsZero() && !r.Finished.IsZero() {
+		sent.finished = r.Finished
+		s.evictFinished()
+	}
+
+	lines := []string{}
+	counter := func(name string, value int64) {
+		if delta := value - sent.values[name]; delta != 0 {
+			lines = append(lines, fmt.Sprintf("%s:%d|c", name, delta))
+			sent.values[name] = value
+		}
+	}
+	gauge := func(name string, value float64) {
+		lines = append(lines, fmt.Sprintf("%s:%g|g", name, value))
+	}
+	ms := func(ns int64) float64 {
+		return float64(ns) / float64(time.Millisecond)
+	}
+
+	for _, ser := range flatten(r) {
+		stage := ser.stage
+		if stage != "dead_letter" {
+			stage = "stage" + stage
+		}
+		base := s.name(ser.pipeline, stage, ser.processor)
+		st := ser.stats
+		counter(base+".payloads_sent", int64(st.PayloadsSent))
+		counter(base+".payloads_received", int64(st.PayloadsReceived))
+		counter(base+".bytes_sent", int64(st.BytesSent))
+		counter(base+".bytes_received", int64(st.BytesReceived))
+		counter(base+".errors", int64(st.Errors))
+		names := []string{}
+		for name := range st.Counters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			counter(base+"."+sanitize(name), st.Counters[name])
+		}
+		gauge(base+".buffered", float64(st.Buffered))
+		if st.Concurrency > 0 {
+			gauge(base+".concurrency", float64(st.Concurrency))
+		}
+		if d := st.ExecutionTimes; d.Count > 0 {
+			gauge(base+".processing_time.p50", ms(d.P50))
+			gauge(base+".processing_time.p95", ms(d.P95))
+			gauge(base+".processing_time.p99", ms(d.P99))
+			gauge(base+".processing_time.max", ms(d.Max))
+		}
+	}
+	return s.send(lines)
+}
+
+// evictFinished forgets the counters of the runs that finished first,
+// beyond maxFinishedRuns.
+func (s *StatsD) evictFinished() {
+	for {
+		n := 0
+		oldest := ""
+		for id, sent := range s.sent {
+			if sent.finished.IsZero() {
+				continue
+			}
+			n++
+			if oldest == "" || sent.finished.Before(s.sent[oldest].finished) {
+				oldest = id
+			}
+		}
+		if n <= maxFinishedRuns {
+			return
+		}
+		delete(s.sent, oldest)
+	}
+}
+
+// send writes the lines, batching as many as fit into each packet.
+func (s *StatsD) send(lines []string) error {
+	var packet bytes.Buffer
+	flush := func() error {
+		if packet.Len() == 0 {
+			return nil
+		}
+		_, err := s.conn.Write(packet.Bytes())
+		packet.Reset()
+		return err
+	}
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > maxPacketSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	return flush()
+}
+
+// Close closes the connection to the StatsD server.
+func (s *StatsD) Close() error {
+	return s.conn.Close()
+}
+
+func (s *StatsD) name(parts ...string) string {
+	var b bytes.Buffer
+	if s.prefix != "" {
+		b.WriteString(s.prefix)
+		b.WriteByte('.')
+	}
+	for i, part := range parts {
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(sanitize(part))
+	}
+	return b.String()
+}
+
+var invalidStatsDChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+func sanitize(part string) string {
+	return invalidStatsDChars.ReplaceAllString(part, "_")
+}
@@ -0,0 +1,71 @@
+package ratchet
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/dailyburn/ratchet/data"
+	"github.com/dailyburn/ratchet/logger"
+)
+
+// PanicError is the error reported when a DataProcessor panics in
+// ProcessData or Finish. The panic is recovered, so that it doesn't crash
+// the whole process, and the error is handled like any other according
+// to the DataProcessor's ErrorPolicy.
+type PanicError struct {
+	Processor string
+	Stage     int
+	Value     interface{} // the value passed to panic
+	Stack     []byte      // the stack trace of the panicking goroutine
+	Data      data.JSON   // the payload being processed, nil in Finish
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("%s (stage %d) panicked: %v", e.Processor, e.Stage, e.Value)
+}
+
+// recoverPanic sets *err to a PanicError if the goroutine is panicking.
+// It must be deferred directly.
+func recoverPanic(err *error) {
+	if v := recover(); v != nil {
+		*err = &PanicError{Value: v, Stack: debug.Stack()}
+	}
+}
+
+// callProcessData calls ProcessData on the wrapped DataProcessor,
+// turning a panic into a PanicError. See call.
+func (dp *dataProcessor) callProcessData(ctx context.Context, d data.JSON, out trackingEmitter) error {
+	return dp.call(ctx, "ProcessData", dp.processDataTimeout, d, out, func(ctx context.Context, out trackingEmitter) error {
+		if cp, ok := unwrap(dp.DataProcessor).(Checkpointer); ok && (dp.checkpoints != nil || tracksData(cp)) {
+			var from data.JSON
+			if dp.checkpoints != nil {
+				from = dp.checkpoints.from
+			}
+			return cp.ProcessFrom(ctx, d, from, checkpointEmitter{out, dp.checkpoints})
+		}
+		return dp.proc.ProcessData(ctx, d, out)
+	})
+}
+
+// callFinish calls Finish on the wrapped DataProcessor,
+// turning a panic into a PanicError. See call.
+func (dp *dataProcessor) callFinish(ctx context.Context, out trackingEmitter) error {
+	return dp.call(ctx, "Finish", dp.finishTimeout, nil, out, func(ctx context.Context, out trackingEmitter) error {
+		return dp.proc.Finish(ctx, out)
+	})
+}
+
+// fillPanicError adds the details of the dataProcessor to a PanicError
+// (which may have been recovered in the goroutine running a DataProcessor),
+// and logs its stack trace.
+func (dp *dataProcessor) fillPanicError(err error, d data.JSON) {
+	pe, ok := err.(*PanicError)
+	if !ok || pe.Processor != "" {
+		return
+	}
+	pe.Processor = dp.String()
+	pe.Stage = dp.stage
+	pe.Data = d
+	logger.Error(pe.Error(), "\n", string(pe.Stack))
+}
@@ -0,0 +1,99 @@
+package ratchet
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync/atomic"
+
+	"github.com/dailyburn/ratchet/data"
+)
+
+// Partitioner picks which of n replicas a payload is sent to, returning an
+// index between 0 and n-1. See Partition.
+type Partitioner func(d data.JSON, n int) int
+
+// RoundRobin returns a Partitioner that spreads payloads evenly across the
+// replicas, in turn.
+func RoundRobin() Partitioner {
+	var next uint64
+	return func(d data.JSON, n int) int {
+		return int((atomic.AddUint64(&next, 1) - 1) % uint64(n))
+	}
+}
+
+// HashPartition returns a Partitioner that sends all payloads with the same
+// key to the same replica, so that they are processed in order. See JSONKey
+// for partitioning on a field of JSON objects.
+func HashPartition(key func(d data.JSON) string) Partitioner {
+	return func(d data.JSON, n int) int {
+		h := fnv.New32a()
+		h.Write([]byte(key(d)))
+		return int(h.Sum32() % uint32(n))
+	}
+}
+
+// JSONKey returns a key function for HashPartition that uses the value of
+// the given field of a JSON object, e.g. JSONKey("customer_id"). Payloads that
+// aren't JSON objects, or don't have the field, all get the same empty key.
+func JSONKey(field string) func(d data.JSON) string {
+	return func(d data.JSON) string {
+		var obj map[string]interface{}
+		if err := data.ParseJSONSilent(d, &obj); err != nil {
+			return ""
+		}
+		if v, ok := obj[field]; ok && v != nil {
+			return fmt.Sprintf("%v", v)
+		}
+		return ""
+	}
+}
+
+// Replicas returns n DataProcessors created by the factory, which is passed
+// the index of each replica. Each replica gets its own state, so a
+// DataProcessor that isn't safe for concurrent use (such as a CSVWriter
+// or SftpWriter) can be scaled out with Partition.
+func Replicas(n int, factory func(i int) DataProcessor) []DataProcessor {
+	replicas := make([]DataProcessor, n)
+	for i := range replicas {
+		replicas[i] = factory(i)
+	}
+	return replicas
+}
+
+// Partition spreads payloads across the given replicas, sending each payload
+// to just one of them as picked by the Partitioner, instead of sending every
+// payload to every output. The replicas are added to the outputs, so they
+// must all be in the next PipelineStage:
+//
+//	writers := ratchet.Replicas(4, func(i int) ratchet.DataProcessor {
+//	        return processors.NewCSVWriter(files[i])
+//	})
+//	byCustomer := ratchet.HashPartition(ratchet.JSONKey("customer_id"))
+//	layout, err := ratchet.NewPipelineLayout(
+//	        ratchet.NewPipelineStage(ratchet.Do(reader).Partition(byCustomer, writers...)),
+//	        ratchet.NewPipelineStage(ratchet.DoAll(writers...)...),
+//	)
+//
+// Outputs set with Outputs (or routes set with Route) are unaffected. The
+// number of payloads sent to each replica is included in the Pipeline stats.
+func (dp *dataProcessor) Partition(p Partitioner, replicas ...DataProcessor) *dataProcessor {
+	dp.partitioner = p
+	for _, r := range replicas {
+		dp.partitions = append(dp.partitions, &route{to: r})
+		dp.addOutput(r)
+	}
+	return dp
+}
+
+// partition marks the replica picked for the payload in send.
+func (dp *dataProcessor) partition(d data.JSON, send []bool) {
+	n := len(dp.partitions)
+	if n == 0 {
+		return
+	}
+	i := dp.partitioner(d, n) % n
+	if i < 0 {
+		i += n
+	}
+	dp.sendAlong(dp.partitions[i], send)
+}
@@ -1,11 +1,12 @@
 package ratchet
 
 import (
-	"errors"
+	"context"
 	"fmt"
-	"os"
-	"os/signal"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dailyburn/ratchet/data"
 	"github.com/dailyburn/ratchet/logger"
@@ -14,16 +15,41 @@ import (
 
 // StartSignal is what's sent to a starting DataProcessor
 // to kick off execution. Typically this value will be ignored.
+// See RunWith and RunStream for sending other data instead.
 var StartSignal = "GO"
 
 // Pipeline is the main construct used for running a series of stages within a data pipeline.
 type Pipeline struct {
 	layout       *PipelineLayout
-	Name         string // Name is simply for display purpsoses in log output.
-	BufferLength int    // Set to control channel buffering, default is 8.
-	PrintData    bool   // Set to true to log full data payloads (only in Debug logging mode).
+	id           uint64          // see StatsReport.ID
+	Name         string          // Name is simply for display purpsoses in log output.
+	BufferLength int             // Set to control channel buffering, default is unbuffered.
+	PrintData    bool            // Set to true to log full data payloads (only in Debug logging mode).
+	Signals      *SignalHandling // Set to handle OS signals while running, see SignalHandling.
+	StallTimeout time.Duration   // Set to fail the run when no data moves for this long, see StallError.
+	Checkpoints  *Checkpointing  // Set to resume interrupted runs, see Checkpointing.
+	Tracing      *Tracing        // Set to trace each payload through the stages, see Tracing.
 	timer        *util.Timer
 	wg           sync.WaitGroup
+	deadLetters  []*dataProcessor
+	mu           sync.Mutex      // guards the channel setup, so stats can be read while running
+	nested       bool            // set for a SubPipeline, leaving signals to the outer Pipeline
+	tracer       *tracer         // for the current run, a SubPipeline's set by the outer Pipeline
+	sources      context.Context // the context of the initial stage, see SignalHandling.Graceful
+	// The data sent to the initial stage instead of the StartSignal (see
+	// RunStream), and for a SubPipeline, the data sent by the DataProcessors
+	// without outputs.
+	input      chan message
+	output     chan message
+	outputWait sync.WaitGroup // for the DataProcessors sending to output
+	branchWait sync.WaitGroup // for the goroutines started by branchOut
+	exited     chan struct{}  // closed once the stages of the last run have exited
+}
+
+var lastPipelineID uint64
+
+func newPipelineID() uint64 {
+	return atomic.AddUint64(&lastPipelineID, 1)
 }
 
 // PipelineIface provides an interface to enable mocking the Pipeline.
@@ -35,7 +61,7 @@ type PipelineIface interface {
 // NewPipeline creates a new pipeline ready to run the given DataProcessors.
 // For more complex use-cases, see NewBranchingPipeline.
 func NewPipeline(processors ...DataProcessor) *Pipeline {
-	p := &Pipeline{Name: "Pipeline"}
+	p := &Pipeline{id: newPipelineID(), Name: "Pipeline"}
 	stages := make([]*PipelineStage, len(processors))
 	for i, p := range processors {
 		dp := Do(p)
@@ -53,7 +79,7 @@ func NewPipeline(processors ...DataProcessor) *Pipeline {
 // between stages each containing variable number of DataProcessors.
 // See the ratchet package documentation for code examples and diagrams.
 func NewBranchingPipeline(layout *PipelineLayout) *Pipeline {
-	p := &Pipeline{layout: layout, Name: "Pipeline"}
+	p := &Pipeline{layout: layout, id: newPipelineID(), Name: "Pipeline"}
 	return p
 }
 
@@ -81,157 +107,418 @@ func (p *Pipeline) dataProcessorOutputs(dp *dataProcessor) []*dataProcessor {
 // dataProcessor's outputs), we set up some intermediary channels that will
 // manage copying and passing data between stages, as well as properly closing
 // channels when all data is received.
-func (p *Pipeline) connectStages() {
+func (p *Pipeline) connectStages(ctx context.Context) {
 	logger.Debug(p.Name, ": connecting stages")
+	// Each run gets new channels, since the last one closed them (e.g. a
+	// SubPipeline running again in a new outer Pipeline).
+	for _, stage := range p.layout.stages {
+		for _, dp := range stage.processors {
+			dp.inputChan = make(chan message)
+			dp.outputChan = make(chan message)
+			dp.mergeInChans = nil
+			dp.mergeFrom = nil
+		}
+	}
 	// First, setup the bridgeing channels & brancher/merger's to aid in
 	// managing channel communication between processors.
 	for _, stage := range p.layout.stages {
 		for _, from := range stage.processors {
 			if from.outputs != nil {
-				from.branchOutChans = []chan data.JSON{}
+				from.branchOutChans = []chan message{}
+				from.branchOutCounts = make([]int64, len(from.outputs))
 				for _, to := range p.dataProcessorOutputs(from) {
 					if to.mergeInChans == nil {
-						to.mergeInChans = []chan data.JSON{}
+						to.mergeInChans = []chan message{}
 					}
 					c := p.initDataChan()
 					from.branchOutChans = append(from.branchOutChans, c)
 					to.mergeInChans = append(to.mergeInChans, c)
+					to.mergeFrom = append(to.mergeFrom, from.DataProcessor)
 				}
 			}
 		}
 	}
 	// Loop through again and setup goroutines to handle data management
-	// between the branchers and mergers
+	// between the branchers and mergers. Every processor gets a brancher,
+	// even without outputs, so that its outputChan is always being drained.
 	for _, stage := range p.layout.stages {
 		for _, dp := range stage.processors {
-			if dp.branchOutChans != nil {
-				dp.branchOut()
+			dp.sink = nil
+			if dp.outputs == nil && p.output != nil {
+				dp.sink = p.output
+				dp.sinkWait = &p.outputWait
+				p.outputWait.Add(1)
 			}
+			dp.branchOut(ctx, &p.branchWait)
 			if dp.mergeInChans != nil {
-				dp.mergeIn()
+				dp.mergeIn(ctx)
 			}
 		}
 	}
 }
 
-func (p *Pipeline) runStages(killChan chan error) {
-	for n, stage := range p.layout.stages {
+// connectDeadLetters sets up a dataProcessor for each dead-letter
+// DataProcessor used by an ErrorPolicy in the layout.
+func (p *Pipeline) connectDeadLetters(ctx context.Context) {
+	p.deadLetters = nil
+	for _, stage := range p.layout.stages {
 		for _, dp := range stage.processors {
-			p.wg.Add(1)
-			// Each DataProcessor runs in a separate gorountine.
-			go func(n int, dp *dataProcessor) {
-				// This is where the main DataProcessor interface
-				// functions are called.
-				logger.Info(p.Name, "- stage", n+1, dp, "waiting to receive data")
-
-				// Store a bunch of channels, so we can wait on their output without messing up the order of operations.
-				exitChans := []chan bool{}
-
-				for d := range dp.inputChan {
-					logger.Info(p.Name, "- stage", n+1, dp, "received data")
-					if p.PrintData {
-						logger.Debug(p.Name, "- stage", n+1, dp, "data =", string(d))
-					}
-					dp.recordDataReceived(d)
-					exitChans = append(exitChans, dp.processData(d, killChan))
-				}
-
-				// Wait until everything is finished before calling dp.Finish.  Since execution happens asynchronously, we may still be waiting on a processData call to return.
-				for i := range exitChans {
-					<-exitChans[i]
+			if dp.errorPolicy.deadLetter == nil {
+				continue
+			}
+			dp.deadLetter = nil
+			for _, dl := range p.deadLetters {
+				if dl.DataProcessor == dp.errorPolicy.deadLetter {
+					dp.deadLetter = dl
 				}
+			}
+			if dp.deadLetter == nil {
+				dp.deadLetter = Do(dp.errorPolicy.deadLetter)
+				dp.deadLetter.branchOut(ctx, &p.branchWait)
+				p.deadLetters = append(p.deadLetters, dp.deadLetter)
+			}
+		}
+	}
+}
 
-				logger.Info(p.Name, "- stage", n+1, dp, "input closed, calling Finish")
-				dp.Finish(dp.outputChan, killChan)
-				if dp.outputChan != nil {
-					logger.Info(p.Name, "- stage", n+1, dp, "closing output")
-					close(dp.outputChan)
-				}
-				p.wg.Done()
-			}(n, dp)
+func (p *Pipeline) runStages(ctx context.Context, killChan chan error) {
+	for n, stage := range p.layout.stages {
+		for _, dp := range stage.processors {
+			dp.stage = n + 1
+			p.runDataProcessor(ctx, fmt.Sprintf("stage %d", n+1), dp, killChan, &p.wg)
 		}
 	}
 }
 
+// runDataProcessor starts a goroutine that calls ProcessData for everything
+// received on dp.inputChan, and then calls Finish and closes dp.outputChan
+// once dp.inputChan is closed.
+func (p *Pipeline) runDataProcessor(ctx context.Context, name string, dp *dataProcessor, killChan chan error, wg *sync.WaitGroup) {
+	// The initial stage processes data with its own context, which is
+	// cancelled to stop reading when the Pipeline is drained. Finish is
+	// still called with ctx.
+	procCtx := ctx
+	if dp.stage == 1 {
+		procCtx = p.sources
+	}
+	if isCancelable(dp.DataProcessor) {
+		unwrap(dp.DataProcessor).(contextSetter).SetContext(procCtx)
+	}
+	dp.tracer = p.tracer
+	if sp, ok := unwrap(dp.DataProcessor).(*subPipeline); ok {
+		sp.setOutput(outputEmitter{dp.outputChan, ctx})
+		sp.pipeline.tracer = p.tracer
+	}
+	wg.Add(1)
+	// Each DataProcessor runs in a separate gorountine.
+	go func() {
+		defer wg.Done()
+		// This is where the main DataProcessor interface
+		// functions are called.
+		logger.Info(p.Name, "-", name, dp, "waiting to receive data")
+
+		dp.setState(stateWaiting)
+		dp.startWorkers()
+		for m := range dp.inputChan {
+			d := m.data
+			if procCtx.Err() != nil {
+				// The pipeline has been halted, so keep draining the
+				// input without processing it. This lets the upstream
+				// goroutines finish and close their channels.
+				dp.setState(stateHalted)
+				continue
+			}
+			dp.setState(stateBusy)
+			logger.Info(p.Name, "-", name, dp, "received data")
+			if p.PrintData {
+				logger.Debug(p.Name, "-", name, dp, "data =", string(d))
+			}
+			dp.recordDataReceived(d)
+			dp.processData(withMessage(procCtx, m), d, killChan)
+			dp.setState(stateWaiting)
+		}
+
+		// Wait until everything is finished before calling dp.Finish.  Since execution happens asynchronously, we may still be waiting on a processData call to return.
+		dp.setState(stateDraining)
+		dp.waitForWorkers()
+
+		if ctx.Err() == nil {
+			logger.Info(p.Name, "-", name, dp, "input closed, calling Finish")
+			dp.setState(stateFinishing)
+			dp.finish(ctx, killChan)
+		} else {
+			logger.Info(p.Name, "-", name, dp, "halted, skipping Finish")
+		}
+		logger.Info(p.Name, "-", name, dp, "closing output")
+		dp.recordFinish()
+		dp.setState(stateDone)
+		close(dp.outputChan)
+	}()
+}
+
 // Run finalizes the channel connections between PipelineStages
-// and kicks off execution.
+// and kicks off execution. It is the same as calling RunContext
+// with context.Background().
+//
 // Run will return a killChan that should be waited on so your calling function doesn't
-// return prematurely. Any stage of the pipeline can send to the killChan to halt
+// return prematurely. Any stage of the pipeline can send to the killChan it is given to halt
 // execution. Your calling function should check if the sent value is an error or nil to know if
 // execution was a failure or a success (nil being the success value).
 func (p *Pipeline) Run() (killChan chan error) {
-	p.timer = util.StartTimer()
-	killChan = make(chan error)
+	return p.RunContext(context.Background())
+}
+
+// RunContext finalizes the channel connections between PipelineStages
+// and kicks off execution, halting it if ctx is cancelled or its deadline
+// passes.
+//
+// Halting the pipeline, either through ctx or through an error sent by a
+// DataProcessor, stops every stage goroutine: data still in flight is
+// drained and discarded, inter-stage channels are closed, Finish is not
+// called and DataProcessors implementing CancelableDataProcessor can abort
+// any in-flight I/O. The first error (or ctx.Err()) is sent on the returned
+// killChan, and nil is sent when execution completes successfully.
+func (p *Pipeline) RunContext(ctx context.Context) (killChan chan error) {
+	killChan, _ = p.run(ctx)
+	return killChan
+}
 
-	p.connectStages()
-	p.runStages(killChan)
+// run is RunContext, also returning the context of the initial stage, which
+// is cancelled once the Pipeline is done, halted or being drained.
+func (p *Pipeline) run(ctx context.Context) (killChan chan error, sources context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	sources, stopSources := context.WithCancel(ctx)
+	p.sources = sources
+	killChan = make(chan error, 1)
+	// errChan receives the errors reported by each DataProcessor.
+	errChan := make(chan error)
+	// interrupted is closed when a signal starts a graceful drain.
+	interrupted := make(chan struct{})
 
-	for _, dp := range p.layout.stages[0].processors {
-		logger.Debug(p.Name, ": sending", StartSignal, "to", dp)
-		dp.inputChan <- data.JSON(StartSignal)
-		dp.Finish(dp.outputChan, killChan)
-		close(dp.inputChan)
+	// A halted run may still be draining its stages, and aborting the
+	// Committers this one uses.
+	if err := p.waitExited(ctx); err != nil {
+		cancel()
+		stopSources()
+		killChan <- err
+		return killChan, sources
+	}
+	if err := pendingAborts.wait(ctx, p.committers()); err != nil {
+		cancel()
+		stopSources()
+		killChan <- err
+		return killChan, sources
+	}
+	checkpoints, err := p.loadCheckpoints()
+	if err != nil {
+		cancel()
+		stopSources()
+		killChan <- err
+		return killChan, sources
+	}
+
+	p.mu.Lock()
+	p.timer = util.StartTimer()
+	p.connectStages(ctx)
+	p.connectDeadLetters(ctx)
+	p.mu.Unlock()
+	for _, dp := range p.processors() {
+		// Drop the acks still held after a halted run.
+		dp.releaseAcks(false)
+	}
+	var tracing *tracer // closed by this Pipeline, not a SubPipeline
+	if !p.nested {
+		p.tracer = nil
+		if p.Tracing != nil {
+			tracing = newTracer(p.Name, *p.Tracing)
+			p.tracer = tracing
+		}
+	}
+	p.runStages(ctx, errChan)
+	var deadLetterWg sync.WaitGroup
+	for _, dl := range p.deadLetters {
+		p.runDataProcessor(ctx, "dead letter", dl, errChan, &deadLetterWg)
 	}
 
 	// After all the stages are running, send the StartSignal
-	// to the initial stage processors to kick off execution, and
-	// then wait until all the processing goroutines are done to
-	// signal successful pipeline completion.
+	// to the initial stage processors to kick off execution.
+	if p.input != nil {
+		go p.feed(sources)
+	} else {
+		for _, dp := range p.layout.stages[0].processors {
+			logger.Debug(p.Name, ": sending", StartSignal, "to", dp)
+			select {
+			case dp.inputChan <- message{data: data.JSON(StartSignal)}:
+			case <-ctx.Done():
+			}
+			close(dp.inputChan)
+		}
+	}
+
+	// Then wait until all the processing goroutines are done to signal
+	// successful pipeline completion, or until the pipeline is halted.
+	done := make(chan struct{})
 	go func() {
 		p.wg.Wait()
+		if p.output != nil {
+			p.outputWait.Wait()
+			close(p.output)
+		}
+		// Dead letters can be sent until every stage is done.
+		for _, dl := range p.deadLetters {
+			close(dl.inputChan)
+		}
+		deadLetterWg.Wait()
+		p.branchWait.Wait()
+		close(done)
+	}()
+	p.exited = done
+	go func() {
+		var err error
+		drained := false
+		select {
+		case <-done:
+			err = ctx.Err()
+			select {
+			case <-interrupted:
+				// A drain that wasn't cut short processed all the data
+				// read, so it is committed before reporting the signal.
+				drained = err == nil
+			default:
+			}
+		case err = <-errChan:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		var uncommitted []*dataProcessor
+		if !p.nested {
+			// The outer Pipeline commits the SubPipelines' Committers.
+			uncommitted = p.committers()
+			if err == nil {
+				uncommitted, err = p.commit(ctx, uncommitted)
+			}
+		}
+		if drained && err == nil {
+			err = ErrInterrupted
+		}
+		cancel()
+		stopSources()
+		select {
+		case <-done:
+			p.abort(uncommitted)
+			uncommitted = nil
+			tracing.close()
+			tracing = nil
+		default:
+			// Halted: abort once the stages have exited, below, with
+			// the next run using these Committers waiting for that.
+			pendingAborts.add(uncommitted)
+		}
+		for _, dp := range p.processors() {
+			if sp, ok := unwrap(dp.DataProcessor).(*subPipeline); ok {
+				sp.stop(done)
+			}
+		}
+		if serr := p.saveCheckpoints(checkpoints); serr != nil && err == nil {
+			err = serr
+		}
 		p.timer.Stop()
-		killChan <- nil
+		killChan <- err
+		// Keep receiving until every stage goroutine has exited, so that
+		// DataProcessors sending further errors never block.
+		for {
+			select {
+			case <-errChan:
+			case <-done:
+				p.abort(uncommitted)
+				tracing.close()
+				return
+			}
+		}
 	}()
 
-	handleInterrupt(killChan)
+	if p.Signals != nil && !p.nested {
+		p.Signals.handle(p.Name, errChan, done, stopSources, interrupted)
+	}
+	if p.StallTimeout > 0 {
+		go p.watch(ctx, errChan, done)
+	}
+	if len(checkpoints) > 0 {
+		go p.checkpoint(checkpoints, errChan, done)
+	}
+
+	return killChan, sources
+}
 
-	return killChan
+// waitExited waits until the stages of the last run have exited, which a
+// halted run sends its error before, or until ctx is done.
+func (p *Pipeline) waitExited(ctx context.Context) error {
+	if p.exited == nil {
+		return nil
+	}
+	select {
+	case <-p.exited:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func (p *Pipeline) initDataChans(length int) []chan data.JSON {
-	cs := make([]chan data.JSON, length)
+// feed sends each payload received on p.input to the initial stage
+// processors, instead of the StartSignal.
+func (p *Pipeline) feed(ctx context.Context) {
+	first := p.layout.stages[0].processors
+	defer func() {
+		for _, dp := range first {
+			close(dp.inputChan)
+		}
+	}()
+	for {
+		select {
+		case m, open := <-p.input:
+			if !open {
+				return
+			}
+			for _, dp := range first {
+				dc := make(data.JSON, len(m.data))
+				copy(dc, m.data)
+				holdAll(m.trackers)
+				select {
+				case dp.inputChan <- message{data: dc, headers: m.headers, trackers: m.trackers}:
+				case <-ctx.Done():
+				}
+			}
+			releaseAll(m.trackers)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *Pipeline) initDataChans(length int) []chan message {
+	cs := make([]chan message, length)
 	for i := range cs {
 		cs[i] = p.initDataChan()
 	}
 	return cs
 }
-func (p *Pipeline) initDataChan() chan data.JSON {
-	return make(chan data.JSON, p.BufferLength)
+func (p *Pipeline) initDataChan() chan message {
+	return make(chan message, p.BufferLength)
 }
 
-// func (p *Pipeline) String() string {
-// 	// Print an overview of the pipeline
-// 	stageNames := []string{}
-// 	for _, s := range p.layout.stages {
-// 		stageNames = append(stageNames, fmt.Sprintf("%v", s))
-// 	}
-// 	return p.Name + ": " + strings.Join(stageNames, " -> "))
-// }
-
-func handleInterrupt(killChan chan error) {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	go func() {
-		for range c {
-			killChan <- errors.New("Exiting due to interrupt signal.")
-		}
-	}()
+// String returns a one-line overview of the pipeline's stages.
+// See DOT and Mermaid for diagrams of the full layout.
+func (p *Pipeline) String() string {
+	stageNames := []string{}
+	for _, s := range p.layout.stages {
+		stageNames = append(stageNames, fmt.Sprintf("%v", s))
+	}
+	return p.Name + ": " + strings.Join(stageNames, " -> ")
 }
 
 // Stats returns a string (formatted for output display) listing the stats
-// gathered for each stage executed.
+// gathered for each stage executed. See StatsReport for the same stats in
+// a structured form.
 func (p *Pipeline) Stats() string {
-	o := fmt.Sprintf("%s: %s\r\n", p.Name, p.timer)
-	for n, stage := range p.layout.stages {
-		o += fmt.Sprintf("Stage %d)\r\n", n+1)
-		for _, dp := range stage.processors {
-			o += fmt.Sprintf("  * %v\r\n", dp)
-			dp.executionStat.calculate()
-			o += fmt.Sprintf("     - Total/Avg Execution Time = %f/%fs\r\n", dp.totalExecutionTime, dp.avgExecutionTime)
-			o += fmt.Sprintf("     - Payloads Sent/Received = %d/%d\r\n", dp.dataSentCounter, dp.dataReceivedCounter)
-			o += fmt.Sprintf("     - Total/Avg Bytes Sent = %d/%d\r\n", dp.totalBytesSent, dp.avgBytesSent)
-			o += fmt.Sprintf("     - Total/Avg Bytes Received = %d/%d\r\n", dp.totalBytesReceived, dp.avgBytesReceived)
-		}
-	}
-	return o
+	return p.StatsReport().String()
 }
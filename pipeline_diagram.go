@@ -0,0 +1,192 @@
+package ratchet
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// DOT returns a Graphviz (https://graphviz.org) description of the
+// PipelineLayout, with a cluster for each PipelineStage and an edge for each
+// output. Dead-letter DataProcessors (see DeadLetter) are drawn with dashed
+// lines. The result can be rendered with e.g. `dot -Tsvg`.
+func (l *PipelineLayout) DOT() string {
+	return l.diagram("Pipeline", nil).dot()
+}
+
+// Mermaid returns a Mermaid (https://mermaid.js.org) flowchart of the
+// PipelineLayout, drawn the same way as DOT. It can be embedded directly
+// in Markdown documents that support Mermaid.
+func (l *PipelineLayout) Mermaid() string {
+	return l.diagram("Pipeline", nil).mermaid()
+}
+
+// DOT returns a Graphviz description of the Pipeline's layout, as
+// PipelineLayout.DOT does, adding the buffer length (or "unbuffered") to
+// each edge. Once the Pipeline has been run, each edge is also labelled
+// with the number of payloads sent along it so far.
+func (p *Pipeline) DOT() string {
+	return p.layout.diagram(p.Name, p.edgeLabel).dot()
+}
+
+// Mermaid returns a Mermaid flowchart of the Pipeline's layout, with
+// the same edge labels as Pipeline.DOT.
+func (p *Pipeline) Mermaid() string {
+	return p.layout.diagram(p.Name, p.edgeLabel).mermaid()
+}
+
+func (p *Pipeline) edgeLabel(dp *dataProcessor, output int) string {
+	parts := []string{"unbuffered"}
+	if p.BufferLength > 0 {
+		parts[0] = fmt.Sprintf("buffer %d", p.BufferLength)
+	}
+	if output < len(dp.branchOutCounts) {
+		parts = append(parts, fmt.Sprintf("%d sent", atomic.LoadInt64(&dp.branchOutCounts[output])))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// diagram is a description of a PipelineLayout that is
+// independent of the format it is rendered in.
+type diagram struct {
+	name        string
+	stages      [][]diagramNode
+	deadLetters []diagramNode
+	edges       []diagramEdge
+}
+
+type diagramNode struct {
+	id    string
+	label string
+}
+
+type diagramEdge struct {
+	from, to string
+	label    string
+	onError  bool
+}
+
+// diagram describes the layout. edgeLabel, if given, returns the label for
+// the edge from dp to its given output.
+func (l *PipelineLayout) diagram(name string, edgeLabel func(dp *dataProcessor, output int) string) *diagram {
+	d := &diagram{name: name}
+	ids := make(map[DataProcessor]string)
+	for n, stage := range l.stages {
+		nodes := []diagramNode{}
+		for i, dp := range stage.processors {
+			id := fmt.Sprintf("s%d_%d", n+1, i+1)
+			ids[dp.DataProcessor] = id
+			nodes = append(nodes, diagramNode{id, nodeLabel(dp)})
+		}
+		d.stages = append(d.stages, nodes)
+	}
+	for _, stage := range l.stages {
+		for _, dp := range stage.processors {
+			for i, out := range dp.outputs {
+				labels := []string{}
+				if l := dp.routeLabel(out); l != "" {
+					labels = append(labels, l)
+				}
+				if edgeLabel != nil {
+					if l := edgeLabel(dp, i); l != "" {
+						labels = append(labels, l)
+					}
+				}
+				e := diagramEdge{from: ids[dp.DataProcessor], to: ids[out], label: strings.Join(labels, ", ")}
+				d.edges = append(d.edges, e)
+			}
+			if dl := dp.errorPolicy.deadLetter; dl != nil {
+				if _, ok := ids[dl]; !ok {
+					ids[dl] = fmt.Sprintf("dl%d", len(d.deadLetters)+1)
+					d.deadLetters = append(d.deadLetters, diagramNode{ids[dl], fmt.Sprintf("%v", dl)})
+				}
+				d.edges = append(d.edges, diagramEdge{from: ids[dp.DataProcessor], to: ids[dl], label: "on error", onError: true})
+			}
+		}
+	}
+	return d
+}
+
+func nodeLabel(dp *dataProcessor) string {
+	if a := dp.adaptive; a != nil {
+		return fmt.Sprintf("%v\nconcurrency %d-%d", dp, a.Min, a.Max)
+	}
+	if dp.concurrency > 0 {
+		return fmt.Sprintf("%v\nconcurrency %d", dp, dp.concurrency)
+	}
+	return fmt.Sprintf("%v", dp)
+}
+
+func (d *diagram) dot() string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "digraph %s {\n", dotQuote(d.name))
+	b.WriteString("\trankdir=LR;\n")
+	b.WriteString("\tnode [shape=box];\n")
+	for n, stage := range d.stages {
+		fmt.Fprintf(&b, "\tsubgraph cluster_stage%d {\n", n+1)
+		fmt.Fprintf(&b, "\t\tlabel=%s;\n", dotQuote(fmt.Sprintf("Stage %d", n+1)))
+		for _, node := range stage {
+			fmt.Fprintf(&b, "\t\t%s [label=%s];\n", node.id, dotQuote(node.label))
+		}
+		b.WriteString("\t}\n")
+	}
+	for _, node := range d.deadLetters {
+		fmt.Fprintf(&b, "\t%s [label=%s, style=dashed];\n", node.id, dotQuote(node.label))
+	}
+	for _, e := range d.edges {
+		attrs := []string{}
+		if e.label != "" {
+			attrs = append(attrs, "label="+dotQuote(e.label))
+		}
+		if e.onError {
+			attrs = append(attrs, "style=dashed")
+		}
+		if len(attrs) > 0 {
+			fmt.Fprintf(&b, "\t%s -> %s [%s];\n", e.from, e.to, strings.Join(attrs, ", "))
+		} else {
+			fmt.Fprintf(&b, "\t%s -> %s;\n", e.from, e.to)
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func (d *diagram) mermaid() string {
+	var b bytes.Buffer
+	b.WriteString("flowchart LR\n")
+	for n, stage := range d.stages {
+		fmt.Fprintf(&b, "\tsubgraph stage%d [\"Stage %d\"]\n", n+1, n+1)
+		for _, node := range stage {
+			fmt.Fprintf(&b, "\t\t%s[%s]\n", node.id, mermaidQuote(node.label))
+		}
+		b.WriteString("\tend\n")
+	}
+	for _, node := range d.deadLetters {
+		fmt.Fprintf(&b, "\t%s[%s]\n", node.id, mermaidQuote(node.label))
+	}
+	for _, e := range d.edges {
+		arrow := "-->"
+		if e.onError {
+			arrow = "-.->"
+		}
+		if e.label != "" {
+			fmt.Fprintf(&b, "\t%s %s|%s| %s\n", e.from, arrow, mermaidQuote(e.label), e.to)
+		} else {
+			fmt.Fprintf(&b, "\t%s %s %s\n", e.from, arrow, e.to)
+		}
+	}
+	return b.String()
+}
+
+var dotReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func dotQuote(s string) string {
+	return `"` + dotReplacer.Replace(s) + `"`
+}
+
+var mermaidReplacer = strings.NewReplacer(`"`, "#quot;", "\n", "<br/>")
+
+func mermaidQuote(s string) string {
+	return `"` + mermaidReplacer.Replace(s) + `"`
+}
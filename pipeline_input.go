@@ -0,0 +1,97 @@
+package ratchet
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/dailyburn/ratchet/data"
+)
+
+// ErrInputClosed is returned by Input.Emit once the Input has been closed.
+var ErrInputClosed = errors.New("ratchet: pipeline input is closed")
+
+// Input is used to send payloads to a Pipeline started with RunStream. It is
+// an Emitter, and is safe for concurrent use.
+type Input struct {
+	c      chan message
+	halted context.Context
+	mu     sync.RWMutex
+	closed bool
+}
+
+// Emit sends a payload to every DataProcessor in the Pipeline's initial
+// stage, blocking until they are ready for it. It fails once the Pipeline
+// has been halted or the Input closed.
+func (in *Input) Emit(d data.JSON) error {
+	return in.send(message{data: d})
+}
+
+// EmitEnvelope sends a payload as Emit does, along with its headers, e.g.
+// to carry the trace ID of the request it came from.
+func (in *Input) EmitEnvelope(e Envelope) error {
+	return in.send(message{data: e.Data, headers: e.Headers})
+}
+
+func (in *Input) send(m message) error {
+	in.mu.RLock()
+	defer in.mu.RUnlock()
+	if in.closed {
+		return ErrInputClosed
+	}
+	select {
+	case in.c <- m:
+		return nil
+	case <-in.halted.Done():
+		return in.halted.Err()
+	}
+}
+
+// Close tells the Pipeline there is no more input, so that it can finish
+// once everything sent so far has been processed. It is safe to call
+// more than once.
+func (in *Input) Close() {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if !in.closed {
+		in.closed = true
+		close(in.c)
+	}
+}
+
+// RunStream runs the Pipeline as RunContext does, except that instead of the
+// StartSignal, the initial stage DataProcessors receive the payloads sent to
+// the returned Input, until it is closed. This lets a Pipeline act as a
+// long-lived stream processor within an application:
+//
+//	input, killChan := pipeline.RunStream(ctx)
+//	for job := range jobs {
+//	        if err := input.Emit(job); err != nil {
+//	                break
+//	        }
+//	}
+//	input.Close()
+//	err := <-killChan
+func (p *Pipeline) RunStream(ctx context.Context) (*Input, chan error) {
+	p.input = make(chan message)
+	in := &Input{c: p.input}
+	killChan, halted := p.run(ctx)
+	in.halted = halted
+	return in, killChan
+}
+
+// RunWith runs the Pipeline as Run does, sending the given payloads to the
+// initial stage DataProcessors instead of the StartSignal, e.g. to run
+// an SQLReader once for each set of query parameters.
+func (p *Pipeline) RunWith(payloads ...data.JSON) (killChan chan error) {
+	in, killChan := p.RunStream(context.Background())
+	go func() {
+		defer in.Close()
+		for _, d := range payloads {
+			if in.Emit(d) != nil {
+				return
+			}
+		}
+	}()
+	return killChan
+}
@@ -18,6 +18,8 @@ type PipelineLayout struct {
 // 	2) DataProcessors in a non-final stage MUST have outputs set.
 // 	3) Outputs must point to a DataProcessor in the next immediate stage.
 // 	4) A DataProcessor must be pointed to by one of the previous Outputs (unless it is in the first PipelineStage).
+//
+// Use NewGraph for layouts where Outputs skip stages.
 func NewPipelineLayout(stages ...*PipelineStage) (*PipelineLayout, error) {
 	l := &PipelineLayout{stages}
 	if err := l.validate(); err != nil {
@@ -1,5 +1,10 @@
 package ratchet
 
+import (
+	"fmt"
+	"strings"
+)
+
 // PipelineStage holds one or more DataProcessor instances.
 type PipelineStage struct {
 	processors []*dataProcessor
@@ -29,6 +34,15 @@ func NewPipelineStage(processors ...*dataProcessor) *PipelineStage {
 	return &PipelineStage{processors}
 }
 
+// String lists the DataProcessors in the stage, e.g. "[SQLReader, CSVWriter]".
+func (s *PipelineStage) String() string {
+	names := []string{}
+	for _, dp := range s.processors {
+		names = append(names, fmt.Sprintf("%v", dp))
+	}
+	return "[" + strings.Join(names, ", ") + "]"
+}
+
 func (s *PipelineStage) hasProcessor(p DataProcessor) bool {
 	for i := range s.processors {
 		if s.processors[i].DataProcessor == p {
@@ -1,9 +1,20 @@
 package ratchet_test
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -11,6 +22,7 @@ import (
 	"github.com/dailyburn/ratchet/data"
 	"github.com/dailyburn/ratchet/logger"
 	"github.com/dailyburn/ratchet/processors"
+	"github.com/dailyburn/ratchet/tracing"
 )
 
 // dummyProcessorDuration is the amount of time ProcessData will spend waiting before it returns.
@@ -89,6 +101,81 @@ func (dw *dummyWriter) ProcessData(d data.JSON, outputChan chan data.JSON, killC
 func (dw *dummyWriter) Finish(outputChan chan data.JSON, killChan chan error) {
 }
 
+// dummyCollector stores every value it receives, in the order received.
+type dummyCollector struct {
+	data []string
+}
+
+func (dc *dummyCollector) String() string {
+	return "dummyCollector"
+}
+
+func (dc *dummyCollector) ProcessData(d data.JSON, outputChan chan data.JSON, killChan chan error) {
+	dc.data = append(dc.data, string(d))
+}
+
+func (dc *dummyCollector) Finish(outputChan chan data.JSON, killChan chan error) {
+}
+
+// dummyEndlessReader keeps sending data until its context is cancelled.
+type dummyEndlessReader struct {
+	ctx context.Context
+}
+
+func (dr *dummyEndlessReader) String() string {
+	return "dummyEndlessReader"
+}
+
+func (dr *dummyEndlessReader) SetContext(ctx context.Context) {
+	dr.ctx = ctx
+}
+
+func (dr *dummyEndlessReader) ProcessData(d data.JSON, outputChan chan data.JSON, killChan chan error) {
+	for dr.ctx.Err() == nil {
+		outputChan <- data.JSON(`"more"`)
+	}
+}
+
+func (dr *dummyEndlessReader) Finish(outputChan chan data.JSON, killChan chan error) {
+}
+
+// dummyFailingProcessor reports two errors for each payload, and keeps running after doing so.
+type dummyFailingProcessor struct{}
+
+func (dp *dummyFailingProcessor) String() string {
+	return "dummyFailingProcessor"
+}
+
+func (dp *dummyFailingProcessor) ProcessData(d data.JSON, outputChan chan data.JSON, killChan chan error) {
+	killChan <- errors.New("first failure")
+	killChan <- errors.New("second failure")
+	outputChan <- d
+}
+
+func (dp *dummyFailingProcessor) Finish(outputChan chan data.JSON, killChan chan error) {
+}
+
+// dummyContextProcessor upper cases the data it receives, skipping empty data, and fails if it receives "fail".
+type dummyContextProcessor struct{}
+
+func (dp *dummyContextProcessor) String() string {
+	return "dummyContextProcessor"
+}
+
+func (dp *dummyContextProcessor) ProcessData(ctx context.Context, d data.JSON, out ratchet.Emitter) error {
+	if string(d) == "fail" {
+		return errors.New("received fail")
+	}
+	if len(d) == 0 {
+		return nil
+	}
+	return out.Emit(data.JSON(strings.ToUpper(string(d))))
+}
+
+func (dp *dummyContextProcessor) Finish(ctx context.Context, out ratchet.Emitter) error {
+	return out.Emit(data.JSON("!"))
+}
+
 func TestDataProcessor(t *testing.T) {
 	logger.LogLevel = logger.LevelDebug
 
@@ -182,6 +269,1545 @@ func TestConcurrentFuncTransformer(t *testing.T) {
 	}
 }
 
+// dummyUnorderedProcessor passes data through concurrently, without keeping
+// its order. Data starting with "slow" takes 100ms.
+type dummyUnorderedProcessor struct {
+	window int
+}
+
+func (dp *dummyUnorderedProcessor) ProcessData(ctx context.Context, d data.JSON, out ratchet.Emitter) error {
+	if strings.HasPrefix(string(d), "slow") {
+		time.Sleep(100 * time.Millisecond)
+	}
+	return out.Emit(d)
+}
+
+func (dp *dummyUnorderedProcessor) Finish(ctx context.Context, out ratchet.Emitter) error {
+	return nil
+}
+
+func (dp *dummyUnorderedProcessor) Concurrency() int {
+	return dummyProcessorConcurrency
+}
+
+func (dp *dummyUnorderedProcessor) ReorderWindow() int {
+	return dp.window
+}
+
+func TestUnorderedDataProcessor(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	for _, test := range []struct {
+		window   int
+		expected []string // the first payloads sent
+	}{
+		{0, []string{"hi", "there", "guys", "slow"}},
+		// "there" can't start until "slow" is done
+		{2, []string{"hi", "slow"}},
+	} {
+		writer := dummyWriter{}
+		reader := &dummyReader{data: [4]string{"slow", "hi", "there", "guys"}}
+		pipeline := ratchet.NewPipeline(reader, ratchet.Wrap(&dummyUnorderedProcessor{test.window}), &writer)
+		if err := <-pipeline.Run(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(writer.data[:len(test.expected)], test.expected) {
+			t.Errorf("Expected window %d to send %#v, got %#v", test.window, test.expected, writer.data)
+		}
+	}
+}
+
+// benchReader sends n payloads, every tenth of which starts with "slow".
+type benchReader struct {
+	n int
+}
+
+func (r *benchReader) ProcessData(ctx context.Context, d data.JSON, out ratchet.Emitter) error {
+	for i := 0; i < r.n; i++ {
+		d := strconv.Itoa(i)
+		if i%10 == 0 {
+			d = "slow" + d
+		}
+		if err := out.Emit(data.JSON(d)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *benchReader) Finish(ctx context.Context, out ratchet.Emitter) error {
+	return nil
+}
+
+// benchProcessor passes data through with a concurrency of 4. Data starting
+// with "slow" takes 1ms.
+type benchProcessor struct{}
+
+func (dp *benchProcessor) ProcessData(ctx context.Context, d data.JSON, out ratchet.Emitter) error {
+	if strings.HasPrefix(string(d), "slow") {
+		time.Sleep(time.Millisecond)
+	}
+	return out.Emit(d)
+}
+
+func (dp *benchProcessor) Finish(ctx context.Context, out ratchet.Emitter) error {
+	return nil
+}
+
+func (dp *benchProcessor) Concurrency() int {
+	return 4
+}
+
+// benchUnorderedProcessor is a benchProcessor that doesn't keep its order.
+type benchUnorderedProcessor struct {
+	benchProcessor
+	window int
+}
+
+func (dp *benchUnorderedProcessor) ReorderWindow() int {
+	return dp.window
+}
+
+func benchmarkConcurrency(b *testing.B, p ratchet.ContextDataProcessor) {
+	logger.LogLevel = logger.LevelSilent
+	pipeline := ratchet.NewPipeline(ratchet.Wrap(&benchReader{b.N}), ratchet.Wrap(p), &dummyCollector{})
+	if err := <-pipeline.Run(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkOrderedConcurrency(b *testing.B) {
+	benchmarkConcurrency(b, &benchProcessor{})
+}
+
+func BenchmarkUnorderedConcurrency(b *testing.B) {
+	benchmarkConcurrency(b, &benchUnorderedProcessor{})
+}
+
+func BenchmarkReorderWindow(b *testing.B) {
+	benchmarkConcurrency(b, &benchUnorderedProcessor{window: 16})
+}
+
+// dummyAdaptiveProcessor takes 5ms for each payload, failing if fail is set.
+type dummyAdaptiveProcessor struct {
+	concurrency int
+	fail        bool
+}
+
+func (dp *dummyAdaptiveProcessor) ProcessData(ctx context.Context, d data.JSON, out ratchet.Emitter) error {
+	time.Sleep(5 * time.Millisecond)
+	if dp.fail {
+		return errors.New("failed")
+	}
+	return out.Emit(d)
+}
+
+func (dp *dummyAdaptiveProcessor) Finish(ctx context.Context, out ratchet.Emitter) error {
+	return nil
+}
+
+func (dp *dummyAdaptiveProcessor) Concurrency() int {
+	return dp.concurrency
+}
+
+func TestAdaptive(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	for _, test := range []struct {
+		p        *dummyAdaptiveProcessor
+		expected func(concurrency int) bool
+	}{
+		// grows with the backlog
+		{&dummyAdaptiveProcessor{}, func(c int) bool { return c > 1 }},
+		// backs off on errors
+		{&dummyAdaptiveProcessor{concurrency: 8, fail: true}, func(c int) bool { return c == 1 }},
+	} {
+		p := ratchet.Wrap(test.p)
+		writer := &dummyCollector{}
+		layout, err := ratchet.NewPipelineLayout(
+			ratchet.NewPipelineStage(ratchet.Do(ratchet.Wrap(&benchReader{100})).Outputs(p)),
+			ratchet.NewPipelineStage(ratchet.Do(p).
+				Adaptive(ratchet.AdaptiveConcurrency{Min: 1, Max: 8, Interval: 10 * time.Millisecond}).
+				OnError(ratchet.DeadLetter(&dummyCollector{})).
+				Outputs(writer)),
+			ratchet.NewPipelineStage(ratchet.Do(writer)),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pipeline := ratchet.NewBranchingPipeline(layout)
+		if err := <-pipeline.Run(); err != nil {
+			t.Fatal(err)
+		}
+		if c := pipeline.StatsReport().Stages[1].Processors[0].Concurrency; !test.expected(c) {
+			t.Errorf("Unexpected concurrency %d for %+v", c, test.p)
+		}
+	}
+}
+
+func TestRunContextCancel(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	// Run a pipeline first, so that goroutines started once per process
+	// (by os/signal) are already running when counting goroutines.
+	<-ratchet.NewPipeline(processors.NewPassthrough()).Run()
+	goroutines := runtime.NumGoroutine()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	pipeline := ratchet.NewPipeline(&dummyEndlessReader{}, processors.NewPassthrough(), processors.NewPassthrough())
+
+	select {
+	case err := <-pipeline.RunContext(ctx):
+		if err != context.DeadlineExceeded {
+			t.Errorf("Expected %v, got %v", context.DeadlineExceeded, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected pipeline to halt once its context was done")
+	}
+
+	// Every goroutine started by the pipeline should exit shortly after it halts.
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > goroutines && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("Expected %d goroutines after the pipeline halted, got %d", goroutines, n)
+	}
+}
+
+func TestContextDataProcessor(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	writer := dummyWriter{}
+	pipeline := ratchet.NewPipeline(&dummyReader{data: [4]string{"hi", "there", "guys"}}, ratchet.Wrap(&dummyContextProcessor{}), &writer)
+
+	err := <-pipeline.Run()
+	if err != nil {
+		t.Error("An error occurred in the ratchet pipeline:", err.Error())
+	}
+	expected := [4]string{"HI", "THERE", "GUYS", "!"}
+	if expected != writer.data {
+		t.Errorf("Expected %#v to be passed through the pipeline, got %#v", expected, writer.data)
+	}
+
+	pipeline = ratchet.NewPipeline(&dummyReader{data: [4]string{"hi", "fail", "guys"}}, ratchet.Wrap(&dummyContextProcessor{}), &dummyWriter{})
+
+	err = <-pipeline.Run()
+	if err == nil || err.Error() != "received fail" {
+		t.Errorf("Expected the pipeline to fail with %q, got %v", "received fail", err)
+	}
+}
+
+func TestAdaptFirstError(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	sent := []data.JSON{}
+	out := emitterFunc(func(d data.JSON) error {
+		sent = append(sent, d)
+		return nil
+	})
+	err := ratchet.Adapt(&dummyFailingProcessor{}).ProcessData(context.Background(), data.JSON("hi"), out)
+	if err == nil || err.Error() != "first failure" {
+		t.Errorf("Expected %q to be returned, got %v", "first failure", err)
+	}
+	if len(sent) != 0 {
+		t.Errorf("Expected no data to be emitted after the failure, got %d payloads", len(sent))
+	}
+
+	pipeline := ratchet.NewPipeline(&dummyReader{}, &dummyFailingProcessor{}, &dummyWriter{})
+	select {
+	case err := <-pipeline.Run():
+		if err == nil || err.Error() != "first failure" {
+			t.Errorf("Expected the pipeline to fail with %q, got %v", "first failure", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the pipeline to halt after the first failure")
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	reader := &dummyReader{data: [4]string{"hi", "fail", "guys"}}
+	transformer := ratchet.Wrap(&dummyContextProcessor{})
+	writer := &dummyWriter{}
+	deadLetters := &dummyWriter{}
+	layout, err := ratchet.NewPipelineLayout(
+		ratchet.NewPipelineStage(ratchet.Do(reader).Outputs(transformer)),
+		ratchet.NewPipelineStage(ratchet.Do(transformer).Outputs(writer).OnError(ratchet.DeadLetter(deadLetters))),
+		ratchet.NewPipelineStage(ratchet.Do(writer)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = <-ratchet.NewBranchingPipeline(layout).Run()
+	if err != nil {
+		t.Error("An error occurred in the ratchet pipeline:", err.Error())
+	}
+	expected := [4]string{"HI", "GUYS", "!"}
+	if expected != writer.data {
+		t.Errorf("Expected %#v to be passed through the pipeline, got %#v", expected, writer.data)
+	}
+	expected = [4]string{`{"error":"received fail","processor":"dummyContextProcessor","stage":2,"data":"fail"}`}
+	if expected != deadLetters.data {
+		t.Errorf("Expected dead letters %#v, got %#v", expected, deadLetters.data)
+	}
+}
+
+func TestGraph(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	// The reader sends to the writer directly as well as through the
+	// transformer, which a PipelineLayout can not express without a Passthrough.
+	reader := &dummyReader{data: [4]string{"hi"}}
+	transformer := ratchet.Wrap(&dummyContextProcessor{})
+	writer := &dummyCollector{}
+	layout, err := ratchet.NewGraph().
+		Connect(reader, transformer, writer).
+		Connect(transformer, writer).
+		Layout()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = <-ratchet.NewBranchingPipeline(layout).Run()
+	if err != nil {
+		t.Error("An error occurred in the ratchet pipeline:", err.Error())
+	}
+	sort.Strings(writer.data)
+	expected := []string{"", "", "", "!", "HI", "hi"}
+	if !reflect.DeepEqual(expected, writer.data) {
+		t.Errorf("Expected %#v to be passed through the pipeline, got %#v", expected, writer.data)
+	}
+
+	other := &dummyWriter{}
+	_, err = ratchet.NewGraph().Connect(reader, transformer).Connect(transformer, writer).Connect(writer, transformer).Layout()
+	if err == nil || !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("Expected a cycle error, got %v", err)
+	}
+	_, err = ratchet.NewGraph().Connect(reader, writer).Add(other).Layout()
+	if err == nil || !strings.Contains(err.Error(), "dangling") {
+		t.Errorf("Expected a dangling error, got %v", err)
+	}
+}
+
+func TestDiagram(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	reader := &dummyReader{data: [4]string{"hi", "fail"}}
+	transformer := ratchet.Wrap(&dummyContextProcessor{})
+	writer := &dummyCollector{}
+	deadLetters := &dummyCollector{}
+	layout, err := ratchet.NewGraph().
+		Connect(reader, transformer, writer).
+		Connect(transformer, writer).
+		OnError(transformer, ratchet.DeadLetter(deadLetters)).
+		Layout()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `flowchart LR
+	subgraph stage1 ["Stage 1"]
+		s1_1["dummyReader"]
+	end
+	subgraph stage2 ["Stage 2"]
+		s2_1["dummyContextProcessor"]
+	end
+	subgraph stage3 ["Stage 3"]
+		s3_1["dummyCollector"]
+	end
+	dl1["dummyCollector"]
+	s1_1 --> s2_1
+	s1_1 --> s3_1
+	s2_1 --> s3_1
+	s2_1 -.->|"on error"| dl1
+`
+	if layout.Mermaid() != expected {
+		t.Errorf("Expected Mermaid diagram:\n%s\ngot:\n%s", expected, layout.Mermaid())
+	}
+	if !strings.Contains(layout.DOT(), "s2_1 -> dl1 [label=\"on error\", style=dashed];") {
+		t.Errorf("Expected DOT diagram to include the dead letter edge, got:\n%s", layout.DOT())
+	}
+
+	pipeline := ratchet.NewBranchingPipeline(layout)
+	if !strings.Contains(pipeline.DOT(), "s1_1 -> s3_1 [label=\"unbuffered\"];") {
+		t.Errorf("Expected DOT diagram to show the edges are unbuffered before running, got:\n%s", pipeline.DOT())
+	}
+	pipeline.BufferLength = 2
+	if err := <-pipeline.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(pipeline.DOT(), "s1_1 -> s3_1 [label=\"buffer 2, 4 sent\"];") {
+		t.Errorf("Expected DOT diagram to include edge stats, got:\n%s", pipeline.DOT())
+	}
+}
+
+func TestStatsReport(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	reader := &dummyReader{data: [4]string{"hi", "fail", "guys"}}
+	transformer := ratchet.Wrap(&dummyContextProcessor{})
+	writer := &dummyWriter{}
+	layout, err := ratchet.NewPipelineLayout(
+		ratchet.NewPipelineStage(ratchet.Do(reader).Outputs(transformer)),
+		ratchet.NewPipelineStage(ratchet.Do(transformer).Outputs(writer).OnError(ratchet.DeadLetter(&dummyCollector{}))),
+		ratchet.NewPipelineStage(ratchet.Do(writer)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline := ratchet.NewBranchingPipeline(layout)
+	if err := <-pipeline.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := json.Marshal(pipeline.StatsReport())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var report ratchet.StatsReport
+	if err := json.Unmarshal(b, &report); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Stages) != 3 || len(report.DeadLetters) != 1 || report.Finished.IsZero() {
+		t.Fatalf("Expected 3 finished stages and a dead letter, got %s", b)
+	}
+	s := report.Stages[1].Processors[0]
+	if s.Name != "dummyContextProcessor" || s.PayloadsReceived != 4 || s.PayloadsSent != 3 || s.Errors != 1 {
+		t.Errorf("Expected 4 payloads received, 3 sent and 1 error, got %+v", s)
+	}
+	expected := ratchet.Distribution{Count: 4, Min: 0, Max: 4, P50: 2, P95: 4, P99: 4}
+	if s.PayloadSizesReceived != expected || s.ExecutionTimes.Count != 4 {
+		t.Errorf("Expected payload size distribution %+v and 4 execution times, got %+v and %+v", expected, s.PayloadSizesReceived, s.ExecutionTimes)
+	}
+	if s.Started.IsZero() || s.Finished.Before(s.Started) {
+		t.Errorf("Expected start and finish timestamps, got %v and %v", s.Started, s.Finished)
+	}
+	if report.String() != pipeline.Stats() || !strings.Contains(pipeline.Stats(), "     - Errors = 1\r\n") {
+		t.Errorf("Expected Stats to be rendered from the report, got %q", pipeline.Stats())
+	}
+}
+
+func TestRoute(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	isHi := func(d data.JSON) bool { return string(d) == "hi" }
+	hasH := func(d data.JSON) bool { return strings.Contains(string(d), "h") }
+	for _, test := range []struct {
+		mode           ratchet.RoutingMode
+		hi, h, other   []string
+		expectedRoutes map[string]int64
+	}{
+		{ratchet.FirstMatch, []string{"hi"}, []string{"huh"}, []string{"", "guys"},
+			map[string]int64{"dummyWriter": 1, "dummyCollector": 1, "dummyCollector (default)": 2, "(unrouted)": 0}},
+		{ratchet.AllMatches, []string{"hi"}, []string{"hi", "huh"}, []string{"", "guys"},
+			map[string]int64{"dummyWriter": 1, "dummyCollector": 2, "dummyCollector (default)": 2, "(unrouted)": 0}},
+	} {
+		reader := &dummyReader{data: [4]string{"hi", "guys", "huh"}}
+		hi := &dummyWriter{}
+		h := &dummyCollector{}
+		other := &dummyCollector{}
+		layout, err := ratchet.NewPipelineLayout(
+			ratchet.NewPipelineStage(ratchet.Do(reader).Route(isHi, hi).Route(hasH, h).Default(other).Routing(test.mode)),
+			ratchet.NewPipelineStage(ratchet.Do(hi), ratchet.Do(h), ratchet.Do(other)),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pipeline := ratchet.NewBranchingPipeline(layout)
+		if err := <-pipeline.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		sort.Strings(h.data)
+		sort.Strings(other.data)
+		if hi.data != [4]string{"hi"} || !reflect.DeepEqual(h.data, test.h) || !reflect.DeepEqual(other.data, test.other) {
+			t.Errorf("Expected routes %v/%v/%v, got %v/%v/%v", test.hi, test.h, test.other, hi.data[:hi.i], h.data, other.data)
+		}
+		routes := pipeline.StatsReport().Stages[0].Processors[0].Routes
+		if !reflect.DeepEqual(routes, test.expectedRoutes) {
+			t.Errorf("Expected route counts %v, got %v", test.expectedRoutes, routes)
+		}
+	}
+}
+
+func TestPartition(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	records := [4]string{`{"c":"a","n":1}`, `{"c":"b","n":2}`, `{"c":"a","n":3}`, `{"c":"b","n":4}`}
+	for _, test := range []struct {
+		partitioner ratchet.Partitioner
+		expected    [][]string
+	}{
+		{ratchet.RoundRobin(), [][]string{{records[0], records[2]}, {records[1], records[3]}}},
+		{ratchet.HashPartition(ratchet.JSONKey("c")), [][]string{{records[0], records[2]}, {records[1], records[3]}}},
+	} {
+		reader := &dummyReader{data: records}
+		var collectors []*dummyCollector
+		replicas := ratchet.Replicas(2, func(i int) ratchet.DataProcessor {
+			c := &dummyCollector{}
+			collectors = append(collectors, c)
+			return c
+		})
+		layout, err := ratchet.NewPipelineLayout(
+			ratchet.NewPipelineStage(ratchet.Do(reader).Partition(test.partitioner, replicas...)),
+			ratchet.NewPipelineStage(ratchet.DoAll(replicas...)...),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pipeline := ratchet.NewBranchingPipeline(layout)
+		if err := <-pipeline.Run(); err != nil {
+			t.Fatal(err)
+		}
+
+		got := [][]string{collectors[0].data, collectors[1].data}
+		if !reflect.DeepEqual(got, test.expected) && !reflect.DeepEqual(got, [][]string{test.expected[1], test.expected[0]}) {
+			t.Errorf("Expected partitions %v, got %v", test.expected, got)
+		}
+		routes := pipeline.StatsReport().Stages[0].Processors[0].Routes
+		expectedRoutes := map[string]int64{"dummyCollector (partition 1)": int64(len(got[0])), "dummyCollector (partition 2)": int64(len(got[1]))}
+		if !reflect.DeepEqual(routes, expectedRoutes) {
+			t.Errorf("Expected partition counts %v, got %v", expectedRoutes, routes)
+		}
+	}
+}
+
+func TestSubPipeline(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	inner, err := ratchet.NewPipelineLayout(
+		ratchet.NewPipelineStage(ratchet.Do(ratchet.Wrap(&dummyContextProcessor{}))),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := &dummyWriter{}
+	pipeline := ratchet.NewPipeline(&dummyReader{data: [4]string{"hi", "there", "guys"}}, ratchet.SubPipeline(inner), writer)
+	if err := <-pipeline.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := [4]string{"HI", "THERE", "GUYS", "!"}; writer.data != expected {
+		t.Errorf("Expected %#v to be sent on by the SubPipeline, got %#v", expected, writer.data)
+	}
+	sub := pipeline.StatsReport().Stages[1].Processors[0].SubPipeline
+	if sub == nil || sub.Stages[0].Processors[0].PayloadsReceived != 4 {
+		t.Errorf("Expected the inner stats to be nested, got %+v", sub)
+	}
+	if !strings.Contains(pipeline.Stats(), "\r\n         * dummyContextProcessor\r\n") {
+		t.Errorf("Expected the inner stats to be indented, got %q", pipeline.Stats())
+	}
+
+	// Errors in the inner DataProcessors halt the outer Pipeline.
+	inner, _ = ratchet.NewPipelineLayout(
+		ratchet.NewPipelineStage(ratchet.Do(ratchet.Wrap(&dummyContextProcessor{}))),
+	)
+	pipeline = ratchet.NewPipeline(&dummyReader{data: [4]string{"hi", "fail"}}, ratchet.SubPipeline(inner), &dummyWriter{})
+	if err := <-pipeline.Run(); err == nil || err.Error() != "received fail" {
+		t.Errorf("Expected the inner error to halt the pipeline, got %v", err)
+	}
+
+	// Even with a DeadLetter ErrorPolicy, since the error can't be tied to
+	// the payload being processed by the SubPipeline.
+	inner, _ = ratchet.NewPipelineLayout(
+		ratchet.NewPipelineStage(ratchet.Do(ratchet.Wrap(&dummyContextProcessor{}))),
+	)
+	deadLetters := &dummyCollector{}
+	sp := ratchet.SubPipeline(inner)
+	reader := &dummyReader{data: [4]string{"hi", "fail", "guys"}}
+	writer = &dummyWriter{}
+	layout, err := ratchet.NewPipelineLayout(
+		ratchet.NewPipelineStage(ratchet.Do(reader).Outputs(sp)),
+		ratchet.NewPipelineStage(ratchet.Do(sp).Outputs(writer).OnError(ratchet.DeadLetter(deadLetters))),
+		ratchet.NewPipelineStage(ratchet.Do(writer)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-ratchet.NewBranchingPipeline(layout).Run(); err == nil || err.Error() != "received fail" {
+		t.Errorf("Expected the inner error to halt the pipeline, got %v", err)
+	}
+	if len(deadLetters.data) != 0 {
+		t.Errorf("Expected no dead letters, got %v", deadLetters.data)
+	}
+
+	// A SubPipeline runs again in a new outer Pipeline once the last one
+	// has been halted, whether by an inner error or by an outer one.
+	for _, inner := range []bool{true, false} {
+		failOnce := ratchet.Wrap(&dummyFailOnceProcessor{})
+		layout, _ := ratchet.NewPipelineLayout(ratchet.NewPipelineStage(ratchet.Do(processors.NewPassthrough())))
+		if inner {
+			layout, _ = ratchet.NewPipelineLayout(ratchet.NewPipelineStage(ratchet.Do(failOnce)))
+			failOnce = processors.NewPassthrough()
+		}
+		sp := ratchet.SubPipeline(layout)
+		reader := &dummyReader{data: [4]string{"hi", "fail", "there"}}
+		pipeline = ratchet.NewPipeline(reader, sp, failOnce, &dummyCollector{})
+		if err := <-pipeline.Run(); err == nil || err.Error() != "received fail" {
+			t.Fatalf("Expected the error to halt the pipeline, got %v", err)
+		}
+		collector := &dummyCollector{}
+		reader = &dummyReader{data: [4]string{"hi", "fail", "there"}}
+		if err := <-ratchet.NewPipeline(reader, sp, failOnce, collector).Run(); err != nil {
+			t.Fatal(err)
+		}
+		if expected := []string{"hi", "fail", "there", ""}; !reflect.DeepEqual(collector.data, expected) {
+			t.Errorf("Expected %v to be sent on by the rerun SubPipeline, got %v", expected, collector.data)
+		}
+	}
+}
+
+// dummyFailOnceProcessor passes data on, failing the first time
+// it receives "fail".
+type dummyFailOnceProcessor struct {
+	failed int32
+}
+
+func (dp *dummyFailOnceProcessor) ProcessData(ctx context.Context, d data.JSON, out ratchet.Emitter) error {
+	if string(d) == "fail" && atomic.CompareAndSwapInt32(&dp.failed, 0, 1) {
+		return errors.New("received fail")
+	}
+	return out.Emit(d)
+}
+
+func (dp *dummyFailOnceProcessor) Finish(ctx context.Context, out ratchet.Emitter) error {
+	return nil
+}
+
+func TestRunStream(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	writer := &dummyWriter{}
+	pipeline := ratchet.NewPipeline(ratchet.Wrap(&dummyContextProcessor{}), writer)
+	if err := <-pipeline.RunWith(data.JSON("hi"), data.JSON("there")); err != nil {
+		t.Fatal(err)
+	}
+	if expected := [4]string{"HI", "THERE", "!"}; writer.data != expected {
+		t.Errorf("Expected RunWith to send %#v, got %#v", expected, writer.data)
+	}
+
+	writer = &dummyWriter{}
+	pipeline = ratchet.NewPipeline(ratchet.Wrap(&dummyContextProcessor{}), writer)
+	input, killChan := pipeline.RunStream(context.Background())
+	for _, d := range []string{"hi", "there", "guys"} {
+		if err := input.Emit(data.JSON(d)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	input.Close()
+	if err := <-killChan; err != nil {
+		t.Fatal(err)
+	}
+	if expected := [4]string{"HI", "THERE", "GUYS", "!"}; writer.data != expected {
+		t.Errorf("Expected the streamed data %#v, got %#v", expected, writer.data)
+	}
+	if err := input.Emit(data.JSON("late")); err != ratchet.ErrInputClosed {
+		t.Errorf("Expected ErrInputClosed once closed, got %v", err)
+	}
+}
+
+// dummyPanicProcessor panics when it receives "panic".
+type dummyPanicProcessor struct{}
+
+func (dp *dummyPanicProcessor) String() string {
+	return "dummyPanicProcessor"
+}
+
+func (dp *dummyPanicProcessor) ProcessData(d data.JSON, outputChan chan data.JSON, killChan chan error) {
+	if string(d) == "panic" {
+		panic("oops")
+	}
+	outputChan <- d
+}
+
+func (dp *dummyPanicProcessor) Finish(outputChan chan data.JSON, killChan chan error) {
+}
+
+// dummyConcurrentPanicProcessor is a concurrent ContextDataProcessor that
+// panics when it receives "panic".
+type dummyConcurrentPanicProcessor struct{}
+
+func (dp *dummyConcurrentPanicProcessor) ProcessData(ctx context.Context, d data.JSON, out ratchet.Emitter) error {
+	if string(d) == "panic" {
+		var m map[string]int
+		m["oops"]++
+	}
+	return out.Emit(d)
+}
+
+func (dp *dummyConcurrentPanicProcessor) Finish(ctx context.Context, out ratchet.Emitter) error {
+	return nil
+}
+
+func (dp *dummyConcurrentPanicProcessor) Concurrency() int {
+	return dummyProcessorConcurrency
+}
+
+func TestPanic(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	pipeline := ratchet.NewPipeline(&dummyReader{data: [4]string{"hi", "panic"}}, &dummyPanicProcessor{}, &dummyWriter{})
+	err := <-pipeline.Run()
+	pe, ok := err.(*ratchet.PanicError)
+	if !ok {
+		t.Fatalf("Expected a PanicError, got %v", err)
+	}
+	if pe.Processor != "dummyPanicProcessor" || pe.Stage != 2 || pe.Value != "oops" || string(pe.Data) != "panic" || len(pe.Stack) == 0 {
+		t.Errorf("Unexpected PanicError %+v", pe)
+	}
+
+	// Panics are handled according to the ErrorPolicy.
+	p := ratchet.Wrap(&dummyConcurrentPanicProcessor{})
+	writer := &dummyWriter{}
+	deadLetters := &dummyCollector{}
+	layout, err := ratchet.NewPipelineLayout(
+		ratchet.NewPipelineStage(ratchet.Do(&dummyReader{data: [4]string{"hi", "panic", "there"}}).Outputs(p)),
+		ratchet.NewPipelineStage(ratchet.Do(p).OnError(ratchet.DeadLetter(deadLetters)).Outputs(writer)),
+		ratchet.NewPipelineStage(ratchet.Do(writer)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-ratchet.NewBranchingPipeline(layout).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := [4]string{"hi", "there", ""}; writer.data != expected {
+		t.Errorf("Expected %#v to be written, got %#v", expected, writer.data)
+	}
+	if len(deadLetters.data) != 1 || !strings.Contains(deadLetters.data[0], "panicked: assignment to entry in nil map") {
+		t.Errorf("Expected the panic to be sent to the dead letter, got %v", deadLetters.data)
+	}
+}
+
+// dummyStuckProcessor is a ContextDataProcessor that ignores its context and
+// blocks when it receives "stuck", until release is closed. It closes stuck
+// (when set) once it blocks, and counts the calls overlapping another one.
+type dummyStuckProcessor struct {
+	release     chan struct{}
+	stuck       chan struct{}
+	running     int32
+	overlapping int32
+}
+
+func (dp *dummyStuckProcessor) ProcessData(ctx context.Context, d data.JSON, out ratchet.Emitter) error {
+	if atomic.AddInt32(&dp.running, 1) > 1 {
+		atomic.AddInt32(&dp.overlapping, 1)
+	}
+	defer atomic.AddInt32(&dp.running, -1)
+	if string(d) == "stuck" {
+		if dp.stuck != nil {
+			close(dp.stuck)
+		}
+		<-dp.release
+	}
+	return out.Emit(d)
+}
+
+func (dp *dummyStuckProcessor) Finish(ctx context.Context, out ratchet.Emitter) error {
+	return nil
+}
+
+func (dp *dummyStuckProcessor) String() string {
+	return "dummyStuckProcessor"
+}
+
+func TestTimeout(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	// The abandoned call returns before the timeout of the next one passes.
+	stuck := &dummyStuckProcessor{release: make(chan struct{}), stuck: make(chan struct{})}
+	go func() {
+		<-stuck.stuck
+		time.Sleep(300 * time.Millisecond)
+		close(stuck.release)
+	}()
+	writer, deadLetters, err := runTimeout(ratchet.Wrap(stuck), 200*time.Millisecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := [4]string{"hi", "there", ""}; writer.data != expected {
+		t.Errorf("Expected %#v to be written, got %#v", expected, writer.data)
+	}
+	if len(deadLetters.data) != 1 || !strings.Contains(deadLetters.data[0], "dummyStuckProcessor (stage 2) ProcessData timed out after 200ms") {
+		t.Errorf("Expected the timeout to be sent to the dead letter, got %v", deadLetters.data)
+	}
+	if n := atomic.LoadInt32(&stuck.overlapping); n != 0 {
+		t.Errorf("Expected the calls not to overlap, %d did", n)
+	}
+
+	// The abandoned call never returns, so the next ones are never made,
+	// and the Pipeline is halted once Finish gives up waiting for it.
+	stuck = &dummyStuckProcessor{release: make(chan struct{})}
+	defer close(stuck.release)
+	_, _, err = runTimeout(ratchet.Wrap(stuck), 50*time.Millisecond, 0)
+	if err == nil || err.Error() != "dummyStuckProcessor (stage 2) Finish timed out after 50ms" {
+		t.Errorf("Expected Finish to time out, got %v", err)
+	}
+	if n := atomic.LoadInt32(&stuck.overlapping); n != 0 {
+		t.Errorf("Expected the calls not to overlap, %d did", n)
+	}
+
+	// An old-style DataProcessor can't be interrupted either, so the next
+	// calls time out waiting for it, until Finish waits long enough.
+	slow := &dummySlowProcessor{}
+	writer, _, err = runTimeout(slow, 50*time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := [4]string{"hi"}; writer.data != expected {
+		t.Errorf("Expected %#v to be written, got %#v", expected, writer.data)
+	}
+	if n := atomic.LoadInt32(&slow.overlapping); n != 0 {
+		t.Errorf("Expected the calls not to overlap, %d did", n)
+	}
+}
+
+// dummySlowProcessor is an old-style DataProcessor that sleeps for 300ms
+// when it receives "stuck", counting the calls overlapping another one.
+type dummySlowProcessor struct {
+	running     int32
+	overlapping int32
+}
+
+func (dp *dummySlowProcessor) ProcessData(d data.JSON, outputChan chan data.JSON, killChan chan error) {
+	if atomic.AddInt32(&dp.running, 1) > 1 {
+		atomic.AddInt32(&dp.overlapping, 1)
+	}
+	defer atomic.AddInt32(&dp.running, -1)
+	if string(d) == "stuck" {
+		time.Sleep(300 * time.Millisecond)
+	}
+	outputChan <- d
+}
+
+func (dp *dummySlowProcessor) Finish(outputChan chan data.JSON, killChan chan error) {
+	if atomic.LoadInt32(&dp.running) > 0 {
+		atomic.AddInt32(&dp.overlapping, 1)
+	}
+}
+
+func (dp *dummySlowProcessor) String() string {
+	return "dummySlowProcessor"
+}
+
+// runTimeout runs "hi", "stuck" and "there" through p with the given
+// timeouts.
+func runTimeout(p ratchet.DataProcessor, processData, finish time.Duration) (*dummyWriter, *dummyCollector, error) {
+	writer := &dummyWriter{}
+	deadLetters := &dummyCollector{}
+	layout, err := ratchet.NewPipelineLayout(
+		ratchet.NewPipelineStage(ratchet.Do(&dummyReader{data: [4]string{"hi", "stuck", "there"}}).Outputs(p)),
+		ratchet.NewPipelineStage(ratchet.Do(p).Timeout(processData, finish).OnError(ratchet.DeadLetter(deadLetters)).Outputs(writer)),
+		ratchet.NewPipelineStage(ratchet.Do(writer)),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = <-ratchet.NewBranchingPipeline(layout).Run()
+	return writer, deadLetters, err
+}
+
+func TestStallTimeout(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+	release := make(chan struct{})
+	defer close(release)
+
+	pipeline := ratchet.NewPipeline(&dummyReader{data: [4]string{"hi", "stuck", "there"}}, ratchet.Wrap(&dummyStuckProcessor{release: release}), &dummyWriter{})
+	pipeline.StallTimeout = 100 * time.Millisecond
+	err := <-pipeline.Run()
+	se, ok := err.(*ratchet.StallError)
+	if !ok {
+		t.Fatalf("Expected a StallError, got %v", err)
+	}
+	if !strings.Contains(se.Error(), "Pipeline: stalled, no data moved for") || !strings.Contains(se.Error(), "stage 2 dummyStuckProcessor (processing for") {
+		t.Errorf("Unexpected error %q", se.Error())
+	}
+	for _, s := range []string{"* dummyStuckProcessor: processing for", "- ProcessData running for", "Goroutines)", "dummyStuckProcessor).ProcessData"} {
+		if !strings.Contains(se.Diagnostics, s) {
+			t.Errorf("Expected %q in the diagnostics, got\n%s", s, se.Diagnostics)
+		}
+	}
+
+	// A StallTimeout too short to tick at a quarter of it still works.
+	pipeline = ratchet.NewPipeline(&dummyReader{data: [4]string{"hi", "stuck", "there"}}, ratchet.Wrap(&dummyStuckProcessor{release: release}), &dummyWriter{})
+	pipeline.StallTimeout = time.Nanosecond
+	err = <-pipeline.Run()
+	if _, ok := err.(*ratchet.StallError); !ok {
+		t.Errorf("Expected a StallError, got %v", err)
+	}
+}
+
+func TestSignals(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	interrupt := func() {
+		time.Sleep(10 * time.Millisecond)
+		p, _ := os.FindProcess(os.Getpid())
+		p.Signal(os.Interrupt)
+	}
+
+	calls := make(chan string, 2)
+	expectCalls := func(expected ...string) {
+		for _, e := range expected {
+			select {
+			case call := <-calls:
+				if call != e {
+					t.Errorf("Expected %q, got %q", e, call)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Expected %q, got nothing", e)
+			}
+		}
+	}
+
+	writer := &dummyCollector{}
+	committer := ratchet.Wrap(&dummyCommitter{name: "c", calls: calls})
+	pipeline := ratchet.NewPipeline(&dummyEndlessReader{}, ratchet.Wrap(&dummyContextProcessor{}), writer, committer)
+	pipeline.Signals = &ratchet.SignalHandling{Graceful: true, DrainTimeout: 5 * time.Second}
+	killChan := pipeline.Run()
+	interrupt()
+	if err := <-killChan; err != ratchet.ErrInterrupted {
+		t.Fatalf("Expected %v, got %v", ratchet.ErrInterrupted, err)
+	}
+	// Finish is called on the later stages once the reader stops.
+	if n := len(writer.data); n < 2 || writer.data[n-1] != "!" || writer.data[n-2] != `"MORE"` {
+		t.Errorf("Expected the pipeline to drain, got %d payloads ending %v", n, writer.data[n-1:])
+	}
+	// The drained data is committed.
+	expectCalls("c prepare", "c commit")
+
+	pipeline = ratchet.NewPipeline(&dummyEndlessReader{}, ratchet.Wrap(&dummyContextProcessor{}), &dummyCollector{}, committer)
+	pipeline.Signals = &ratchet.SignalHandling{}
+	killChan = pipeline.Run()
+	interrupt()
+	if err := <-killChan; err != ratchet.ErrInterrupted {
+		t.Errorf("Expected %v, got %v", ratchet.ErrInterrupted, err)
+	}
+	// Without draining, nothing is.
+	expectCalls("c abort")
+}
+
+// dummyCheckpointStore keeps checkpoints in memory.
+type dummyCheckpointStore struct {
+	mu        sync.Mutex
+	positions map[string]string
+}
+
+func (s *dummyCheckpointStore) Load(runID, source string) (data.JSON, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.positions[runID+"/"+source]; ok {
+		return data.JSON(p), nil
+	}
+	return nil, nil
+}
+
+func (s *dummyCheckpointStore) Save(runID, source string, position data.JSON) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.positions[runID+"/"+source] = string(position)
+	return nil
+}
+
+// dummyFailingCollector stores every value it receives, and fails if it receives "fail".
+type dummyFailingCollector struct {
+	data []string
+}
+
+func (dc *dummyFailingCollector) ProcessData(ctx context.Context, d data.JSON, out ratchet.Emitter) error {
+	if string(d) == "fail" {
+		return errors.New("received fail")
+	}
+	dc.data = append(dc.data, string(d))
+	return nil
+}
+
+func (dc *dummyFailingCollector) Finish(ctx context.Context, out ratchet.Emitter) error {
+	return nil
+}
+
+func TestCheckpoint(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	store := &dummyCheckpointStore{positions: make(map[string]string)}
+	run := func(input string) ([]string, error) {
+		collector := &dummyFailingCollector{}
+		pipeline := ratchet.NewPipeline(processors.NewIoReader(strings.NewReader(input)), ratchet.Wrap(collector))
+		pipeline.Checkpoints = &ratchet.Checkpointing{RunID: "test", Store: store}
+		err := <-pipeline.Run()
+		return collector.data, err
+	}
+
+	if _, err := run("a\nb\nfail\nc\n"); err == nil {
+		t.Fatal("Expected the first run to fail")
+	}
+	if expected := `{"offset":4,"line":2}`; store.positions["test/IoReader"] != expected {
+		t.Errorf("Expected the position %s to be saved, got %v", expected, store.positions)
+	}
+	// The rerun resumes after the lines processed by the first one.
+	collected, err := run("a\nb\nfixed\nc\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"fixed", "c"}; !reflect.DeepEqual(collected, expected) {
+		t.Errorf("Expected the rerun to process %v, got %v", expected, collected)
+	}
+	// Once completed, there is nothing left to read.
+	if collected, err = run("a\nb\nfixed\nc\n"); err != nil || len(collected) != 0 {
+		t.Errorf("Expected nothing left to process, got %v (%v)", collected, err)
+	}
+}
+
+// dummyTrackingReader emits the lines of each of its files with ratchet.Track,
+// recording the files once they are acknowledged.
+type dummyTrackingReader struct {
+	files [][]string
+	mu    sync.Mutex
+	acked []int
+}
+
+func (dr *dummyTrackingReader) ProcessData(ctx context.Context, d data.JSON, out ratchet.Emitter) error {
+	for i, lines := range dr.files {
+		i := i
+		tracked, done := ratchet.Track(out, func() {
+			dr.mu.Lock()
+			dr.acked = append(dr.acked, i)
+			dr.mu.Unlock()
+		})
+		for _, line := range lines {
+			if err := tracked.Emit(data.JSON(line)); err != nil {
+				return err
+			}
+		}
+		done()
+	}
+	return nil
+}
+
+func (dr *dummyTrackingReader) Finish(ctx context.Context, out ratchet.Emitter) error {
+	return nil
+}
+
+// dummyDataTracker is a dummyTrackingReader reading its files in ProcessFrom
+// as well, recording whether it was called.
+type dummyDataTracker struct {
+	dummyTrackingReader
+	trackData     bool
+	processedFrom bool
+}
+
+func (dr *dummyDataTracker) ProcessFrom(ctx context.Context, d data.JSON, from data.JSON, out ratchet.CheckpointEmitter) error {
+	dr.processedFrom = true
+	return dr.dummyTrackingReader.ProcessData(ctx, d, out)
+}
+
+func (dr *dummyDataTracker) TracksData() bool {
+	return dr.trackData
+}
+
+// dummyFinishWriter is a FinishAcker that "writes" the data it receives in
+// Finish, failing if fail is set.
+type dummyFinishWriter struct {
+	fail bool
+}
+
+func (dw *dummyFinishWriter) ProcessData(ctx context.Context, d data.JSON, out ratchet.Emitter) error {
+	return nil
+}
+
+func (dw *dummyFinishWriter) Finish(ctx context.Context, out ratchet.Emitter) error {
+	if dw.fail {
+		return errors.New("write failed")
+	}
+	return nil
+}
+
+func (dw *dummyFinishWriter) AckOnFinish() bool {
+	return true
+}
+
+// dummyDeferringWriter defers acknowledging the data it receives, and only
+// acknowledges data other than "B".
+type dummyDeferringWriter struct{}
+
+func (dw *dummyDeferringWriter) ProcessData(ctx context.Context, d data.JSON, out ratchet.Emitter) error {
+	if ack := ratchet.DeferAck(ctx); string(d) != "B" {
+		ack()
+	}
+	return nil
+}
+
+func (dw *dummyDeferringWriter) Finish(ctx context.Context, out ratchet.Emitter) error {
+	return nil
+}
+
+func TestAck(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	for _, test := range []struct {
+		writer ratchet.ContextDataProcessor
+		fails  bool
+		acked  []int
+	}{
+		{&dummyFinishWriter{}, false, []int{0, 1}},
+		{&dummyFinishWriter{fail: true}, true, nil},
+		{&dummyDeferringWriter{}, false, []int{1}},
+	} {
+		// The empty line is skipped by dummyContextProcessor, and
+		// acknowledged as such.
+		reader := &dummyTrackingReader{files: [][]string{{"a", "b"}, {"c", ""}}}
+		pipeline := ratchet.NewPipeline(ratchet.Wrap(reader), ratchet.Wrap(&dummyContextProcessor{}), ratchet.Wrap(test.writer))
+		if err := <-pipeline.Run(); (err != nil) != test.fails {
+			t.Errorf("Unexpected error %v", err)
+		}
+		if !reflect.DeepEqual(reader.acked, test.acked) {
+			t.Errorf("Expected files %v to be acknowledged, got %v", test.acked, reader.acked)
+		}
+	}
+}
+
+// dummyCommitter is a Committer recording the calls made to it on calls,
+// which fails in Prepare if failPrepare is set.
+type dummyCommitter struct {
+	name        string
+	failPrepare bool
+	calls       chan string
+}
+
+func (dc *dummyCommitter) String() string {
+	return dc.name
+}
+
+func (dc *dummyCommitter) ProcessData(ctx context.Context, d data.JSON, out ratchet.Emitter) error {
+	return nil
+}
+
+func (dc *dummyCommitter) Finish(ctx context.Context, out ratchet.Emitter) error {
+	return nil
+}
+
+func (dc *dummyCommitter) Prepare(ctx context.Context) error {
+	dc.calls <- dc.name + " prepare"
+	if dc.failPrepare {
+		return errors.New("not ready")
+	}
+	return nil
+}
+
+func (dc *dummyCommitter) Commit(ctx context.Context) error {
+	dc.calls <- dc.name + " commit"
+	return nil
+}
+
+func (dc *dummyCommitter) Abort(ctx context.Context) error {
+	dc.calls <- dc.name + " abort"
+	return nil
+}
+
+func TestDataTracker(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	// Without checkpointing, ProcessFrom is only called when opting in.
+	for _, trackData := range []bool{false, true} {
+		reader := &dummyDataTracker{dummyTrackingReader: dummyTrackingReader{files: [][]string{{"a"}}}, trackData: trackData}
+		writer := &dummyWriter{}
+		if err := <-ratchet.NewPipeline(ratchet.Wrap(reader), writer).Run(); err != nil {
+			t.Fatal(err)
+		}
+		if reader.processedFrom != trackData {
+			t.Errorf("Expected ProcessFrom to be called: %v, got %v", trackData, reader.processedFrom)
+		}
+		if writer.data[0] != "a" || !reflect.DeepEqual(reader.acked, []int{0}) {
+			t.Errorf("Expected a to be written and acknowledged, got %#v and %v", writer.data, reader.acked)
+		}
+	}
+}
+
+func TestCommit(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	for _, test := range []struct {
+		input       string
+		failPrepare bool
+		err         string
+		calls       []string
+	}{
+		{"hi", false, "", []string{"a prepare", "b prepare", "a commit", "b commit"}},
+		{"hi", true, "b: preparing to commit: not ready", []string{"a prepare", "b prepare", "a abort", "b abort"}},
+		{"fail", false, "received fail", []string{"a abort", "b abort"}},
+	} {
+		calls := make(chan string, 10)
+		a := &dummyCommitter{name: "a", calls: calls}
+		b := &dummyCommitter{name: "b", failPrepare: test.failPrepare, calls: calls}
+		reader := &dummyReader{data: [4]string{test.input}}
+		pipeline := ratchet.NewPipeline(reader, ratchet.Wrap(&dummyContextProcessor{}), ratchet.Wrap(a), ratchet.Wrap(b))
+		err := <-pipeline.Run()
+		if fmt.Sprint(err) != test.err && !(err == nil && test.err == "") {
+			t.Errorf("Expected error %q, got %v", test.err, err)
+		}
+		// A halted Pipeline aborts in the background.
+		for _, expected := range test.calls {
+			select {
+			case call := <-calls:
+				if call != expected {
+					t.Errorf("Expected %q, got %q", expected, call)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Expected %q, got nothing", expected)
+			}
+		}
+	}
+
+	// A new run waits for the halted one to abort the same Committer,
+	// which happens once its stuck stage exits.
+	calls := make(chan string, 10)
+	c := &dummyCommitter{name: "c", calls: calls}
+	stuck := &dummyStuckProcessor{release: make(chan struct{}), stuck: make(chan struct{})}
+	ctx, cancel := context.WithCancel(context.Background())
+	killChan := ratchet.NewPipeline(&dummyReader{data: [4]string{"stuck"}}, ratchet.Wrap(stuck), ratchet.Wrap(c)).RunContext(ctx)
+	<-stuck.stuck
+	cancel()
+	if err := <-killChan; err != context.Canceled {
+		t.Fatalf("Expected the run to be cancelled, got %v", err)
+	}
+	rerun := make(chan error, 1)
+	go func() {
+		rerun <- <-ratchet.NewPipeline(&dummyReader{data: [4]string{"hi"}}, ratchet.Wrap(c)).Run()
+	}()
+	select {
+	case err := <-rerun:
+		t.Fatalf("Expected the rerun to wait for the abort, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(stuck.release)
+	if err := <-rerun; err != nil {
+		t.Fatal(err)
+	}
+	close(calls)
+	var got []string
+	for call := range calls {
+		got = append(got, call)
+	}
+	if expected := []string{"c abort", "c prepare", "c commit"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
+// headerTagger adds a "tag" header to the data it receives.
+type headerTagger struct{}
+
+func (ht *headerTagger) ProcessData(ctx context.Context, d data.JSON, out ratchet.Emitter) error {
+	return ratchet.WithHeaders(out, ratchet.Headers{"tag": "t"}).Emit(d)
+}
+
+func (ht *headerTagger) Finish(ctx context.Context, out ratchet.Emitter) error {
+	return nil
+}
+
+// headerCollector stores every value it receives, followed by some of its headers.
+type headerCollector struct {
+	data []string
+}
+
+func (hc *headerCollector) ProcessData(ctx context.Context, d data.JSON, out ratchet.Emitter) error {
+	h := ratchet.HeadersFrom(ctx)
+	hc.data = append(hc.data, fmt.Sprintf("%s line=%s tag=%s trace=%s", d, h[ratchet.HeaderLine], h["tag"], h[ratchet.HeaderTraceParent]))
+	if h[ratchet.HeaderLine] != "" && h[ratchet.HeaderReadAt] == "" {
+		return errors.New("missing read-at header")
+	}
+	return nil
+}
+
+func (hc *headerCollector) Finish(ctx context.Context, out ratchet.Emitter) error {
+	return nil
+}
+
+func TestHeaders(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	// Headers pass through a DataProcessor unaware of them.
+	collector := &headerCollector{}
+	reader := processors.NewIoReader(strings.NewReader("a\nb\n"))
+	reader.TrackData = true
+	pipeline := ratchet.NewPipeline(reader, ratchet.Wrap(&headerTagger{}), processors.NewPassthrough(), ratchet.Wrap(collector))
+	if err := <-pipeline.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"a line=1 tag=t trace=", "b line=2 tag=t trace="}; !reflect.DeepEqual(collector.data, expected) {
+		t.Errorf("Expected %v, got %v", expected, collector.data)
+	}
+
+	collector = &headerCollector{}
+	pipeline = ratchet.NewPipeline(ratchet.Wrap(&dummyContextProcessor{}), ratchet.Wrap(collector))
+	input, killChan := pipeline.RunStream(context.Background())
+	if err := input.EmitEnvelope(ratchet.Envelope{Headers: ratchet.Headers{ratchet.HeaderTraceParent: "abc"}, Data: data.JSON("hi")}); err != nil {
+		t.Fatal(err)
+	}
+	input.Close()
+	if err := <-killChan; err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"HI line= tag= trace=abc", "! line= tag= trace="}; !reflect.DeepEqual(collector.data, expected) {
+		t.Errorf("Expected %v, got %v", expected, collector.data)
+	}
+}
+
+// traceCollector stores the traceparent of the ProcessData call for each value it receives.
+type traceCollector struct {
+	parents map[string]string
+}
+
+func (tc *traceCollector) String() string {
+	return "traceCollector"
+}
+
+func (tc *traceCollector) ProcessData(ctx context.Context, d data.JSON, out ratchet.Emitter) error {
+	tc.parents[string(d)] = ratchet.TraceParent(ctx)
+	return nil
+}
+
+func (tc *traceCollector) Finish(ctx context.Context, out ratchet.Emitter) error {
+	return nil
+}
+
+func TestTracing(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	recorder := &tracing.Recorder{}
+	collector := &traceCollector{parents: map[string]string{}}
+	reader := processors.NewIoReader(strings.NewReader("a\nb\n"))
+	reader.TrackData = true
+	pipeline := ratchet.NewPipeline(reader, ratchet.Wrap(&dummyContextProcessor{}), ratchet.Wrap(collector))
+	pipeline.Tracing = &ratchet.Tracing{Exporter: recorder}
+	if err := <-pipeline.Run(); err != nil {
+		t.Fatal(err)
+	}
+	spans := recorder.Spans()
+	byID := make(map[string]ratchet.Span)
+	for _, s := range spans {
+		byID[s.SpanID] = s
+	}
+	// A trace for each line, and for the "!" emitted by Finish.
+	var traces []string
+	traceParents := make(map[string]bool)
+	for _, s := range spans {
+		if s.Name != "traceCollector" {
+			continue
+		}
+		traceParents["00-"+s.TraceID+"-"+s.SpanID+"-01"] = true
+		trace := s.Name
+		for s.ParentSpanID != "" {
+			parent, ok := byID[s.ParentSpanID]
+			if !ok || parent.TraceID != s.TraceID {
+				t.Fatalf("Expected the parent of %+v in the same trace", s)
+			}
+			s = parent
+			trace = s.Name + " line " + s.Attributes[ratchet.HeaderLine] + " > " + trace
+		}
+		traces = append(traces, trace)
+	}
+	sort.Strings(traces)
+	expected := []string{
+		"IoReader line 1 > dummyContextProcessor line  > traceCollector",
+		"IoReader line 2 > dummyContextProcessor line  > traceCollector",
+		"dummyContextProcessor line  > traceCollector",
+	}
+	if len(spans) != 8 || !reflect.DeepEqual(traces, expected) {
+		t.Errorf("Expected the traces %v, got %v from %+v", expected, traces, spans)
+	}
+	for d, tp := range collector.parents {
+		if !traceParents[tp] {
+			t.Errorf("Expected the traceparent of a span for %s, got %q", d, tp)
+		}
+	}
+
+	recorder = &tracing.Recorder{}
+	collector = &traceCollector{parents: map[string]string{}}
+	reader = processors.NewIoReader(strings.NewReader("a\nb\n"))
+	pipeline = ratchet.NewPipeline(reader, ratchet.Wrap(collector))
+	pipeline.Tracing = &ratchet.Tracing{Exporter: recorder, SampleRate: 1e-12}
+	if err := <-pipeline.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if spans := recorder.Spans(); len(spans) != 0 {
+		t.Errorf("Expected the traces not to be sampled, got %+v", spans)
+	}
+	if tp := collector.parents["a"]; !strings.HasSuffix(tp, "-00") {
+		t.Errorf("Expected an unsampled traceparent, got %q", tp)
+	}
+
+	// HTTPRequest passes the trace context on.
+	received := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("traceparent")
+	}))
+	defer server.Close()
+	request, err := processors.NewHTTPRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder = &tracing.Recorder{}
+	pipeline = ratchet.NewPipeline(processors.NewIoReader(strings.NewReader("a\n")), request)
+	pipeline.Tracing = &ratchet.Tracing{Exporter: recorder}
+	if err := <-pipeline.Run(); err != nil {
+		t.Fatal(err)
+	}
+	var requests []ratchet.Span
+	for _, s := range recorder.Spans() {
+		if s.Name == "HTTPRequest" {
+			requests = append(requests, s)
+		}
+	}
+	if len(requests) != 1 {
+		t.Fatalf("Expected one HTTPRequest span, got %+v", requests)
+	}
+	select {
+	case tp := <-received:
+		if s := requests[0]; tp != "00-"+s.TraceID+"-"+s.SpanID+"-01" {
+			t.Errorf("Expected the traceparent of %+v, got %q", s, tp)
+		}
+	default:
+		t.Error("Expected a request to be received")
+	}
+}
+
+// sourceCollector stores every value it receives, prefixed with its source.
+type sourceCollector struct {
+	sources map[ratchet.DataProcessor]string
+	data    []string
+}
+
+func (sc *sourceCollector) ProcessData(ctx context.Context, d data.JSON, out ratchet.Emitter) error {
+	sc.data = append(sc.data, sc.sources[ratchet.Source(ctx)]+string(d))
+	return nil
+}
+
+func (sc *sourceCollector) Finish(ctx context.Context, out ratchet.Emitter) error {
+	return nil
+}
+
+func TestMerge(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	sortByValue := func(d data.JSON) string { return string(d) }
+	for _, test := range []struct {
+		stage    func(c ratchet.DataProcessor) *ratchet.PipelineStage
+		expected []string
+	}{
+		{func(c ratchet.DataProcessor) *ratchet.PipelineStage {
+			return ratchet.NewPipelineStage(ratchet.Do(c).Merge(ratchet.MergeRoundRobin))
+		}, []string{"a1", "b2", "a4", "b3", "a5", "b8", "a10", "b9"}},
+		{func(c ratchet.DataProcessor) *ratchet.PipelineStage {
+			return ratchet.NewPipelineStage(ratchet.Do(c).Merge(ratchet.MergeSequential))
+		}, []string{"a1", "a4", "a5", "a10", "b2", "b3", "b8", "b9"}},
+		{func(c ratchet.DataProcessor) *ratchet.PipelineStage {
+			return ratchet.NewPipelineStage(ratchet.Do(c).MergeSorted(sortByValue))
+		}, []string{"a1", "b2", "b3", "a4", "a5", "b8", "b9", "a10"}},
+	} {
+		a := &dummyReader{data: [4]string{"1", "4", "5", "10"}}
+		b := &dummyReader{data: [4]string{"2", "3", "8", "9"}}
+		collector := &sourceCollector{sources: map[ratchet.DataProcessor]string{a: "a", b: "b"}}
+		c := ratchet.Wrap(collector)
+		layout, err := ratchet.NewPipelineLayout(
+			ratchet.NewPipelineStage(ratchet.Do(a).Outputs(c), ratchet.Do(b).Outputs(c)),
+			test.stage(c),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := <-ratchet.NewBranchingPipeline(layout).Run(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(collector.data, test.expected) {
+			t.Errorf("Expected merged data %v, got %v", test.expected, collector.data)
+		}
+	}
+}
+
+func TestMergeSharedUpstream(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	// The reader sends every payload to both b and c, so it would block on
+	// c while the merge reads all of b's first.
+	lines := []string{}
+	expected := []string{}
+	for i := 1; i <= 10; i++ {
+		lines = append(lines, strconv.Itoa(i))
+		expected = append(expected, "b"+strconv.Itoa(i))
+	}
+	for i := 1; i <= 10; i++ {
+		expected = append(expected, "c"+strconv.Itoa(i))
+	}
+	reader := processors.NewIoReader(strings.NewReader(strings.Join(lines, "\n")))
+	b, c := processors.NewPassthrough(), processors.NewPassthrough()
+	collector := &sourceCollector{sources: map[ratchet.DataProcessor]string{b: "b", c: "c"}}
+	d := ratchet.Wrap(collector)
+	layout, err := ratchet.NewPipelineLayout(
+		ratchet.NewPipelineStage(ratchet.Do(reader).Outputs(b, c)),
+		ratchet.NewPipelineStage(ratchet.Do(b).Outputs(d), ratchet.Do(c).Outputs(d)),
+		ratchet.NewPipelineStage(ratchet.Do(d).Merge(ratchet.MergeSequential)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline := ratchet.NewBranchingPipeline(layout)
+	pipeline.StallTimeout = time.Second
+	if err := <-pipeline.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(collector.data, expected) {
+		t.Errorf("Expected merged data %v, got %v", expected, collector.data)
+	}
+}
+
+// sourceWriter stores every value it receives, prefixed with its source,
+// as a SourceAwareDataProcessor.
+type sourceWriter struct {
+	sources map[ratchet.DataProcessor]string
+	data    []string
+}
+
+func (sw *sourceWriter) ProcessData(d data.JSON, outputChan chan data.JSON, killChan chan error) {
+	killChan <- errors.New("expected ProcessDataFrom to be called instead")
+}
+
+func (sw *sourceWriter) ProcessDataFrom(d data.JSON, from ratchet.DataProcessor, outputChan chan data.JSON, killChan chan error) {
+	sw.data = append(sw.data, sw.sources[from]+string(d))
+}
+
+func (sw *sourceWriter) Finish(outputChan chan data.JSON, killChan chan error) {
+}
+
+func TestSourceAwareDataProcessor(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	a := &dummyReader{data: [4]string{"1", "4", "5", "10"}}
+	b := &dummyReader{data: [4]string{"2", "3", "8", "9"}}
+	writer := &sourceWriter{sources: map[ratchet.DataProcessor]string{a: "a", b: "b"}}
+	layout, err := ratchet.NewPipelineLayout(
+		ratchet.NewPipelineStage(ratchet.Do(a).Outputs(writer), ratchet.Do(b).Outputs(writer)),
+		ratchet.NewPipelineStage(ratchet.Do(writer).Merge(ratchet.MergeSequential)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-ratchet.NewBranchingPipeline(layout).Run(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"a1", "a4", "a5", "a10", "b2", "b3", "b8", "b9"}; !reflect.DeepEqual(writer.data, expected) {
+		t.Errorf("Expected merged data %v, got %v", expected, writer.data)
+	}
+}
+
+type emitterFunc func(d data.JSON) error
+
+func (f emitterFunc) Emit(d data.JSON) error {
+	return f(d)
+}
+
 func ExampleNewPipeline() {
 	logger.LogLevel = logger.LevelSilent
 
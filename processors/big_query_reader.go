@@ -79,11 +79,14 @@ func (r *BigQueryReader) ForEachQueryData(d data.JSON, killChan chan error, forE
 	var err error
 	if r.query == "" && r.sqlGenerator != nil {
 		sql, err = r.sqlGenerator(d)
-		util.KillPipelineIfErr(err, killChan)
+		if util.KilledPipeline(err, killChan) {
+			return
+		}
 	} else if r.query != "" {
 		sql = r.query
 	} else {
 		killChan <- errors.New("BigQueryReader: must have either static query or sqlGenerator func")
+		return
 	}
 
 	logger.Debug("BigQueryReader: Running -", sql)
@@ -93,7 +96,14 @@ func (r *BigQueryReader) ForEachQueryData(d data.JSON, killChan chan error, forE
 	aggregatedData := bigquery.Data{}
 
 	for bqd := range bqDataChan {
-		util.KillPipelineIfErr(bqd.Err, killChan)
+		if util.KilledPipeline(bqd.Err, killChan) {
+			// Let the query finish in the background.
+			go func() {
+				for range bqDataChan {
+				}
+			}()
+			return
+		}
 		logger.Info("BigQueryReader: received bqData: len(rows) =", len(bqd.Rows))
 		// logger.Debug("   %+v", bqd)
 
@@ -106,7 +116,13 @@ func (r *BigQueryReader) ForEachQueryData(d data.JSON, killChan chan error, forE
 				// Send data as soon as we get it back
 				logger.Debug("BigQueryReader: sending data without aggregation")
 				d, err := data.JSONFromHeaderAndRows(bqd.Headers, bqd.Rows)
-				util.KillPipelineIfErr(err, killChan)
+				if util.KilledPipeline(err, killChan) {
+					go func() {
+						for range bqDataChan {
+						}
+					}()
+					return
+				}
 				forEach(d) // pass back out via the forEach func
 			}
 		}
@@ -114,7 +130,9 @@ func (r *BigQueryReader) ForEachQueryData(d data.JSON, killChan chan error, forE
 	if r.AggregateResults {
 		logger.Info("BigQueryReader: sending aggregated results: len(rows) =", len(aggregatedData.Rows))
 		d, err := data.JSONFromHeaderAndRows(aggregatedData.Headers, aggregatedData.Rows)
-		util.KillPipelineIfErr(err, killChan)
+		if util.KilledPipeline(err, killChan) {
+			return
+		}
 		forEach(d) // pass back out via the forEach func
 	}
 }
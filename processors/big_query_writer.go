@@ -35,12 +35,14 @@ func NewBigQueryWriterForNewTable(config *BigQueryConfig, tableName string, fiel
 // ProcessData defers to WriterBatch
 func (w *BigQueryWriter) ProcessData(d data.JSON, outputChan chan data.JSON, killChan chan error) {
 	queuedRows, err := data.ObjectsFromJSON(d)
-	util.KillPipelineIfErr(err, killChan)
+	if util.KilledPipeline(err, killChan) {
+		return
+	}
 
 	logger.Info("BigQueryWriter: Writing -", len(queuedRows))
 	err = w.WriteBatch(queuedRows)
-	if err != nil {
-		util.KillPipelineIfErr(err, killChan)
+	if util.KilledPipeline(err, killChan) {
+		return
 	}
 	logger.Info("BigQueryWriter: Write complete")
 }
@@ -0,0 +1,12 @@
+package processors
+
+import "context"
+
+// contextOrBackground returns ctx, or context.Background() if a processor
+// is used without ever having SetContext called (e.g. outside of a Pipeline).
+func contextOrBackground(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
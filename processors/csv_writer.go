@@ -1,7 +1,11 @@
 package processors
 
 import (
+	"context"
 	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 
 	"github.com/dailyburn/ratchet/data"
 	"github.com/dailyburn/ratchet/util"
@@ -14,6 +18,7 @@ import (
 // use an IoWriter instead.
 type CSVWriter struct {
 	Parameters util.CSVParameters
+	file       *stagedFile // set by NewCSVFileWriter
 }
 
 // NewCSVWriter returns a new CSVWriter wrapping the given io.Writer object
@@ -31,6 +36,17 @@ func NewCSVWriter(w io.Writer) *CSVWriter {
 	}
 }
 
+// NewCSVFileWriter returns a new CSVWriter writing to the file at path.
+// Within a Pipeline, the data is written to a temporary file next to it,
+// which only replaces the file once the Pipeline has succeeded (see
+// ratchet.Committer), so that a half-written file is never left behind.
+func NewCSVFileWriter(path string) *CSVWriter {
+	file := &stagedFile{path: path}
+	w := NewCSVWriter(file)
+	w.file = file
+	return w
+}
+
 // ProcessData defers to util.CSVProcess
 func (w *CSVWriter) ProcessData(d data.JSON, outputChan chan data.JSON, killChan chan error) {
 	util.CSVProcess(&w.Parameters, d, outputChan, killChan)
@@ -43,3 +59,94 @@ func (w *CSVWriter) Finish(outputChan chan data.JSON, killChan chan error) {
 func (w *CSVWriter) String() string {
 	return "CSVWriter"
 }
+
+// AckOnFinish defers to ratchet.FinishAcker, holding the acknowledgements
+// until the file is committed when writing to a file.
+func (w *CSVWriter) AckOnFinish() bool {
+	return w.file != nil
+}
+
+// Prepare defers to ratchet.Committer, flushing the temporary file.
+func (w *CSVWriter) Prepare(ctx context.Context) error {
+	if w.file == nil {
+		return nil
+	}
+	return w.file.prepare()
+}
+
+// Commit defers to ratchet.Committer, renaming the temporary file.
+func (w *CSVWriter) Commit(ctx context.Context) error {
+	if w.file == nil {
+		return nil
+	}
+	// The header is written again to the next file.
+	w.Parameters.HeaderWritten = false
+	return w.file.commit()
+}
+
+// Abort defers to ratchet.Committer, removing the temporary file.
+func (w *CSVWriter) Abort(ctx context.Context) error {
+	if w.file == nil {
+		return nil
+	}
+	w.Parameters.HeaderWritten = false
+	return w.file.abort()
+}
+
+// stagedFile writes to a temporary file next to path, created on the first
+// Write, which replaces the file at path once committed.
+type stagedFile struct {
+	path string
+	f    *os.File
+}
+
+func (s *stagedFile) Write(p []byte) (int, error) {
+	if err := s.create(); err != nil {
+		return 0, err
+	}
+	return s.f.Write(p)
+}
+
+func (s *stagedFile) create() error {
+	if s.f != nil {
+		return nil
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.path), "."+filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+	s.f = f
+	// as os.Create would, rather than TempFile's 0600
+	return f.Chmod(0644)
+}
+
+// prepare syncs the temporary file (creating it if nothing was written).
+func (s *stagedFile) prepare() error {
+	if err := s.create(); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+func (s *stagedFile) commit() error {
+	f := s.f
+	s.f = nil
+	if f == nil {
+		return nil
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
+
+func (s *stagedFile) abort() error {
+	f := s.f
+	s.f = nil
+	if f == nil {
+		return nil
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,86 @@
+package processors_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dailyburn/ratchet"
+	"github.com/dailyburn/ratchet/data"
+	"github.com/dailyburn/ratchet/logger"
+	"github.com/dailyburn/ratchet/processors"
+)
+
+// failingProcessor passes data through, failing once it receives fail.
+type failingProcessor struct {
+	fail string
+}
+
+func (p *failingProcessor) ProcessData(ctx context.Context, d data.JSON, out ratchet.Emitter) error {
+	if string(d) == p.fail {
+		return errors.New("received " + p.fail)
+	}
+	return out.Emit(d)
+}
+
+func (p *failingProcessor) Finish(ctx context.Context, out ratchet.Emitter) error {
+	return nil
+}
+
+func TestCSVFileWriter(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+	dir, err := ioutil.TempDir("", "csv_writer_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.csv")
+	written := "\"a\"\n\"1\"\n\"2\"\n"
+
+	// A successful run replaces the file.
+	if err := ioutil.WriteFile(path, []byte("old\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reader := processors.NewIoReader(strings.NewReader(`{"a":1}` + "\n" + `{"a":2}`))
+	pipeline := ratchet.NewPipeline(reader, processors.NewCSVFileWriter(path))
+	if err := <-pipeline.Run(); err != nil {
+		t.Fatal(err)
+	}
+	assertFiles(t, dir, path, written)
+
+	// A failed run leaves it as it is, once the temporary file is removed.
+	reader = processors.NewIoReader(strings.NewReader(`{"a":3}` + "\n" + `{"a":4}`))
+	pipeline = ratchet.NewPipeline(reader, ratchet.Wrap(&failingProcessor{fail: `{"a":4}`}), processors.NewCSVFileWriter(path))
+	if err := <-pipeline.Run(); err == nil || err.Error() != `received {"a":4}` {
+		t.Fatalf("Expected the run to fail, got %v", err)
+	}
+	for i := 0; i < 100 && countFiles(dir) > 1; i++ {
+		// A halted Pipeline aborts in the background.
+		time.Sleep(10 * time.Millisecond)
+	}
+	assertFiles(t, dir, path, written)
+}
+
+// assertFiles checks that path is the only file in dir, and its content.
+func assertFiles(t *testing.T, dir, path, expected string) {
+	if n := countFiles(dir); n != 1 {
+		t.Errorf("Expected only %s to be left, got %d files", path, n)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != expected {
+		t.Errorf("Expected %q to be written, got %q", expected, b)
+	}
+}
+
+func countFiles(dir string) int {
+	files, _ := ioutil.ReadDir(dir)
+	return len(files)
+}
@@ -22,7 +22,9 @@ func NewFileReader(filename string) *FileReader {
 // ProcessData reads a file and sends its contents to outputChan
 func (r *FileReader) ProcessData(d data.JSON, outputChan chan data.JSON, killChan chan error) {
 	d, err := ioutil.ReadFile(r.filename)
-	util.KillPipelineIfErr(err, killChan)
+	if util.KilledPipeline(err, killChan) {
+		return
+	}
 	outputChan <- d
 }
 
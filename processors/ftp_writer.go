@@ -1,7 +1,10 @@
 package processors
 
 import (
+	"context"
+	"errors"
 	"io"
+	"path"
 
 	"github.com/dailyburn/ratchet/data"
 	"github.com/dailyburn/ratchet/logger"
@@ -9,11 +12,16 @@ import (
 	"github.com/jlaffaye/ftp"
 )
 
-// FtpWriter type represents an ftp writter processor
+// FtpWriter type represents an ftp writter processor.
+//
+// Within a Pipeline, the data is uploaded to a temporary file next to the
+// path, which is only renamed to the path once the Pipeline has succeeded
+// (see ratchet.Committer).
 type FtpWriter struct {
 	ftpFilepath   string
 	conn          *ftp.ServerConn
 	fileWriter    *io.PipeWriter
+	stored        chan error // receives the result of the upload
 	authenticated bool
 	host          string
 	username      string
@@ -27,47 +35,107 @@ func NewFtpWriter(host, username, password, path string) *FtpWriter {
 }
 
 // connect - opens a connection to the provided ftp host and then authenticates with the host with the username, password attributes
-func (f *FtpWriter) connect(killChan chan error) {
+// connect returns false if the connection could not be established (after sending the error to killChan)
+func (f *FtpWriter) connect(killChan chan error) bool {
 	conn, err := ftp.Dial(f.host)
-	if err != nil {
-		util.KillPipelineIfErr(err, killChan)
+	if util.KilledPipeline(err, killChan) {
+		return false
 	}
 
 	lerr := conn.Login(f.username, f.password)
-	if lerr != nil {
-		util.KillPipelineIfErr(lerr, killChan)
+	if util.KilledPipeline(lerr, killChan) {
+		conn.Quit()
+		return false
 	}
 
 	r, w := io.Pipe()
 
 	f.conn = conn
-	go f.conn.Stor(f.path, r)
+	f.stored = make(chan error, 1)
+	go func() {
+		err := conn.Stor(f.tempPath(), r)
+		// stop any further writes if the upload failed
+		r.CloseWithError(err)
+		f.stored <- err
+	}()
 	f.fileWriter = w
 	f.authenticated = true
+	return true
 }
 
 // ProcessData writes data as is directly to the output file
 func (f *FtpWriter) ProcessData(d data.JSON, outputChan chan data.JSON, killChan chan error) {
 	logger.Debug("FTPWriter Process data:", string(d))
-	if !f.authenticated {
-		f.connect(killChan)
+	if !f.authenticated && !f.connect(killChan) {
+		return
 	}
 
 	_, e := f.fileWriter.Write([]byte(d))
-	if e != nil {
-		util.KillPipelineIfErr(e, killChan)
-	}
+	util.KillPipelineIfErr(e, killChan)
 }
 
-// Finish closes open references to the remote file and server
+// Finish completes the upload of the temporary file
 func (f *FtpWriter) Finish(outputChan chan data.JSON, killChan chan error) {
-	if f.fileWriter != nil {
-		f.fileWriter.Close()
+	util.KillPipelineIfErr(f.upload(nil), killChan)
+}
+
+// upload closes the file being uploaded (with the given error, to abort
+// the upload), and returns the result of the upload.
+func (f *FtpWriter) upload(err error) error {
+	if f.fileWriter == nil {
+		return nil
 	}
-	if f.conn != nil {
-		f.conn.Logout()
-		f.conn.Quit()
+	f.fileWriter.CloseWithError(err)
+	f.fileWriter = nil
+	return <-f.stored
+}
+
+// tempPath returns the temporary file path.
+func (f *FtpWriter) tempPath() string {
+	dir, file := path.Split(f.path)
+	return dir + "." + file + ".tmp"
+}
+
+// AckOnFinish defers to ratchet.FinishAcker, holding the acknowledgements
+// until the file is committed.
+func (f *FtpWriter) AckOnFinish() bool {
+	return true
+}
+
+// Prepare defers to ratchet.Committer.
+func (f *FtpWriter) Prepare(ctx context.Context) error {
+	return nil
+}
+
+// Commit defers to ratchet.Committer, renaming the uploaded file.
+func (f *FtpWriter) Commit(ctx context.Context) error {
+	if f.conn == nil {
+		return nil
+	}
+	defer f.close()
+	if err := f.upload(nil); err != nil {
+		return err
+	}
+	return f.conn.Rename(f.tempPath(), f.path)
+}
+
+// Abort defers to ratchet.Committer, deleting the temporary file.
+func (f *FtpWriter) Abort(ctx context.Context) error {
+	if f.conn == nil {
+		return nil
 	}
+	defer f.close()
+	f.upload(errors.New("aborted"))
+	return f.conn.Delete(f.tempPath())
+}
+
+// close closes open references to the remote server, so that the
+// next run connects again.
+func (f *FtpWriter) close() {
+	f.conn.Logout()
+	f.conn.Quit()
+	f.conn = nil
+	f.authenticated = false
 }
 
 func (f *FtpWriter) String() string {
@@ -1,10 +1,12 @@
 package processors
 
 import (
+	"context"
 	"io"
 	"io/ioutil"
 	"net/http"
 
+	"github.com/dailyburn/ratchet"
 	"github.com/dailyburn/ratchet/data"
 	"github.com/dailyburn/ratchet/util"
 )
@@ -15,6 +17,7 @@ import (
 type HTTPRequest struct {
 	Request *http.Request
 	Client  *http.Client
+	ctx     context.Context
 }
 
 // NewHTTPRequest creates a new HTTPRequest and is essentially wrapping net/http's NewRequest
@@ -26,20 +29,54 @@ func NewHTTPRequest(method, url string, body io.Reader) (*HTTPRequest, error) {
 
 // ProcessData sends data to outputChan if the response body is not null
 func (r *HTTPRequest) ProcessData(d data.JSON, outputChan chan data.JSON, killChan chan error) {
-	resp, err := r.Client.Do(r.Request)
-	util.KillPipelineIfErr(err, killChan)
-	if resp != nil && resp.Body != nil {
-		dd, err := ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
-		util.KillPipelineIfErr(err, killChan)
+	dd, err := r.do(contextOrBackground(r.ctx))
+	if util.KilledPipeline(err, killChan) {
+		return
+	}
+	if dd != nil {
 		outputChan <- dd
 	}
 }
 
+// ProcessDataContext defers to ratchet.ContextAwareDataProcessor. Within a
+// Pipeline, the request carries the trace context of the payload in a W3C
+// traceparent header (see ratchet.Tracing).
+func (r *HTTPRequest) ProcessDataContext(ctx context.Context, d data.JSON, out ratchet.Emitter) error {
+	dd, err := r.do(ctx)
+	if err != nil || dd == nil {
+		return err
+	}
+	return out.Emit(dd)
+}
+
+// do sends the request, returning the response body (if not null).
+func (r *HTTPRequest) do(ctx context.Context) (data.JSON, error) {
+	req := r.Request.WithContext(ctx)
+	if tp := ratchet.TraceParent(ctx); tp != "" {
+		req.Header = req.Header.Clone()
+		req.Header.Set("traceparent", tp)
+	}
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil || resp.Body == nil {
+		return nil, nil
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
 // Finish - see interface for documentation.
 func (r *HTTPRequest) Finish(outputChan chan data.JSON, killChan chan error) {
 }
 
+// SetContext defers to CancelableDataProcessor. In-flight requests are
+// canceled once the context is cancelled.
+func (r *HTTPRequest) SetContext(ctx context.Context) {
+	r.ctx = ctx
+}
+
 func (r *HTTPRequest) String() string {
 	return "HTTPRequest"
 }
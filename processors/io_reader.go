@@ -3,18 +3,29 @@ package processors
 import (
 	"bufio"
 	"compress/gzip"
+	"context"
 	"io"
+	"io/ioutil"
+	"strconv"
+	"time"
 
+	"github.com/dailyburn/ratchet"
 	"github.com/dailyburn/ratchet/data"
 	"github.com/dailyburn/ratchet/util"
 )
 
 // IoReader wraps an io.Reader and reads it.
+//
+// Set TrackData to read in ProcessFrom within a Pipeline even when it isn't
+// checkpointing (see ratchet.DataTracker), so that the data is emitted with
+// headers, and readers embedding IoReader clean up their inputs once the
+// data has been acknowledged.
 type IoReader struct {
 	Reader     io.Reader
 	LineByLine bool // defaults to true
 	BufferSize int
 	Gzipped    bool
+	TrackData  bool
 }
 
 // NewIoReader returns a new IoReader wrapping the given io.Reader object.
@@ -24,16 +35,103 @@ func NewIoReader(reader io.Reader) *IoReader {
 
 // ProcessData overwrites the reader if the content is Gzipped, then defers to ForEachData
 func (r *IoReader) ProcessData(d data.JSON, outputChan chan data.JSON, killChan chan error) {
-	if r.Gzipped {
-		gzReader, err := gzip.NewReader(r.Reader)
-		util.KillPipelineIfErr(err, killChan)
-		r.Reader = gzReader
+	if util.KilledPipeline(r.ungzip(), killChan) {
+		return
 	}
 	r.ForEachData(killChan, func(d data.JSON) {
 		outputChan <- d
 	})
 }
 
+// TracksData defers to ratchet.DataTracker.
+func (r *IoReader) TracksData() bool {
+	return r.TrackData
+}
+
+// ioReaderPosition is the position recorded by IoReader.ProcessFrom.
+type ioReaderPosition struct {
+	Offset int64 `json:"offset"`         // bytes read, after decompressing
+	Line   int64 `json:"line,omitempty"` // lines read, when LineByLine
+}
+
+// ProcessFrom defers to ratchet.Checkpointer. Reading resumes at the byte
+// offset reached by the last run, seeking to it if Reader is an io.Seeker
+// (and isn't Gzipped), and skipping the data before it otherwise. Each line
+// is emitted with its number (see ratchet.HeaderLine) when LineByLine.
+func (r *IoReader) ProcessFrom(ctx context.Context, d data.JSON, from data.JSON, out ratchet.CheckpointEmitter) error {
+	pos, err := parseIoReaderPosition(from)
+	if err != nil {
+		return err
+	}
+	if err := r.ungzip(); err != nil {
+		return err
+	}
+	return r.forEachFrom(pos.Offset, r.emitFrom(out, pos))
+}
+
+func parseIoReaderPosition(from data.JSON) (ioReaderPosition, error) {
+	var pos ioReaderPosition
+	if from == nil {
+		return pos, nil
+	}
+	err := data.ParseJSON(from, &pos)
+	return pos, err
+}
+
+// emitFrom returns a forEachFrom function emitting data at its offset,
+// counting lines from pos.
+func (r *IoReader) emitFrom(out ratchet.CheckpointEmitter, pos ioReaderPosition) func(d data.JSON, offset int64) error {
+	return func(d data.JSON, offset int64) error {
+		h := provenance(nil)
+		pos.Offset = offset
+		if r.LineByLine {
+			pos.Line++
+			h[ratchet.HeaderLine] = strconv.FormatInt(pos.Line, 10)
+		}
+		p, err := data.NewJSON(pos)
+		if err != nil {
+			return err
+		}
+		return withHeaders(out, h).EmitAt(d, p)
+	}
+}
+
+// track defers to ratchet.Track, for the CheckpointEmitter given to
+// ProcessFrom.
+func track(out ratchet.CheckpointEmitter, acked func()) (ratchet.CheckpointEmitter, func()) {
+	tracked, done := ratchet.Track(out, acked)
+	return tracked.(ratchet.CheckpointEmitter), done
+}
+
+// withHeaders defers to ratchet.WithHeaders, for the CheckpointEmitter given
+// to ProcessFrom.
+func withHeaders(out ratchet.CheckpointEmitter, h ratchet.Headers) ratchet.CheckpointEmitter {
+	return ratchet.WithHeaders(out, h).(ratchet.CheckpointEmitter)
+}
+
+// provenance returns the headers of the data read by a reader: h, along
+// with the time it was read at.
+func provenance(h ratchet.Headers) ratchet.Headers {
+	if h == nil {
+		h = ratchet.Headers{}
+	}
+	h[ratchet.HeaderReadAt] = time.Now().UTC().Format(time.RFC3339Nano)
+	return h
+}
+
+// ungzip overwrites the reader if the content is Gzipped.
+func (r *IoReader) ungzip() error {
+	if !r.Gzipped {
+		return nil
+	}
+	gzReader, err := gzip.NewReader(r.Reader)
+	if err != nil {
+		return err
+	}
+	r.Reader = gzReader
+	return nil
+}
+
 // Finish - see interface for documentation.
 func (r *IoReader) Finish(outputChan chan data.JSON, killChan chan error) {
 }
@@ -41,35 +139,65 @@ func (r *IoReader) Finish(outputChan chan data.JSON, killChan chan error) {
 // ForEachData either reads by line or by buffered stream, sending the data
 // back to the anonymous func that ultimately shoves it onto the outputChan
 func (r *IoReader) ForEachData(killChan chan error, foo func(d data.JSON)) {
+	err := r.forEachFrom(0, func(d data.JSON, offset int64) error {
+		foo(d)
+		return nil
+	})
+	util.KillPipelineIfErr(err, killChan)
+}
+
+// forEachFrom reads the data after offset (by line or by buffered stream),
+// calling forEach with each line or buffer and the offset after it.
+func (r *IoReader) forEachFrom(offset int64, forEach func(d data.JSON, offset int64) error) error {
+	if offset > 0 {
+		var err error
+		if s, ok := r.Reader.(io.Seeker); ok && !r.Gzipped {
+			_, err = s.Seek(offset, io.SeekStart)
+		} else {
+			_, err = io.CopyN(ioutil.Discard, r.Reader, offset)
+		}
+		if err != nil {
+			return err
+		}
+	}
 	if r.LineByLine {
-		r.scanLines(killChan, foo)
-	} else {
-		r.bufferedRead(killChan, foo)
+		return r.scanLines(offset, forEach)
 	}
+	return r.bufferedRead(offset, forEach)
 }
 
-func (r *IoReader) scanLines(killChan chan error, forEach func(d data.JSON)) {
+func (r *IoReader) scanLines(offset int64, forEach func(d data.JSON, offset int64) error) error {
 	scanner := bufio.NewScanner(r.Reader)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := bufio.ScanLines(data, atEOF)
+		offset += int64(advance)
+		return advance, token, err
+	})
 	for scanner.Scan() {
-		forEach(data.JSON(scanner.Text()))
+		if err := forEach(data.JSON(scanner.Text()), offset); err != nil {
+			return err
+		}
 	}
-	err := scanner.Err()
-	util.KillPipelineIfErr(err, killChan)
+	return scanner.Err()
 }
 
-func (r *IoReader) bufferedRead(killChan chan error, forEach func(d data.JSON)) {
+func (r *IoReader) bufferedRead(offset int64, forEach func(d data.JSON, offset int64) error) error {
 	reader := bufio.NewReader(r.Reader)
 	d := make([]byte, r.BufferSize)
 	for {
 		n, err := reader.Read(d)
 		if err != nil && err != io.EOF {
-			killChan <- err
+			return err
 		}
 		if n == 0 {
 			break
 		}
-		forEach(d)
+		offset += int64(n)
+		if err := forEach(d, offset); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 func (r *IoReader) String() string {
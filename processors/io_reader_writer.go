@@ -1,8 +1,10 @@
 package processors
 
 import (
+	"context"
 	"io"
 
+	"github.com/dailyburn/ratchet"
 	"github.com/dailyburn/ratchet/data"
 )
 
@@ -35,6 +37,28 @@ func (r *IoReaderWriter) ProcessData(d data.JSON, outputChan chan data.JSON, kil
 	})
 }
 
+// ProcessFrom defers to ratchet.Checkpointer, resuming like
+// IoReader.ProcessFrom.
+func (r *IoReaderWriter) ProcessFrom(ctx context.Context, d data.JSON, from data.JSON, out ratchet.CheckpointEmitter) error {
+	pos, err := parseIoReaderPosition(from)
+	if err != nil {
+		return err
+	}
+	emit := r.emitFrom(out, pos)
+	return r.forEachFrom(pos.Offset, func(d data.JSON, offset int64) error {
+		var err error
+		if r.AddNewline {
+			_, err = io.WriteString(r.Writer, string(d)+"\n")
+		} else {
+			_, err = r.Writer.Write(d)
+		}
+		if err != nil {
+			return err
+		}
+		return emit(d, offset)
+	})
+}
+
 // Finish - see interface for documentation.
 func (r *IoReaderWriter) Finish(outputChan chan data.JSON, killChan chan error) {
 }
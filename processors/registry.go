@@ -0,0 +1,262 @@
+package processors
+
+import (
+	"database/sql"
+	"io"
+	"unicode/utf8"
+
+	"github.com/dailyburn/ratchet"
+	"github.com/dailyburn/ratchet/config"
+	"github.com/dailyburn/ratchet/util"
+)
+
+// Registers the built-in DataProcessors for use in pipeline definitions,
+// under their type names. See the config package.
+func init() {
+	config.Register("CSVTransformer", config.Factory{
+		Params: csvParams,
+		New: func(args *config.Args) (ratchet.DataProcessor, error) {
+			t := NewCSVTransformer()
+			return t, setCSVParameters(&t.Parameters, args)
+		},
+	})
+	config.Register("CSVWriter", config.Factory{
+		Params: append([]config.Param{
+			{Name: "writer", Type: config.Resource, Required: true},
+		}, csvParams...),
+		New: func(args *config.Args) (ratchet.DataProcessor, error) {
+			var w io.Writer
+			if err := args.Resource("writer", &w); err != nil {
+				return nil, err
+			}
+			c := NewCSVWriter(w)
+			return c, setCSVParameters(&c.Parameters, args)
+		},
+	})
+	config.Register("FileReader", config.Factory{
+		Params: []config.Param{
+			{Name: "filename", Type: config.String, Required: true},
+		},
+		New: func(args *config.Args) (ratchet.DataProcessor, error) {
+			return NewFileReader(args.String("filename")), nil
+		},
+	})
+	config.Register("FtpWriter", config.Factory{
+		Params: []config.Param{
+			{Name: "host", Type: config.String, Required: true},
+			{Name: "username", Type: config.String, Required: true},
+			{Name: "password", Type: config.String, Required: true},
+			{Name: "path", Type: config.String, Required: true},
+		},
+		New: func(args *config.Args) (ratchet.DataProcessor, error) {
+			return NewFtpWriter(args.String("host"), args.String("username"), args.String("password"), args.String("path")), nil
+		},
+	})
+	config.Register("HTTPRequest", config.Factory{
+		Params: []config.Param{
+			{Name: "method", Type: config.String},
+			{Name: "url", Type: config.String, Required: true},
+		},
+		New: func(args *config.Args) (ratchet.DataProcessor, error) {
+			method := "GET"
+			if args.Has("method") {
+				method = args.String("method")
+			}
+			r, err := NewHTTPRequest(method, args.String("url"), nil)
+			if err != nil {
+				return nil, args.Errorf("url", "%v", err)
+			}
+			return r, nil
+		},
+	})
+	config.Register("IoReader", config.Factory{
+		Params: []config.Param{
+			{Name: "reader", Type: config.Resource, Required: true},
+			{Name: "line_by_line", Type: config.Bool},
+			{Name: "buffer_size", Type: config.Int},
+			{Name: "gzipped", Type: config.Bool},
+		},
+		New: func(args *config.Args) (ratchet.DataProcessor, error) {
+			var reader io.Reader
+			if err := args.Resource("reader", &reader); err != nil {
+				return nil, err
+			}
+			r := NewIoReader(reader)
+			if args.Has("line_by_line") {
+				r.LineByLine = args.Bool("line_by_line")
+			}
+			if args.Has("buffer_size") {
+				r.BufferSize = args.Int("buffer_size")
+			}
+			r.Gzipped = args.Bool("gzipped")
+			return r, nil
+		},
+	})
+	config.Register("IoWriter", config.Factory{
+		Params: []config.Param{
+			{Name: "writer", Type: config.Resource, Required: true},
+			{Name: "add_newline", Type: config.Bool},
+		},
+		New: func(args *config.Args) (ratchet.DataProcessor, error) {
+			var writer io.Writer
+			if err := args.Resource("writer", &writer); err != nil {
+				return nil, err
+			}
+			w := NewIoWriter(writer)
+			w.AddNewline = args.Bool("add_newline")
+			return w, nil
+		},
+	})
+	config.Register("Passthrough", config.Factory{
+		New: func(args *config.Args) (ratchet.DataProcessor, error) {
+			return NewPassthrough(), nil
+		},
+	})
+	config.Register("RegexpMatcher", config.Factory{
+		Params: []config.Param{
+			{Name: "pattern", Type: config.String, Required: true},
+			{Name: "debug_log", Type: config.Bool},
+		},
+		New: func(args *config.Args) (ratchet.DataProcessor, error) {
+			m := NewRegexpMatcher(args.String("pattern"))
+			m.DebugLog = args.Bool("debug_log")
+			return m, nil
+		},
+	})
+	config.Register("S3Reader", config.Factory{
+		Params: append(append([]config.Param{}, s3Params...),
+			config.Param{Name: "object", Type: config.String},
+			config.Param{Name: "prefix", Type: config.String},
+			config.Param{Name: "delete_objects", Type: config.Bool},
+		),
+		New: func(args *config.Args) (ratchet.DataProcessor, error) {
+			if args.Has("object") == args.Has("prefix") {
+				return nil, args.Errorf("object", "exactly one of object or prefix must be set")
+			}
+			var r *S3Reader
+			if args.Has("object") {
+				r = NewS3ObjectReader(args.String("aws_id"), args.String("aws_secret"), args.String("region"), args.String("bucket"), args.String("object"))
+			} else {
+				r = NewS3PrefixReader(args.String("aws_id"), args.String("aws_secret"), args.String("region"), args.String("bucket"), args.String("prefix"))
+			}
+			r.DeleteObjects = args.Bool("delete_objects")
+			return r, nil
+		},
+	})
+	config.Register("S3Writer", config.Factory{
+		Params: append(append([]config.Param{}, s3Params...),
+			config.Param{Name: "key", Type: config.String, Required: true},
+			config.Param{Name: "compress", Type: config.Bool},
+			config.Param{Name: "line_separator", Type: config.String},
+		),
+		New: func(args *config.Args) (ratchet.DataProcessor, error) {
+			w := NewS3Writer(args.String("aws_id"), args.String("aws_secret"), args.String("region"), args.String("bucket"), args.String("key"))
+			w.Compress = args.Bool("compress")
+			if args.Has("line_separator") {
+				w.LineSeparator = args.String("line_separator")
+			}
+			return w, nil
+		},
+	})
+	config.Register("SCP", config.Factory{
+		Params: []config.Param{
+			{Name: "object", Type: config.String, Required: true},
+			{Name: "destination", Type: config.String, Required: true},
+			{Name: "port", Type: config.String},
+		},
+		New: func(args *config.Args) (ratchet.DataProcessor, error) {
+			s := NewSCP(args.String("object"), args.String("destination"))
+			s.Port = args.String("port")
+			return s, nil
+		},
+	})
+	config.Register("SQLExecutor", config.Factory{
+		Params: []config.Param{
+			{Name: "db", Type: config.Resource, Required: true},
+			{Name: "sql", Type: config.String, Required: true},
+		},
+		New: func(args *config.Args) (ratchet.DataProcessor, error) {
+			var db *sql.DB
+			if err := args.Resource("db", &db); err != nil {
+				return nil, err
+			}
+			return NewSQLExecutor(db, args.String("sql")), nil
+		},
+	})
+	config.Register("SQLReader", config.Factory{
+		Params: []config.Param{
+			{Name: "db", Type: config.Resource, Required: true},
+			{Name: "query", Type: config.String, Required: true},
+			{Name: "batch_size", Type: config.Int},
+			{Name: "concurrency", Type: config.Int},
+		},
+		New: func(args *config.Args) (ratchet.DataProcessor, error) {
+			var db *sql.DB
+			if err := args.Resource("db", &db); err != nil {
+				return nil, err
+			}
+			r := NewSQLReader(db, args.String("query"))
+			if args.Has("batch_size") {
+				r.BatchSize = args.Int("batch_size")
+			}
+			r.ConcurrencyLevel = args.Int("concurrency")
+			return r, nil
+		},
+	})
+	config.Register("SQLWriter", config.Factory{
+		Params: []config.Param{
+			{Name: "db", Type: config.Resource, Required: true},
+			{Name: "table", Type: config.String, Required: true},
+			{Name: "on_dup_key_update", Type: config.Bool},
+			{Name: "on_dup_key_fields", Type: config.StringList},
+			{Name: "batch_size", Type: config.Int},
+			{Name: "concurrency", Type: config.Int},
+		},
+		New: func(args *config.Args) (ratchet.DataProcessor, error) {
+			var db *sql.DB
+			if err := args.Resource("db", &db); err != nil {
+				return nil, err
+			}
+			w := NewSQLWriter(db, args.String("table"))
+			if args.Has("on_dup_key_update") {
+				w.OnDupKeyUpdate = args.Bool("on_dup_key_update")
+			}
+			w.OnDupKeyFields = args.StringList("on_dup_key_fields")
+			w.BatchSize = args.Int("batch_size")
+			w.ConcurrencyLevel = args.Int("concurrency")
+			return w, nil
+		},
+	})
+}
+
+var s3Params = []config.Param{
+	{Name: "aws_id", Type: config.String, Required: true},
+	{Name: "aws_secret", Type: config.String, Required: true},
+	{Name: "region", Type: config.String, Required: true},
+	{Name: "bucket", Type: config.String, Required: true},
+}
+
+var csvParams = []config.Param{
+	{Name: "write_header", Type: config.Bool},
+	{Name: "header", Type: config.StringList},
+	{Name: "comma", Type: config.String},
+	{Name: "quote_escape", Type: config.String},
+}
+
+func setCSVParameters(params *util.CSVParameters, args *config.Args) error {
+	if args.Has("write_header") {
+		params.WriteHeader = args.Bool("write_header")
+	}
+	params.Header = args.StringList("header")
+	if args.Has("comma") {
+		comma := args.String("comma")
+		if utf8.RuneCountInString(comma) != 1 {
+			return args.Errorf("comma", "must be a single character, got %q", comma)
+		}
+		params.Comma, _ = utf8.DecodeRuneInString(comma)
+	}
+	if args.Has("quote_escape") {
+		params.Writer.QuoteEscape = args.String("quote_escape")
+	}
+	return nil
+}
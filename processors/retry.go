@@ -0,0 +1,259 @@
+package processors
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/dailyburn/ratchet"
+	"github.com/dailyburn/ratchet/data"
+	"github.com/dailyburn/ratchet/logger"
+)
+
+// RetryPolicy configures how Retry re-invokes a DataProcessor. The zero
+// value is usable, each field falling back to the default noted below.
+type RetryPolicy struct {
+	MaxAttempts  int           // total number of calls, including the first one. Defaults to 3.
+	InitialDelay time.Duration // delay before the first retry. Defaults to 100ms.
+	MaxDelay     time.Duration // upper bound for the delay between retries. Defaults to 30s.
+	Multiplier   float64       // factor the delay grows by after each retry. Defaults to 2.
+	Jitter       float64       // randomly shortens each delay by up to this fraction (0-1). Defaults to 0.
+	// Retryable decides which errors are worth retrying. By default every
+	// error is retried. See IsTemporary.
+	Retryable func(err error) bool
+}
+
+// IsTemporary can be used as RetryPolicy.Retryable to only retry errors
+// that report themselves as temporary, such as net.Error timeouts.
+func IsTemporary(err error) bool {
+	t, ok := err.(interface {
+		Temporary() bool
+	})
+	return ok && t.Temporary()
+}
+
+// Retrier re-invokes ProcessData (or Finish) on the DataProcessor it wraps
+// whenever it reports an error, backing off exponentially between attempts.
+// See Retry.
+type Retrier struct {
+	processor ratchet.ContextDataProcessor
+	wrapped   ratchet.DataProcessor
+	legacy    bool // wrapped isn't a ContextDataProcessor, see attempt
+	policy    RetryPolicy
+	retries   int64
+	failures  int64
+}
+
+// concurrentRetrier is a Retrier for a ConcurrentDataProcessor.
+type concurrentRetrier struct {
+	*Retrier
+}
+
+// Concurrency defers to the wrapped ConcurrentDataProcessor.
+func (r concurrentRetrier) Concurrency() int {
+	return r.optional().(concurrent).Concurrency()
+}
+
+type concurrent interface {
+	Concurrency() int
+}
+
+// Retry returns a DataProcessor that re-invokes the given DataProcessor
+// according to policy when it sends an error to its killChan. Transient
+// failures, such as a network timeout in a SQLWriter or HTTPRequest, then no
+// longer halt the Pipeline. Once the attempts are used up (or the error is
+// not retryable) the last error is reported as usual, so Retry can be
+// combined with a dead-letter ErrorPolicy.
+//
+// Data sent during a failed attempt is discarded (and never acknowledged, see
+// ratchet.Track), and data sent during the successful attempt is only passed
+// on, along with its headers, once that attempt has completed. This
+// keeps retries from producing duplicate output, but the whole output of an
+// attempt is held in memory until then. Retry is therefore meant for writers
+// and request/response style processors, whose output for each call is
+// bounded, and not for readers such as SQLReader or S3Reader.
+//
+// An attempt isn't retried until the previous one has returned, even for a
+// DataProcessor that keeps running after sending an error to its killChan.
+//
+// The number of retries, and of calls that still failed after retrying,
+// is reported in Pipeline.Stats.
+func Retry(p ratchet.DataProcessor, policy RetryPolicy) ratchet.DataProcessor {
+	if policy.MaxAttempts <= 0 {
+		policy.MaxAttempts = 3
+	}
+	if policy.InitialDelay <= 0 {
+		policy.InitialDelay = 100 * time.Millisecond
+	}
+	if policy.MaxDelay <= 0 {
+		policy.MaxDelay = 30 * time.Second
+	}
+	if policy.Multiplier < 1 {
+		policy.Multiplier = 2
+	}
+	r := &Retrier{processor: ratchet.Adapt(p), wrapped: p, policy: policy}
+	// Wrap only gives back p itself for a DataProcessor that Adapt had to
+	// adapt, as opposed to one wrapping a ContextDataProcessor.
+	r.legacy = ratchet.Wrap(r.processor) == p
+	if _, ok := r.optional().(concurrent); ok {
+		return ratchet.Wrap(concurrentRetrier{r})
+	}
+	return ratchet.Wrap(r)
+}
+
+// ProcessData calls ProcessData on the wrapped DataProcessor until it succeeds
+// or the RetryPolicy gives up.
+func (r *Retrier) ProcessData(ctx context.Context, d data.JSON, out ratchet.Emitter) error {
+	_, contextAware := r.wrapped.(ratchet.ContextAwareDataProcessor)
+	return r.retry(ctx, out, func(out ratchet.Emitter) error {
+		if r.legacy && !contextAware {
+			return attempt(ctx, out, func(outputChan chan data.JSON, killChan chan error) {
+				r.wrapped.ProcessData(d, outputChan, killChan)
+			})
+		}
+		return r.processor.ProcessData(ctx, d, out)
+	})
+}
+
+// Finish calls Finish on the wrapped DataProcessor until it succeeds
+// or the RetryPolicy gives up.
+func (r *Retrier) Finish(ctx context.Context, out ratchet.Emitter) error {
+	return r.retry(ctx, out, func(out ratchet.Emitter) error {
+		if r.legacy {
+			return attempt(ctx, out, r.wrapped.Finish)
+		}
+		return r.processor.Finish(ctx, out)
+	})
+}
+
+func (r *Retrier) retry(ctx context.Context, out ratchet.Emitter, call func(out ratchet.Emitter) error) error {
+	for attempt := 1; ; attempt++ {
+		// The data is passed on once the attempt has succeeded, along with
+		// its headers and acknowledgement tracking.
+		buffered, flush := ratchet.Buffer(out)
+		err := call(buffered)
+		if err == nil {
+			return flush()
+		}
+		if ctx.Err() != nil || attempt >= r.policy.MaxAttempts || (r.policy.Retryable != nil && !r.policy.Retryable(err)) {
+			atomic.AddInt64(&r.failures, 1)
+			return err
+		}
+
+		atomic.AddInt64(&r.retries, 1)
+		delay := r.delay(attempt)
+		logger.Info("Retry:", r, "attempt", attempt, "failed with", err.Error(), "- retrying in", delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			atomic.AddInt64(&r.failures, 1)
+			return err
+		}
+	}
+}
+
+// delay returns how long to wait after the given (failed) attempt.
+func (r *Retrier) delay(attempt int) time.Duration {
+	d := float64(r.policy.InitialDelay) * math.Pow(r.policy.Multiplier, float64(attempt-1))
+	if d > float64(r.policy.MaxDelay) {
+		d = float64(r.policy.MaxDelay)
+	}
+	if r.policy.Jitter > 0 {
+		d -= d * r.policy.Jitter * rand.Float64()
+	}
+	return time.Duration(d)
+}
+
+// attempt makes a ProcessData or Finish call to an old-style DataProcessor,
+// buffering the data it sends and returning the first error it sends to its
+// killChan. Unlike ratchet.Adapt, it waits for the call to return, so that
+// the next attempt doesn't overlap with it.
+func attempt(ctx context.Context, out ratchet.Emitter, call func(outputChan chan data.JSON, killChan chan error)) error {
+	outputChan := make(chan data.JSON)
+	killChan := make(chan error)
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		defer func() { done <- err }()
+		defer func() {
+			if v := recover(); v != nil {
+				err = &ratchet.PanicError{Value: v, Stack: debug.Stack()}
+			}
+		}()
+		call(outputChan, killChan)
+	}()
+
+	var err error
+	for {
+		select {
+		case d, open := <-outputChan:
+			if !open {
+				outputChan = nil
+			} else if err == nil {
+				out.Emit(d)
+			}
+		case e := <-killChan:
+			if err == nil {
+				err = e
+			}
+		case e := <-done:
+			if err == nil {
+				err = e
+			}
+			return err
+		case <-ctx.Done():
+			// The call can't be interrupted, but won't be retried either,
+			// so discard anything else it sends in the background.
+			go func() {
+				for {
+					select {
+					case _, open := <-outputChan:
+						if !open {
+							outputChan = nil
+						}
+					case <-killChan:
+					case <-done:
+						return
+					}
+				}
+			}()
+			return ctx.Err()
+		}
+	}
+}
+
+// optional returns what to check the optional interfaces of the wrapped
+// DataProcessor on: the ContextDataProcessor behind it if it was passed
+// through ratchet.Wrap, or the DataProcessor itself.
+func (r *Retrier) optional() interface{} {
+	if r.legacy {
+		return r.wrapped
+	}
+	return r.processor
+}
+
+// SetContext passes the context on to the wrapped DataProcessor,
+// if it implements ratchet.CancelableDataProcessor.
+func (r *Retrier) SetContext(ctx context.Context) {
+	if c, ok := r.optional().(interface {
+		SetContext(ctx context.Context)
+	}); ok {
+		c.SetContext(ctx)
+	}
+}
+
+// Counters defers to ratchet.CounterProvider
+func (r *Retrier) Counters() map[string]int64 {
+	return map[string]int64{
+		"Retries":        atomic.LoadInt64(&r.retries),
+		"Retry Failures": atomic.LoadInt64(&r.failures),
+	}
+}
+
+func (r *Retrier) String() string {
+	return fmt.Sprintf("Retry(%v)", r.wrapped)
+}
@@ -0,0 +1,198 @@
+package processors_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dailyburn/ratchet"
+	"github.com/dailyburn/ratchet/data"
+	"github.com/dailyburn/ratchet/logger"
+	"github.com/dailyburn/ratchet/processors"
+)
+
+// flakyProcessor fails the given number of times before passing data through.
+type flakyProcessor struct {
+	failures int
+}
+
+func (p *flakyProcessor) ProcessData(d data.JSON, outputChan chan data.JSON, killChan chan error) {
+	outputChan <- data.JSON("partial")
+	if p.failures > 0 {
+		p.failures--
+		killChan <- errors.New("flaky failure")
+		return
+	}
+	outputChan <- d
+}
+
+func (p *flakyProcessor) Finish(outputChan chan data.JSON, killChan chan error) {
+}
+
+func (p *flakyProcessor) String() string {
+	return "flakyProcessor"
+}
+
+func TestRetry(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	var b strings.Builder
+	retry := processors.Retry(&flakyProcessor{failures: 2}, processors.RetryPolicy{InitialDelay: time.Millisecond})
+	pipeline := ratchet.NewPipeline(processors.NewIoReader(strings.NewReader("hi")), retry, processors.NewIoWriter(&b))
+
+	if err := <-pipeline.Run(); err != nil {
+		t.Fatal("An error occurred in the ratchet pipeline:", err.Error())
+	}
+	if b.String() != "partialhi" {
+		t.Errorf("Expected only the successful attempt's data to be sent, got %q", b.String())
+	}
+	stats := pipeline.Stats()
+	for _, expected := range []string{"Retry(flakyProcessor)", "Retries = 2", "Retry Failures = 0"} {
+		if !strings.Contains(stats, expected) {
+			t.Errorf("Expected stats to contain %q, got %s", expected, stats)
+		}
+	}
+
+	retry = processors.Retry(&flakyProcessor{failures: 3}, processors.RetryPolicy{InitialDelay: time.Millisecond})
+	pipeline = ratchet.NewPipeline(processors.NewIoReader(strings.NewReader("hi")), retry, processors.NewIoWriter(&b))
+	if err := <-pipeline.Run(); err == nil || err.Error() != "flaky failure" {
+		t.Errorf("Expected the pipeline to fail once attempts are used up, got %v", err)
+	}
+}
+
+// lingeringProcessor fails twice, returning a while after sending each
+// error, and counts the calls made before the previous one returned.
+type lingeringProcessor struct {
+	calls, running, overlaps int32
+}
+
+func (p *lingeringProcessor) ProcessData(d data.JSON, outputChan chan data.JSON, killChan chan error) {
+	if atomic.AddInt32(&p.running, 1) > 1 {
+		atomic.AddInt32(&p.overlaps, 1)
+	}
+	defer atomic.AddInt32(&p.running, -1)
+	if atomic.AddInt32(&p.calls, 1) <= 2 {
+		killChan <- errors.New("lingering failure")
+		time.Sleep(20 * time.Millisecond)
+		return
+	}
+	outputChan <- d
+}
+
+func (p *lingeringProcessor) Finish(outputChan chan data.JSON, killChan chan error) {
+}
+
+func (p *lingeringProcessor) String() string {
+	return "lingeringProcessor"
+}
+
+func TestRetryWaitsForPreviousAttempt(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	var b strings.Builder
+	p := &lingeringProcessor{}
+	retry := processors.Retry(p, processors.RetryPolicy{InitialDelay: time.Millisecond})
+	pipeline := ratchet.NewPipeline(processors.NewIoReader(strings.NewReader("hi")), retry, processors.NewIoWriter(&b))
+	if err := <-pipeline.Run(); err != nil {
+		t.Fatal("An error occurred in the ratchet pipeline:", err.Error())
+	}
+	if b.String() != "hi" {
+		t.Errorf("Expected hi, got %q", b.String())
+	}
+	if p.overlaps != 0 {
+		t.Errorf("Expected each attempt to wait for the previous one, got %d overlapping calls", p.overlaps)
+	}
+}
+
+// concurrentContextProcessor is a ContextDataProcessor with a concurrency of 2.
+type concurrentContextProcessor struct{}
+
+func (p *concurrentContextProcessor) ProcessData(ctx context.Context, d data.JSON, out ratchet.Emitter) error {
+	return out.Emit(d)
+}
+
+func (p *concurrentContextProcessor) Finish(ctx context.Context, out ratchet.Emitter) error {
+	return nil
+}
+
+func (p *concurrentContextProcessor) Concurrency() int {
+	return 2
+}
+
+func (p *concurrentContextProcessor) String() string {
+	return "concurrentContextProcessor"
+}
+
+func TestRetryConcurrency(t *testing.T) {
+	retry := processors.Retry(ratchet.Wrap(&concurrentContextProcessor{}), processors.RetryPolicy{})
+	if dot := ratchet.NewPipeline(retry).DOT(); !strings.Contains(dot, "concurrency 2") {
+		t.Errorf("Expected the concurrency of a wrapped ContextDataProcessor to be kept, got %s", dot)
+	}
+	retry = processors.Retry(&flakyProcessor{}, processors.RetryPolicy{})
+	if _, ok := retry.(ratchet.ConcurrentDataProcessor); ok {
+		t.Error("Expected Retry of a DataProcessor without concurrency not to be a ConcurrentDataProcessor")
+	}
+	if dot := ratchet.NewPipeline(retry).DOT(); strings.Contains(dot, "concurrency") {
+		t.Errorf("Expected no concurrency, got %s", dot)
+	}
+}
+
+// trackingFlakyProcessor fails once, emitting its data with a header and
+// tracked with ratchet.Track on each attempt, and counts the acked calls.
+type trackingFlakyProcessor struct {
+	calls, acked int32
+}
+
+func (p *trackingFlakyProcessor) ProcessData(ctx context.Context, d data.JSON, out ratchet.Emitter) error {
+	call := atomic.AddInt32(&p.calls, 1)
+	tracked, done := ratchet.Track(out, func() { atomic.AddInt32(&p.acked, 1) })
+	out = ratchet.WithHeaders(tracked, ratchet.Headers{"attempt": strconv.Itoa(int(call))})
+	if err := out.Emit(d); err != nil {
+		return err
+	}
+	done()
+	if call == 1 {
+		return errors.New("flaky failure")
+	}
+	return nil
+}
+
+func (p *trackingFlakyProcessor) Finish(ctx context.Context, out ratchet.Emitter) error {
+	return nil
+}
+
+// headerRecorder records the attempt header of the data it receives.
+type headerRecorder struct {
+	attempts []string
+}
+
+func (p *headerRecorder) ProcessData(ctx context.Context, d data.JSON, out ratchet.Emitter) error {
+	p.attempts = append(p.attempts, ratchet.HeadersFrom(ctx)["attempt"])
+	return nil
+}
+
+func (p *headerRecorder) Finish(ctx context.Context, out ratchet.Emitter) error {
+	return nil
+}
+
+func TestRetryHeadersAndAcks(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	p := &trackingFlakyProcessor{}
+	recorder := &headerRecorder{}
+	retry := processors.Retry(ratchet.Wrap(p), processors.RetryPolicy{InitialDelay: time.Millisecond})
+	pipeline := ratchet.NewPipeline(processors.NewIoReader(strings.NewReader("hi")), retry, ratchet.Wrap(recorder))
+	if err := <-pipeline.Run(); err != nil {
+		t.Fatal("An error occurred in the ratchet pipeline:", err.Error())
+	}
+	if len(recorder.attempts) != 1 || recorder.attempts[0] != "2" {
+		t.Errorf("Expected the data of attempt 2 with its header, got %v", recorder.attempts)
+	}
+	if acked := atomic.LoadInt32(&p.acked); acked != 1 {
+		t.Errorf("Expected only the successful attempt to be acknowledged, got %d", acked)
+	}
+}
@@ -3,10 +3,13 @@ package processors
 // http://docs.aws.amazon.com/sdk-for-go/api/service/s3/S3.html
 
 import (
+	"context"
+
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/dailyburn/ratchet"
 	"github.com/dailyburn/ratchet/data"
 	"github.com/dailyburn/ratchet/logger"
 	"github.com/dailyburn/ratchet/util"
@@ -17,14 +20,24 @@ import (
 // prefix in your bucket.
 // S3Reader embeds an IoReeader, so it will support the same configuration
 // options as IoReader.
+//
+// Processed objects can be cleaned up by setting DeleteObjects, or by
+// setting ArchivePrefix to move them to ArchivePrefix + their key instead.
+// They are cleaned up once all of them have been read, unless TrackData is
+// set (or the Pipeline is checkpointing): then each object is cleaned up once
+// all the data read from it has been acknowledged (see ratchet.Track), so an
+// object is left as it is if writing its data fails, and cleanup errors are
+// logged.
 type S3Reader struct {
 	IoReader            // embeds IoReader
 	bucket              string
 	object              string
 	prefix              string
 	DeleteObjects       bool
+	ArchivePrefix       string
 	processedObjectKeys []string
 	client              *s3.S3
+	ctx                 context.Context
 }
 
 // NewS3ObjectReader reads a single object from the given S3 bucket
@@ -51,36 +64,138 @@ func NewS3PrefixReader(awsID, awsSecret, awsRegion, bucket, prefix string) *S3Re
 // directory to outputChan), or just sends the single file to outputChan if a complete
 // file path is provided (not a prefix/directory).
 //
-// It optionally deletes all processed objects once the contents have been sent to outputChan
+// It optionally deletes (or archives) all processed objects once the contents have been sent to outputChan
 func (r *S3Reader) ProcessData(d data.JSON, outputChan chan data.JSON, killChan chan error) {
+	ctx := contextOrBackground(r.ctx)
 	if r.prefix != "" {
 		logger.Debug("S3Reader: process data for prefix", r.prefix)
 		objects, err := util.ListS3Objects(r.client, r.bucket, r.prefix)
 		logger.Debug("S3Reader: list =", objects)
-		util.KillPipelineIfErr(err, killChan)
+		if util.KilledPipeline(err, killChan) {
+			return
+		}
 		for _, o := range objects {
-			obj, err := util.GetS3Object(r.client, r.bucket, o)
-			util.KillPipelineIfErr(err, killChan)
+			if ctx.Err() != nil {
+				logger.Debug("S3Reader: canceled, skipping remaining objects")
+				return
+			}
+			obj, err := util.GetS3ObjectContext(ctx, r.client, r.bucket, o)
+			if util.KilledPipeline(err, killChan) {
+				return
+			}
 			r.processObject(obj, outputChan, killChan)
 			r.processedObjectKeys = append(r.processedObjectKeys, o)
 		}
 	} else {
 		logger.Debug("S3Reader: process data for object", r.object)
-		obj, err := util.GetS3Object(r.client, r.bucket, r.object)
-		util.KillPipelineIfErr(err, killChan)
+		obj, err := util.GetS3ObjectContext(ctx, r.client, r.bucket, r.object)
+		if util.KilledPipeline(err, killChan) {
+			return
+		}
 		r.processObject(obj, outputChan, killChan)
 		r.processedObjectKeys = append(r.processedObjectKeys, r.object)
 	}
-	if r.DeleteObjects {
-		_, err := util.DeleteS3Objects(r.client, r.bucket, r.processedObjectKeys)
-		util.KillPipelineIfErr(err, killChan)
+	util.KillPipelineIfErr(r.cleanUp(r.processedObjectKeys...), killChan)
+}
+
+// cleanUp archives or deletes the given objects, if configured to.
+func (r *S3Reader) cleanUp(keys ...string) error {
+	if len(keys) == 0 || (r.ArchivePrefix == "" && !r.DeleteObjects) {
+		return nil
+	}
+	if r.ArchivePrefix != "" {
+		for _, key := range keys {
+			if _, err := util.CopyS3Object(r.client, r.bucket, key, r.ArchivePrefix+key); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := util.DeleteS3Objects(r.client, r.bucket, keys)
+	return err
+}
+
+// s3ReaderPosition is the position recorded by S3Reader.ProcessFrom.
+type s3ReaderPosition struct {
+	Object string `json:"object"`
+	Offset int64  `json:"offset"` // bytes read from Object, after decompressing
+}
+
+// ProcessFrom defers to ratchet.Checkpointer. Objects are read in the
+// (lexical) order S3 lists them, so reading resumes at the offset reached in
+// the object read by the last run, skipping the objects listed before it.
+// Each object is cleaned up once its data has been acknowledged. The data is
+// emitted with the object's key (see ratchet.HeaderFile).
+func (r *S3Reader) ProcessFrom(ctx context.Context, d data.JSON, from data.JSON, out ratchet.CheckpointEmitter) error {
+	var pos s3ReaderPosition
+	if from != nil {
+		if err := data.ParseJSON(from, &pos); err != nil {
+			return err
+		}
+	}
+	objects := []string{r.object}
+	if r.prefix != "" {
+		var err error
+		if objects, err = util.ListS3Objects(r.client, r.bucket, r.prefix); err != nil {
+			return err
+		}
+	}
+	for _, o := range objects {
+		if o < pos.Object {
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var offset int64
+		if o == pos.Object {
+			offset = pos.Offset
+		}
+		if err := r.readObjectFrom(ctx, o, offset, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *S3Reader) readObjectFrom(ctx context.Context, object string, offset int64, out ratchet.CheckpointEmitter) error {
+	obj, err := util.GetS3ObjectContext(ctx, r.client, r.bucket, object)
+	if err != nil {
+		return err
+	}
+	defer obj.Body.Close()
+	r.IoReader.Reader = obj.Body
+	if err := r.IoReader.ungzip(); err != nil {
+		return err
+	}
+	out = withHeaders(out, provenance(ratchet.Headers{ratchet.HeaderFile: object}))
+	tracked, done := track(out, func() {
+		if err := r.cleanUp(object); err != nil {
+			logger.Error("S3Reader: cleaning up", object, "-", err)
+		}
+	})
+	err = r.IoReader.forEachFrom(offset, func(d data.JSON, offset int64) error {
+		pos, err := data.NewJSON(s3ReaderPosition{object, offset})
+		if err != nil {
+			return err
+		}
+		return tracked.EmitAt(d, pos)
+	})
+	if err == nil {
+		done()
 	}
+	return err
 }
 
 // Finish - see interface for documentation.
 func (r *S3Reader) Finish(outputChan chan data.JSON, killChan chan error) {
 }
 
+// SetContext defers to CancelableDataProcessor. In-flight downloads are
+// canceled, and no further objects are read, once the context is cancelled.
+func (r *S3Reader) SetContext(ctx context.Context) {
+	r.ctx = ctx
+}
+
 func (r *S3Reader) processObject(obj *s3.GetObjectOutput, outputChan chan data.JSON, killChan chan error) {
 	// Use IoReader for actual data handling
 	r.IoReader.Reader = obj.Body
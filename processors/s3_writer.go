@@ -1,9 +1,14 @@
 package processors
 
 import (
+	"context"
+
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/dailyburn/ratchet/data"
+	"github.com/dailyburn/ratchet/logger"
 	"github.com/dailyburn/ratchet/util"
 )
 
@@ -14,13 +19,20 @@ import (
 // By default, we will separate each iteration of data sent to `ProcessData` with a new line
 // when we piece back together to send to S3. Change the `LineSeparator` attribute to change
 // this behavior.
+//
+// By default the object is written directly to its key. Set StagingPrefix
+// (e.g. to "_staging/") to first write it to StagingPrefix + key within a
+// Pipeline, and only copy it to its key once the Pipeline has succeeded (see
+// ratchet.Committer).
 type S3Writer struct {
 	data          []string
 	Compress      bool
 	LineSeparator string
+	StagingPrefix string
 	config        *aws.Config
 	bucket        string
 	key           string
+	staged        bool // whether the staging object has been written
 }
 
 // NewS3Writer instaniates a new S3Writer
@@ -39,9 +51,59 @@ func (w *S3Writer) ProcessData(d data.JSON, outputChan chan data.JSON, killChan
 	w.data = append(w.data, string(d))
 }
 
-// Finish writes all enqueued data to S3, defering to util.WriteS3Object
+// Finish writes all enqueued data to S3 (or its staging key), defering to util.WriteS3Object
 func (w *S3Writer) Finish(outputChan chan data.JSON, killChan chan error) {
-	util.WriteS3Object(w.data, w.config, w.bucket, w.key, w.LineSeparator, w.Compress)
+	_, err := util.WriteS3Object(w.data, w.config, w.bucket, w.StagingPrefix+w.key, w.LineSeparator, w.Compress)
+	w.staged = err == nil && w.StagingPrefix != ""
+	util.KillPipelineIfErr(err, killChan)
+}
+
+// objectKey returns the key the object is written to, after the
+// StagingPrefix if staging.
+func (w *S3Writer) objectKey() string {
+	if w.Compress {
+		return w.key + ".gz"
+	}
+	return w.key
+}
+
+// Prepare defers to ratchet.Committer.
+func (w *S3Writer) Prepare(ctx context.Context) error {
+	return nil
+}
+
+// Commit defers to ratchet.Committer, copying the staging object to its key.
+func (w *S3Writer) Commit(ctx context.Context) error {
+	if !w.staged {
+		return nil
+	}
+	client := s3.New(session.New(w.config))
+	staging := w.StagingPrefix + w.objectKey()
+	if _, err := util.CopyS3Object(client, w.bucket, staging, w.objectKey()); err != nil {
+		return err
+	}
+	w.staged = false
+	// The object is published, even if cleaning up fails.
+	if _, err := util.DeleteS3Objects(client, w.bucket, []string{staging}); err != nil {
+		logger.Error("S3Writer: deleting", staging, "-", err)
+	}
+	return nil
+}
+
+// Abort defers to ratchet.Committer, deleting the staging object.
+func (w *S3Writer) Abort(ctx context.Context) error {
+	if !w.staged {
+		return nil
+	}
+	w.staged = false
+	_, err := util.DeleteS3Objects(s3.New(session.New(w.config)), w.bucket, []string{w.StagingPrefix + w.objectKey()})
+	return err
+}
+
+// AckOnFinish defers to ratchet.FinishAcker, since the data is only
+// written in Finish (and published once committed).
+func (w *S3Writer) AckOnFinish() bool {
+	return true
 }
 
 func (w *S3Writer) String() string {
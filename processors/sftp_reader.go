@@ -1,7 +1,13 @@
 package processors
 
 import (
+	"context"
+	"path"
+	"sort"
+
+	"github.com/dailyburn/ratchet"
 	"github.com/dailyburn/ratchet/data"
+	"github.com/dailyburn/ratchet/logger"
 	"github.com/dailyburn/ratchet/util"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
@@ -11,12 +17,20 @@ import (
 // directory specified by the path (SftpReader.Walk must be set to true).
 //
 // To only send full paths (and not file contents), set FileNamesOnly to true.
-// If FileNamesOnly is set to true, DeleteObjects will be ignored.
+// If FileNamesOnly is set to true, DeleteObjects and ArchiveDir will be ignored.
+//
+// Processed files can be cleaned up by setting DeleteObjects, or by setting
+// ArchiveDir to move them into that (existing) directory instead. Each file
+// is cleaned up once it has been read, unless TrackData is set (or the
+// Pipeline is checkpointing): then it is cleaned up once all the data read
+// from it has been acknowledged (see ratchet.Track), so a file is left as it
+// is if writing its data fails, and cleanup errors are logged.
 type SftpReader struct {
 	IoReader      // embeds IoReader
 	parameters    *util.SftpParameters
 	client        *sftp.Client
 	DeleteObjects bool
+	ArchiveDir    string
 	Walk          bool
 	FileNamesOnly bool
 	initialized   bool
@@ -62,7 +76,9 @@ func NewSftpReaderByClient(client *sftp.Client, path string) *SftpReader {
 // ProcessData optionally walks through the tree to send each object separately, or sends the single
 // object upstream
 func (r *SftpReader) ProcessData(d data.JSON, outputChan chan data.JSON, killChan chan error) {
-	r.ensureInitialized(killChan)
+	if !r.ensureInitialized(killChan) {
+		return
+	}
 	if r.Walk {
 		r.walk(outputChan, killChan)
 	} else {
@@ -70,6 +86,111 @@ func (r *SftpReader) ProcessData(d data.JSON, outputChan chan data.JSON, killCha
 	}
 }
 
+// sftpReaderPosition is the position recorded by SftpReader.ProcessFrom.
+type sftpReaderPosition struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"` // bytes read from Path, after decompressing
+}
+
+// ProcessFrom defers to ratchet.Checkpointer. When walking, files are read in
+// lexical order of their paths, so reading resumes at the offset reached in
+// the file read by the last run, skipping the files before it. FileNamesOnly
+// paths are emitted at the path's position. Each file is cleaned up once its
+// data has been acknowledged. The data is emitted with the file's path (see
+// ratchet.HeaderFile).
+func (r *SftpReader) ProcessFrom(ctx context.Context, d data.JSON, from data.JSON, out ratchet.CheckpointEmitter) error {
+	var pos sftpReaderPosition
+	if from != nil {
+		if err := data.ParseJSON(from, &pos); err != nil {
+			return err
+		}
+	}
+	if err := r.initialize(); err != nil {
+		return err
+	}
+	paths := []string{r.parameters.Path}
+	if r.Walk {
+		paths = nil
+		walker := r.client.Walk(r.parameters.Path)
+		for walker.Step() {
+			if err := walker.Err(); err != nil {
+				return err
+			}
+			if !walker.Stat().IsDir() {
+				paths = append(paths, walker.Path())
+			}
+		}
+		sort.Strings(paths)
+	}
+	for _, path := range paths {
+		if path < pos.Path || (r.FileNamesOnly && path == pos.Path) {
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var offset int64
+		if path == pos.Path {
+			offset = pos.Offset
+		}
+		if err := r.readFileFrom(path, offset, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *SftpReader) readFileFrom(path string, offset int64, out ratchet.CheckpointEmitter) error {
+	out = withHeaders(out, provenance(ratchet.Headers{ratchet.HeaderFile: path}))
+	emitTo := func(out ratchet.CheckpointEmitter) func(d data.JSON, offset int64) error {
+		return func(d data.JSON, offset int64) error {
+			pos, err := data.NewJSON(sftpReaderPosition{path, offset})
+			if err != nil {
+				return err
+			}
+			return out.EmitAt(d, pos)
+		}
+	}
+	if r.FileNamesOnly {
+		d, err := data.NewJSON(util.SftpPath{Path: path})
+		if err != nil {
+			return err
+		}
+		return emitTo(out)(d, 0)
+	}
+
+	file, err := r.client.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r.IoReader.Reader = file
+	if err := r.IoReader.ungzip(); err != nil {
+		return err
+	}
+	tracked, done := track(out, func() {
+		if err := r.cleanUp(path); err != nil {
+			logger.Error("SftpReader: cleaning up", path, "-", err)
+		}
+	})
+	if err := r.IoReader.forEachFrom(offset, emitTo(tracked)); err != nil {
+		return err
+	}
+	done()
+	return nil
+}
+
+// cleanUp archives or deletes the given file, if configured to.
+func (r *SftpReader) cleanUp(p string) error {
+	if r.ArchiveDir != "" {
+		return r.client.Rename(p, path.Join(r.ArchiveDir, path.Base(p)))
+	}
+	if r.DeleteObjects {
+		return r.client.Remove(p)
+	}
+	return nil
+}
+
 // Finish optionally closes open references to the remote server
 func (r *SftpReader) Finish(outputChan chan data.JSON, killChan chan error) {
 	if r.CloseOnFinish {
@@ -87,54 +208,66 @@ func (r *SftpReader) String() string {
 	return "SftpReader"
 }
 
-func (r *SftpReader) ensureInitialized(killChan chan error) {
+// ensureInitialized returns false if the client could not be set up (after sending the error to killChan)
+func (r *SftpReader) ensureInitialized(killChan chan error) bool {
+	return !util.KilledPipeline(r.initialize(), killChan)
+}
+
+func (r *SftpReader) initialize() error {
 	if r.initialized {
-		return
+		return nil
 	}
 
 	client, err := util.SftpClient(r.parameters.Server, r.parameters.Username, r.parameters.AuthMethods)
-	util.KillPipelineIfErr(err, killChan)
+	if err != nil {
+		return err
+	}
 
 	r.client = client
 	r.initialized = true
+	return nil
 }
 
 func (r *SftpReader) walk(outputChan chan data.JSON, killChan chan error) {
 	walker := r.client.Walk(r.parameters.Path)
 	for walker.Step() {
-		util.KillPipelineIfErr(walker.Err(), killChan)
-		if !walker.Stat().IsDir() {
-			r.sendObject(walker.Path(), outputChan, killChan)
+		if util.KilledPipeline(walker.Err(), killChan) {
+			return
+		}
+		if !walker.Stat().IsDir() && !r.sendObject(walker.Path(), outputChan, killChan) {
+			return
 		}
 	}
 }
 
-func (r *SftpReader) sendObject(path string, outputChan chan data.JSON, killChan chan error) {
+// sendObject returns false if sending failed (after sending the error to killChan)
+func (r *SftpReader) sendObject(path string, outputChan chan data.JSON, killChan chan error) bool {
 	if r.FileNamesOnly {
-		r.sendFilePath(path, outputChan, killChan)
-	} else {
-		r.sendFile(path, outputChan, killChan)
+		return r.sendFilePath(path, outputChan, killChan)
 	}
+	return r.sendFile(path, outputChan, killChan)
 }
 
-func (r *SftpReader) sendFilePath(path string, outputChan chan data.JSON, killChan chan error) {
+func (r *SftpReader) sendFilePath(path string, outputChan chan data.JSON, killChan chan error) bool {
 	sftpPath := util.SftpPath{Path: path}
 	d, err := data.NewJSON(sftpPath)
-	util.KillPipelineIfErr(err, killChan)
+	if util.KilledPipeline(err, killChan) {
+		return false
+	}
 	outputChan <- d
+	return true
 }
 
-func (r *SftpReader) sendFile(path string, outputChan chan data.JSON, killChan chan error) {
+func (r *SftpReader) sendFile(path string, outputChan chan data.JSON, killChan chan error) bool {
 	file, err := r.client.Open(path)
-
-	util.KillPipelineIfErr(err, killChan)
+	if util.KilledPipeline(err, killChan) {
+		return false
+	}
 	defer file.Close()
 
 	r.IoReader.Reader = file
 	r.IoReader.ProcessData(nil, outputChan, killChan)
 
-	if r.DeleteObjects {
-		err = r.client.Remove(path)
-		util.KillPipelineIfErr(err, killChan)
-	}
+	err = r.cleanUp(path)
+	return !util.KilledPipeline(err, killChan)
 }
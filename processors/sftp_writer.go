@@ -1,6 +1,9 @@
 package processors
 
 import (
+	"context"
+	"path"
+
 	"golang.org/x/crypto/ssh"
 
 	"github.com/dailyburn/ratchet/data"
@@ -9,12 +12,22 @@ import (
 	"github.com/pkg/sftp"
 )
 
-// SftpWriter is an inline writer to remote sftp server
+// SftpWriter is an inline writer to remote sftp server.
+//
+// Within a Pipeline, a writer created with NewSftpWriter writes to a hidden
+// temporary file next to its path (".<name>.tmp"), which is only renamed to
+// the path once the Pipeline has succeeded (see ratchet.Committer),
+// replacing any file there. Note that this means the path is only written
+// once the whole Pipeline is done, rather than while it runs, and not at all
+// if it fails. The connection is then closed if CloseOnFinish is set.
+// Outside of a Pipeline (where SetContext is never called), it writes to the
+// path directly, and Finish closes the connection.
 type SftpWriter struct {
 	client        *sftp.Client
 	file          *sftp.File
 	parameters    *util.SftpParameters
 	initialized   bool
+	ctx           context.Context // set within a Pipeline, see SetContext
 	CloseOnFinish bool
 }
 
@@ -45,38 +58,152 @@ func NewSftpWriterByFile(file *sftp.File) *SftpWriter {
 // ProcessData writes data as is directly to the output file
 func (w *SftpWriter) ProcessData(d data.JSON, outputChan chan data.JSON, killChan chan error) {
 	logger.Debug("SftpWriter Process data:", string(d))
-	w.ensureInitialized(killChan)
+	if !w.ensureInitialized(killChan) {
+		return
+	}
 	_, e := w.file.Write([]byte(d))
 	util.KillPipelineIfErr(e, killChan)
 }
 
 // Finish optionally closes open references to the remote file and server
+// (once committed, if writing to a temporary file)
 func (w *SftpWriter) Finish(outputChan chan data.JSON, killChan chan error) {
-	if w.CloseOnFinish {
+	if w.CloseOnFinish && w.initialized && !w.staging() {
 		w.file.Close()
 		w.client.Close()
 	}
 }
 
+// SetContext defers to ratchet.CancelableDataProcessor. It is only called
+// within a Pipeline, so the writer then writes to a temporary file.
+func (w *SftpWriter) SetContext(ctx context.Context) {
+	w.ctx = ctx
+}
+
+// staging returns true if writing to a temporary file.
+func (w *SftpWriter) staging() bool {
+	return w.parameters != nil && w.ctx != nil
+}
+
+// tempPath returns the temporary file path.
+func (w *SftpWriter) tempPath() string {
+	return w.hiddenPath(".tmp")
+}
+
+// hiddenPath returns a hidden file path next to the path, with the given suffix.
+func (w *SftpWriter) hiddenPath(suffix string) string {
+	dir, file := path.Split(w.parameters.Path)
+	return dir + "." + file + suffix
+}
+
+// AckOnFinish defers to ratchet.FinishAcker, holding the acknowledgements
+// until the file is committed when writing to a temporary file.
+func (w *SftpWriter) AckOnFinish() bool {
+	return w.staging()
+}
+
+// Prepare defers to ratchet.Committer.
+func (w *SftpWriter) Prepare(ctx context.Context) error {
+	return nil
+}
+
+// Commit defers to ratchet.Committer, renaming the temporary file.
+func (w *SftpWriter) Commit(ctx context.Context) error {
+	if !w.staging() || !w.initialized {
+		return nil
+	}
+	defer w.close()
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	return w.replace(w.tempPath(), w.parameters.Path)
+}
+
+// replace renames oldpath to newpath, replacing any file there. Rename fails
+// if newpath exists (and the vendored client has no PosixRename), so that
+// file is moved aside first, and moved back if oldpath can't be renamed:
+// newpath is briefly missing, but never lost.
+func (w *SftpWriter) replace(oldpath, newpath string) error {
+	err := w.client.Rename(oldpath, newpath)
+	if err == nil {
+		return nil
+	}
+	if _, serr := w.client.Stat(newpath); serr != nil {
+		return err // there is nothing to move aside
+	}
+	previous := w.hiddenPath(".old")
+	if err := w.client.Rename(newpath, previous); err != nil {
+		return err
+	}
+	if err := w.client.Rename(oldpath, newpath); err != nil {
+		if rerr := w.client.Rename(previous, newpath); rerr != nil {
+			logger.Error("SftpWriter: restoring", newpath, "from", previous, "-", rerr)
+		}
+		return err
+	}
+	// The file is replaced, even if cleaning up fails.
+	if err := w.client.Remove(previous); err != nil {
+		logger.Error("SftpWriter: removing", previous, "-", err)
+	}
+	return nil
+}
+
+// Abort defers to ratchet.Committer, removing the temporary file.
+func (w *SftpWriter) Abort(ctx context.Context) error {
+	if !w.staging() || !w.initialized {
+		return nil
+	}
+	defer w.close()
+	w.file.Close()
+	return w.client.Remove(w.tempPath())
+}
+
+// close optionally closes the connection, after committing or aborting.
+// Either way, the next run writes to a new temporary file.
+func (w *SftpWriter) close() {
+	w.initialized = false
+	if w.CloseOnFinish {
+		w.client.Close()
+		w.client = nil
+	}
+}
+
 func (w *SftpWriter) String() string {
 	return "SftpWriter"
 }
 
-// ensureInitialized calls connect and then creates the output file on the sftp server at the specified path
-func (w *SftpWriter) ensureInitialized(killChan chan error) {
+// ensureInitialized calls connect (unless still connected after the last run) and then creates the
+// output file on the sftp server (or when staging, the temporary file next to it).
+// It returns false if either step failed (after sending the error to killChan).
+func (w *SftpWriter) ensureInitialized(killChan chan error) bool {
 	if w.initialized {
-		return
+		return true
 	}
 
-	client, err := util.SftpClient(w.parameters.Server, w.parameters.Username, w.parameters.AuthMethods)
-	util.KillPipelineIfErr(err, killChan)
+	client := w.client
+	if client == nil {
+		var err error
+		client, err = util.SftpClient(w.parameters.Server, w.parameters.Username, w.parameters.AuthMethods)
+		if util.KilledPipeline(err, killChan) {
+			return false
+		}
+	}
 
 	logger.Info("Path", w.parameters.Path)
 
-	file, err := client.Create(w.parameters.Path)
-	util.KillPipelineIfErr(err, killChan)
+	target := w.parameters.Path
+	if w.staging() {
+		target = w.tempPath()
+	}
+	file, err := client.Create(target)
+	if util.KilledPipeline(err, killChan) {
+		client.Close()
+		w.client = nil
+		return false
+	}
 
 	w.client = client
 	w.file = file
 	w.initialized = true
+	return true
 }
@@ -36,28 +36,26 @@ func NewDynamicSQLExecutor(dbConn *sql.DB, sqlGenerator func(data.JSON) (string,
 
 // ProcessData runs the SQL statements, deferring to util.ExecuteSQLQuery
 func (s *SQLExecutor) ProcessData(d data.JSON, outputChan chan data.JSON, killChan chan error) {
-	// handle panics a bit more gracefully
-	defer func() {
-		if err := recover(); err != nil {
-			util.KillPipelineIfErr(err.(error), killChan)
-		}
-	}()
-
 	sql := ""
 	var err error
 	if s.query == "" && s.sqlGenerator != nil {
 		sql, err = s.sqlGenerator(d)
-		util.KillPipelineIfErr(err, killChan)
+		if util.KilledPipeline(err, killChan) {
+			return
+		}
 	} else if s.query != "" {
 		sql = s.query
 	} else {
 		killChan <- errors.New("SQLExecutor: must have either static query or sqlGenerator func")
+		return
 	}
 
 	logger.Debug("SQLExecutor: Running - ", sql)
 	// See sql.go
 	err = util.ExecuteSQLQuery(s.readDB, sql)
-	util.KillPipelineIfErr(err, killChan)
+	if util.KilledPipeline(err, killChan) {
+		return
+	}
 	logger.Info("SQLExecutor: Query complete")
 }
 
@@ -1,9 +1,12 @@
 package processors
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 
+	"github.com/dailyburn/ratchet"
 	"github.com/dailyburn/ratchet/data"
 	"github.com/dailyburn/ratchet/logger"
 	"github.com/dailyburn/ratchet/util"
@@ -19,6 +22,10 @@ import (
 // The dynamic SQL generation is implemented by passing in a "sqlGenerator"
 // function to NewDynamicSQLReader. This allows you to write whatever code is
 // needed to generate SQL based upon data flowing through the pipeline.
+//
+// Set TrackData to read in ProcessFrom within a Pipeline even when it isn't
+// checkpointing (see ratchet.DataTracker), so that the data is emitted with
+// headers.
 type SQLReader struct {
 	readDB            *sql.DB
 	query             string
@@ -26,6 +33,8 @@ type SQLReader struct {
 	BatchSize         int
 	StructDestination interface{}
 	ConcurrencyLevel  int // See ConcurrentDataProcessor
+	TrackData         bool
+	ctx               context.Context
 }
 
 type dataErr struct {
@@ -53,38 +62,119 @@ func (s *SQLReader) ProcessData(d data.JSON, outputChan chan data.JSON, killChan
 // running the query and retrieving the data in data.JSON format, and then
 // passing the results back witih the function call to forEach.
 func (s *SQLReader) ForEachQueryData(d data.JSON, killChan chan error, forEach func(d data.JSON)) {
-	sql := ""
-	var err error
+	sql, err := s.queryFor(d)
+	if util.KilledPipeline(err, killChan) {
+		return
+	}
+	err = s.forEachBatch(sql, func(d data.JSON) error {
+		forEach(d)
+		return nil
+	})
+	util.KillPipelineIfErr(err, killChan)
+}
+
+// queryFor returns the query to run for d, generating it in dynamic mode.
+func (s *SQLReader) queryFor(d data.JSON) (string, error) {
 	if s.query == "" && s.sqlGenerator != nil {
-		sql, err = s.sqlGenerator(d)
-		util.KillPipelineIfErr(err, killChan)
+		return s.sqlGenerator(d)
 	} else if s.query != "" {
-		sql = s.query
-	} else {
-		killChan <- errors.New("SQLReader: must have either static query or sqlGenerator func")
+		return s.query, nil
 	}
+	return "", errors.New("SQLReader: must have either static query or sqlGenerator func")
+}
 
+func (s *SQLReader) forEachBatch(sql string, forEach func(d data.JSON) error) error {
 	logger.Debug("SQLReader: Running - ", sql)
 	// See sql.go
-	dataChan, err := util.GetDataFromSQLQuery(s.readDB, sql, s.BatchSize, s.StructDestination)
-	util.KillPipelineIfErr(err, killChan)
+	dataChan, err := util.GetDataFromSQLQueryContext(contextOrBackground(s.ctx), s.readDB, sql, s.BatchSize, s.StructDestination)
+	if err != nil {
+		return err
+	}
+	// Let the query helper finish in the background if we return early.
+	defer func() {
+		go func() {
+			for range dataChan {
+			}
+		}()
+	}()
 
 	for d := range dataChan {
 		// First check if an error was returned back from the SQL processing
 		// helper, then if not call forEach with the received data.
 		var derr dataErr
 		if err := data.ParseJSONSilent(d, &derr); err == nil {
-			util.KillPipelineIfErr(errors.New(derr.Error), killChan)
-		} else {
-			forEach(d)
+			return errors.New(derr.Error)
+		}
+		if err := forEach(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TracksData defers to ratchet.DataTracker.
+func (s *SQLReader) TracksData() bool {
+	return s.TrackData
+}
+
+// sqlReaderPosition is the position recorded by SQLReader.ProcessFrom.
+type sqlReaderPosition struct {
+	Rows int `json:"rows"` // rows read so far
+}
+
+// ProcessFrom defers to ratchet.Checkpointer. The query is run again, and
+// the rows read by the last run are skipped, so it must return its rows in
+// a stable order (i.e. use ORDER BY). The data is emitted with the query
+// (see ratchet.HeaderQuery).
+func (s *SQLReader) ProcessFrom(ctx context.Context, d data.JSON, from data.JSON, out ratchet.CheckpointEmitter) error {
+	var pos sqlReaderPosition
+	if from != nil {
+		if err := data.ParseJSON(from, &pos); err != nil {
+			return err
 		}
 	}
+	sql, err := s.queryFor(d)
+	if err != nil {
+		return err
+	}
+	out = withHeaders(out, provenance(ratchet.Headers{ratchet.HeaderQuery: sql}))
+	skip := pos.Rows
+	return s.forEachBatch(sql, func(d data.JSON) error {
+		var rows []json.RawMessage
+		if err := data.ParseJSON(d, &rows); err != nil {
+			return err
+		}
+		if skip >= len(rows) {
+			skip -= len(rows)
+			return nil
+		}
+		if skip > 0 {
+			var err error
+			if d, err = data.NewJSON(rows[skip:]); err != nil {
+				return err
+			}
+			rows = rows[skip:]
+			skip = 0
+		}
+		pos.Rows += len(rows)
+		p, err := data.NewJSON(pos)
+		if err != nil {
+			return err
+		}
+		return out.EmitAt(d, p)
+	})
 }
 
 // Finish - see interface for documentation.
 func (s *SQLReader) Finish(outputChan chan data.JSON, killChan chan error) {
 }
 
+// SetContext defers to CancelableDataProcessor. Running queries are
+// aborted once the context is cancelled.
+func (s *SQLReader) SetContext(ctx context.Context) {
+	s.ctx = ctx
+}
+
 func (s *SQLReader) String() string {
 	return "SQLReader"
 }
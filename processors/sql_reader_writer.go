@@ -1,8 +1,10 @@
 package processors
 
 import (
+	"context"
 	"database/sql"
 
+	"github.com/dailyburn/ratchet"
 	"github.com/dailyburn/ratchet/data"
 )
 
@@ -24,7 +26,8 @@ type SQLReaderWriter struct {
 func NewSQLReaderWriter(readConn *sql.DB, writeConn *sql.DB, readQuery, writeTable string) *SQLReaderWriter {
 	s := SQLReaderWriter{}
 	s.SQLReader = *NewSQLReader(readConn, readQuery)
-	s.SQLWriter = *NewSQLWriter(writeConn, writeTable)
+	// as NewSQLWriter, without copying its lock
+	s.SQLWriter = SQLWriter{writeDB: writeConn, TableName: writeTable, OnDupKeyUpdate: true}
 	return &s
 }
 
@@ -43,6 +46,26 @@ func (s *SQLReaderWriter) ProcessData(d data.JSON, outputChan chan data.JSON, ki
 	})
 }
 
+// ProcessFrom defers to ratchet.Checkpointer, resuming like
+// SQLReader.ProcessFrom and writing the data before sending it.
+func (s *SQLReaderWriter) ProcessFrom(ctx context.Context, d data.JSON, from data.JSON, out ratchet.CheckpointEmitter) error {
+	return s.SQLReader.ProcessFrom(ctx, d, from, sqlWritingEmitter{out, &s.SQLWriter})
+}
+
+// sqlWritingEmitter writes the data emitted by SQLReader.ProcessFrom
+// before emitting it.
+type sqlWritingEmitter struct {
+	ratchet.CheckpointEmitter
+	w *SQLWriter
+}
+
+func (e sqlWritingEmitter) EmitAt(d data.JSON, position data.JSON) error {
+	if err := e.w.write(d); err != nil {
+		return err
+	}
+	return e.CheckpointEmitter.EmitAt(d, position)
+}
+
 // Finish - see interface for documentation.
 func (s *SQLReaderWriter) Finish(outputChan chan data.JSON, killChan chan error) {
 }
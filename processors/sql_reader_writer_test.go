@@ -0,0 +1,142 @@
+package processors_test
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/dailyburn/ratchet"
+	"github.com/dailyburn/ratchet/checkpoint"
+	"github.com/dailyburn/ratchet/logger"
+	"github.com/dailyburn/ratchet/processors"
+)
+
+// fakeDriver is a database/sql driver returning the rows 1 and 2 (in an
+// "id" column) for any SELECT, and recording the other statements executed.
+type fakeDriver struct {
+	mu    sync.Mutex
+	execs []string
+}
+
+var fake = &fakeDriver{}
+
+func init() {
+	sql.Register("ratchetfake", fake)
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	return fakeConn{d}, nil
+}
+
+func (d *fakeDriver) executed() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	execs := d.execs
+	d.execs = nil
+	return execs
+}
+
+type fakeConn struct{ d *fakeDriver }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeStmt{c.d, query}, nil
+}
+
+func (c fakeConn) Close() error {
+	return nil
+}
+
+func (c fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("fakeDriver: transactions aren't supported")
+}
+
+type fakeStmt struct {
+	d     *fakeDriver
+	query string
+}
+
+func (s fakeStmt) Close() error {
+	return nil
+}
+
+func (s fakeStmt) NumInput() int {
+	return -1
+}
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	s.d.execs = append(s.d.execs, fmt.Sprint(s.query, args))
+	return fakeResult{}, nil
+}
+
+type fakeResult struct{}
+
+func (fakeResult) LastInsertId() (int64, error) {
+	return 0, nil
+}
+
+func (fakeResult) RowsAffected() (int64, error) {
+	return 0, nil
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if !strings.HasPrefix(s.query, "SELECT") {
+		return nil, errors.New("fakeDriver: not a query")
+	}
+	return &fakeRows{values: []int64{1, 2}}, nil
+}
+
+type fakeRows struct {
+	values []int64
+}
+
+func (r *fakeRows) Columns() []string {
+	return []string{"id"}
+}
+
+func (r *fakeRows) Close() error {
+	return nil
+}
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	dest[0] = r.values[0]
+	r.values = r.values[1:]
+	return nil
+}
+
+func TestSQLReaderWriterCheckpoint(t *testing.T) {
+	logger.LogLevel = logger.LevelSilent
+
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := sql.Open("ratchetfake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rw := processors.NewSQLReaderWriter(db, db, "SELECT id FROM a ORDER BY id", "b")
+	pipeline := ratchet.NewPipeline(rw, processors.NewPassthrough())
+	pipeline.Checkpoints = &ratchet.Checkpointing{RunID: "test", Store: checkpoint.NewFileStore(dir)}
+	if err := <-pipeline.Run(); err != nil {
+		t.Fatal(err)
+	}
+	expected := "INSERT INTO b(id) VALUES(?),(?) ON DUPLICATE KEY UPDATE `id`=VALUES(`id`)[1 2]"
+	if execs := fake.executed(); len(execs) != 1 || execs[0] != expected {
+		t.Errorf("Expected the rows read to be written with %q, got %q", expected, execs)
+	}
+}
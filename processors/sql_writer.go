@@ -1,7 +1,9 @@
 package processors
 
 import (
+	"context"
 	"database/sql"
+	"sync"
 
 	"github.com/dailyburn/ratchet/data"
 	"github.com/dailyburn/ratchet/logger"
@@ -18,6 +20,11 @@ import (
 //
 // For use-cases where a SQLWriter instance needs to write to
 // multiple tables you can pass in SQLWriterData.
+//
+// Set Transactional to write all the data within a single transaction,
+// which is only committed once the Pipeline has succeeded (see
+// ratchet.Committer), so that a failed run doesn't leave half-written
+// tables behind.
 type SQLWriter struct {
 	writeDB          *sql.DB
 	TableName        string
@@ -25,6 +32,9 @@ type SQLWriter struct {
 	OnDupKeyFields   []string
 	ConcurrencyLevel int // See ConcurrentDataProcessor
 	BatchSize        int
+	Transactional    bool
+	txMu             sync.Mutex
+	tx               *sql.Tx // set once the transaction has begun
 }
 
 // SQLWriterData is a custom data structure you can send into a SQLWriter
@@ -43,13 +53,13 @@ func NewSQLWriter(db *sql.DB, tableName string) *SQLWriter {
 
 // ProcessData defers to util.SQLInsertData
 func (s *SQLWriter) ProcessData(d data.JSON, outputChan chan data.JSON, killChan chan error) {
-	// handle panics a bit more gracefully
-	defer func() {
-		if err := recover(); err != nil {
-			util.KillPipelineIfErr(err.(error), killChan)
-		}
-	}()
+	if util.KilledPipeline(s.write(d), killChan) {
+		return
+	}
+	logger.Info("SQLWriter: Write complete")
+}
 
+func (s *SQLWriter) write(d data.JSON) error {
 	// First check for SQLWriterData
 	var wd SQLWriterData
 	err := data.ParseJSONSilent(d, &wd)
@@ -57,15 +67,33 @@ func (s *SQLWriter) ProcessData(d data.JSON, outputChan chan data.JSON, killChan
 	if err == nil && wd.TableName != "" && wd.InsertData != nil {
 		logger.Debug("SQLWriter: SQLWriterData scenario")
 		dd, err := data.NewJSON(wd.InsertData)
-		util.KillPipelineIfErr(err, killChan)
-		err = util.SQLInsertData(s.writeDB, dd, wd.TableName, s.OnDupKeyUpdate, s.OnDupKeyFields, s.BatchSize)
-		util.KillPipelineIfErr(err, killChan)
-	} else {
-		logger.Debug("SQLWriter: normal data scenario")
-		err = util.SQLInsertData(s.writeDB, d, s.TableName, s.OnDupKeyUpdate, s.OnDupKeyFields, s.BatchSize)
-		util.KillPipelineIfErr(err, killChan)
+		if err != nil {
+			return err
+		}
+		return s.insert(dd, wd.TableName)
 	}
-	logger.Info("SQLWriter: Write complete")
+	logger.Debug("SQLWriter: normal data scenario")
+	return s.insert(d, s.TableName)
+}
+
+// insert defers to util.SQLInsertData, or util.SQLInsertDataTx
+// when Transactional.
+func (s *SQLWriter) insert(d data.JSON, tableName string) error {
+	if !s.Transactional {
+		return util.SQLInsertData(s.writeDB, d, tableName, s.OnDupKeyUpdate, s.OnDupKeyFields, s.BatchSize)
+	}
+	s.txMu.Lock()
+	if s.tx == nil {
+		tx, err := s.writeDB.Begin()
+		if err != nil {
+			s.txMu.Unlock()
+			return err
+		}
+		s.tx = tx
+	}
+	tx := s.tx
+	s.txMu.Unlock()
+	return util.SQLInsertDataTx(tx, d, tableName, s.OnDupKeyUpdate, s.OnDupKeyFields, s.BatchSize)
 }
 
 // Finish - see interface for documentation.
@@ -80,3 +108,42 @@ func (s *SQLWriter) String() string {
 func (s *SQLWriter) Concurrency() int {
 	return s.ConcurrencyLevel
 }
+
+// AckOnFinish defers to ratchet.FinishAcker, holding the acknowledgements
+// until the transaction is committed when Transactional.
+func (s *SQLWriter) AckOnFinish() bool {
+	return s.Transactional
+}
+
+// Prepare defers to ratchet.Committer.
+func (s *SQLWriter) Prepare(ctx context.Context) error {
+	return nil
+}
+
+// Commit defers to ratchet.Committer, committing the transaction.
+func (s *SQLWriter) Commit(ctx context.Context) error {
+	tx := s.takeTx()
+	if tx == nil {
+		return nil
+	}
+	return tx.Commit()
+}
+
+// Abort defers to ratchet.Committer, rolling back the transaction.
+func (s *SQLWriter) Abort(ctx context.Context) error {
+	tx := s.takeTx()
+	if tx == nil {
+		return nil
+	}
+	return tx.Rollback()
+}
+
+// takeTx returns the transaction begun by the current run (if any),
+// so that the next run begins a new one.
+func (s *SQLWriter) takeTx() *sql.Tx {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	tx := s.tx
+	s.tx = nil
+	return tx
+}
@@ -0,0 +1,195 @@
+package ratchet
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/dailyburn/ratchet/data"
+)
+
+// Predicate decides whether a payload should be sent along a route.
+// See Route.
+type Predicate func(d data.JSON) bool
+
+// RoutingMode determines which routes a payload is sent along when
+// more than one Predicate matches it.
+type RoutingMode int
+
+const (
+	// FirstMatch sends each payload along the first matching route only.
+	// This is the default.
+	FirstMatch RoutingMode = iota
+	// AllMatches sends each payload along every matching route.
+	AllMatches
+)
+
+// route is an output that only receives payloads matching its predicate.
+// A nil predicate marks a default route.
+type route struct {
+	pred  Predicate
+	to    DataProcessor
+	count int64 // payloads sent along the route
+}
+
+// Route sends payloads for which pred returns true to the given DataProcessor,
+// instead of sending every payload to every output. Routes are checked in the
+// order they were added, and with the default FirstMatch mode a payload is
+// only sent along the first route that matches it:
+//
+//	ratchet.Do(reader).
+//	        Route(isOrder, orderWriter).
+//	        Route(isRefund, refundWriter).
+//	        Default(unknownWriter)
+//
+// The routed DataProcessors are added to the outputs, so they must be in the
+// next PipelineStage as usual. Outputs set with Outputs still receive every
+// payload. The number of payloads sent along each route is included in the
+// Pipeline stats.
+func (dp *dataProcessor) Route(pred Predicate, to DataProcessor) *dataProcessor {
+	dp.routes = append(dp.routes, &route{pred: pred, to: to})
+	dp.addOutput(to)
+	return dp
+}
+
+// Default sends payloads that don't match any Route to the given DataProcessor.
+// Without a Default route, such payloads are dropped (and counted as
+// "unrouted" in the Pipeline stats).
+func (dp *dataProcessor) Default(to DataProcessor) *dataProcessor {
+	dp.routes = append(dp.routes, &route{to: to})
+	dp.addOutput(to)
+	return dp
+}
+
+// Routing sets the RoutingMode used to pick between matching routes.
+func (dp *dataProcessor) Routing(mode RoutingMode) *dataProcessor {
+	dp.routingMode = mode
+	return dp
+}
+
+func (dp *dataProcessor) addOutput(p DataProcessor) {
+	for _, out := range dp.outputs {
+		if out == p {
+			return
+		}
+	}
+	dp.outputs = append(dp.outputs, p)
+}
+
+// allRoutes returns the routes added by Route and Default, followed by
+// those added by Partition.
+func (dp *dataProcessor) allRoutes() []*route {
+	if len(dp.partitions) == 0 {
+		return dp.routes
+	}
+	return append(append([]*route{}, dp.routes...), dp.partitions...)
+}
+
+// isRouted returns true if the given output only receives routed payloads.
+func (dp *dataProcessor) isRouted(p DataProcessor) bool {
+	for _, r := range dp.routes {
+		if r.to == p {
+			return true
+		}
+	}
+	for _, r := range dp.partitions {
+		if r.to == p {
+			return true
+		}
+	}
+	return false
+}
+
+// routeTo returns which of dp.outputs the payload should be sent to,
+// or nil if it should be sent to all of them.
+func (dp *dataProcessor) routeTo(d data.JSON) []bool {
+	if len(dp.routes) == 0 && len(dp.partitions) == 0 {
+		return nil
+	}
+	send := make([]bool, len(dp.outputs))
+	for i, out := range dp.outputs {
+		send[i] = !dp.isRouted(out)
+	}
+	dp.partition(d, send)
+	if len(dp.routes) == 0 {
+		return send
+	}
+	matched := false
+	for _, r := range dp.routes {
+		if r.pred == nil || !r.pred(d) {
+			continue
+		}
+		dp.sendAlong(r, send)
+		matched = true
+		if dp.routingMode == FirstMatch {
+			break
+		}
+	}
+	if !matched {
+		routed := false
+		for _, r := range dp.routes {
+			if r.pred == nil {
+				dp.sendAlong(r, send)
+				routed = true
+			}
+		}
+		if !routed {
+			atomic.AddInt64(&dp.unrouted, 1)
+		}
+	}
+	return send
+}
+
+func (dp *dataProcessor) sendAlong(r *route, send []bool) {
+	atomic.AddInt64(&r.count, 1)
+	for i, out := range dp.outputs {
+		if out == r.to {
+			send[i] = true
+		}
+	}
+}
+
+// routeCounts returns the number of payloads sent along each route and
+// to each partition, for the Pipeline stats.
+func (dp *dataProcessor) routeCounts() map[string]int64 {
+	if len(dp.routes) == 0 && len(dp.partitions) == 0 {
+		return nil
+	}
+	counts := make(map[string]int64)
+	for _, r := range dp.routes {
+		name := fmt.Sprintf("%v", r.to)
+		if r.pred == nil {
+			name += " (default)"
+		}
+		counts[name] += atomic.LoadInt64(&r.count)
+	}
+	if len(dp.routes) > 0 {
+		counts["(unrouted)"] = atomic.LoadInt64(&dp.unrouted)
+	}
+	for i, r := range dp.partitions {
+		counts[fmt.Sprintf("%v (partition %d)", r.to, i+1)] = atomic.LoadInt64(&r.count)
+	}
+	return counts
+}
+
+// routeLabel describes the route to the given output in diagrams,
+// e.g. "route 1", "default" or "partition 1".
+func (dp *dataProcessor) routeLabel(p DataProcessor) string {
+	labels := []string{}
+	for i, r := range dp.routes {
+		if r.to != p {
+			continue
+		}
+		if r.pred == nil {
+			labels = append(labels, "default")
+		} else {
+			labels = append(labels, fmt.Sprintf("route %d", i+1))
+		}
+	}
+	for i, r := range dp.partitions {
+		if r.to == p {
+			labels = append(labels, fmt.Sprintf("partition %d", i+1))
+		}
+	}
+	return strings.Join(labels, ", ")
+}
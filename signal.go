@@ -0,0 +1,93 @@
+package ratchet
+
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/dailyburn/ratchet/logger"
+)
+
+// ErrInterrupted is sent on the killChan when the Pipeline is stopped by
+// a signal. See SignalHandling.
+var ErrInterrupted = errors.New("Exiting due to interrupt signal.")
+
+// ErrDrainTimeout is sent on the killChan when a graceful drain started by a
+// signal takes longer than SignalHandling.DrainTimeout, and the Pipeline is
+// halted instead.
+var ErrDrainTimeout = errors.New("Exiting due to interrupt signal, timed out draining the pipeline.")
+
+// SignalHandling configures how a Pipeline reacts to OS signals, e.g. an
+// interrupt from the terminal or SIGTERM from a container orchestrator:
+//
+//	pipeline.Signals = &ratchet.SignalHandling{Graceful: true, DrainTimeout: 30 * time.Second}
+//
+// Signals are only handled while the Pipeline is running, so several
+// Pipelines in a process can each handle them.
+type SignalHandling struct {
+	// Notify lists the signals to handle. It defaults to os.Interrupt
+	// and SIGTERM.
+	Notify []os.Signal
+	// Graceful makes a signal drain the Pipeline instead of halting it:
+	// the initial stage stops reading (its context is cancelled, and it
+	// can no longer send data), the data already read is processed by the
+	// later stages and Finish is called on every DataProcessor as usual.
+	// The Committers are committed, as the data read has all been written,
+	// and ErrInterrupted is then sent on the killChan (unless a commit
+	// failed, whose error is sent instead). A second signal halts the
+	// Pipeline straight away, aborting the Committers.
+	Graceful bool
+	// DrainTimeout is how long a graceful drain can take before the
+	// Pipeline is halted, with ErrDrainTimeout. Zero means no limit.
+	DrainTimeout time.Duration
+}
+
+// handle starts handling signals for a run of the Pipeline, until done is
+// closed. Errors halting the Pipeline are sent on killChan. For a graceful
+// drain, stopSources is called and interrupted is closed.
+func (h *SignalHandling) handle(name string, killChan chan error, done chan struct{}, stopSources func(), interrupted chan struct{}) {
+	signals := h.Notify
+	if len(signals) == 0 {
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, signals...)
+	halt := func(err error) {
+		select {
+		case killChan <- err:
+		case <-done:
+		}
+	}
+	go func() {
+		defer signal.Stop(c)
+		select {
+		case sig := <-c:
+			logger.Info(name, ": received", sig)
+		case <-done:
+			return
+		}
+		if !h.Graceful {
+			halt(ErrInterrupted)
+			return
+		}
+
+		logger.Info(name, ": draining")
+		close(interrupted)
+		stopSources()
+		var timeout <-chan time.Time
+		if h.DrainTimeout > 0 {
+			timer := time.NewTimer(h.DrainTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-c:
+			halt(ErrInterrupted)
+		case <-timeout:
+			halt(ErrDrainTimeout)
+		case <-done:
+		}
+	}()
+}
@@ -0,0 +1,173 @@
+package ratchet
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// StatsReport holds the stats gathered while running a Pipeline, as returned
+// by Pipeline.StatsReport. It can be serialized with encoding/json, e.g. to
+// store the metrics of each run.
+type StatsReport struct {
+	Name        string           `json:"name"`
+	ID          string           `json:"id"` // unique to the Pipeline within the process, unlike Name
+	Started     time.Time        `json:"started"`
+	Finished    time.Time        `json:"finished"` // zero while the Pipeline is still running
+	Duration    time.Duration    `json:"duration"`
+	Stages      []StageStats     `json:"stages"`
+	DeadLetters []ProcessorStats `json:"dead_letters,omitempty"`
+}
+
+// StageStats holds the stats of each DataProcessor in a PipelineStage.
+type StageStats struct {
+	Stage      int              `json:"stage"` // starting at 1
+	Processors []ProcessorStats `json:"processors"`
+}
+
+// ProcessorStats holds the stats gathered for a single DataProcessor.
+type ProcessorStats struct {
+	Name               string        `json:"name"`
+	PayloadsSent       int           `json:"payloads_sent"`
+	PayloadsReceived   int           `json:"payloads_received"`
+	BytesSent          int           `json:"bytes_sent"`
+	BytesReceived      int           `json:"bytes_received"`
+	AvgBytesSent       int           `json:"avg_bytes_sent"`
+	AvgBytesReceived   int           `json:"avg_bytes_received"`
+	Executions         int           `json:"executions"` // calls to ProcessData
+	TotalExecutionTime time.Duration `json:"total_execution_time"`
+	AvgExecutionTime   time.Duration `json:"avg_execution_time"`
+	Errors             int           `json:"errors"`
+	Buffered           int           `json:"buffered"`              // payloads waiting in the input channels
+	Concurrency        int           `json:"concurrency,omitempty"` // concurrent ProcessData calls allowed, see Adaptive
+	// Distributions of ProcessData execution time (in nanoseconds)
+	// and of payload sizes (in bytes).
+	ExecutionTimes       Distribution     `json:"execution_times"`
+	PayloadSizesSent     Distribution     `json:"payload_sizes_sent"`
+	PayloadSizesReceived Distribution     `json:"payload_sizes_received"`
+	Started              time.Time        `json:"started"`                // when the first payload was received
+	Finished             time.Time        `json:"finished"`               // when the DataProcessor closed its output
+	Counters             map[string]int64 `json:"counters,omitempty"`     // see CounterProvider
+	Routes               map[string]int64 `json:"routes,omitempty"`       // payloads sent along each route, see Route
+	SubPipeline          *StatsReport     `json:"sub_pipeline,omitempty"` // the inner stats of a SubPipeline
+}
+
+// StatsReport returns the stats gathered for each stage executed. It can be
+// called while the Pipeline is running, or once it is done.
+func (p *Pipeline) StatsReport() *StatsReport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r := &StatsReport{Name: p.Name, ID: strconv.FormatUint(p.id, 10)}
+	if p.timer != nil {
+		r.Started = p.timer.StartTime()
+		r.Finished = p.timer.EndTime()
+		r.Duration = p.timer.Duration()
+	}
+	for n, stage := range p.layout.stages {
+		s := StageStats{Stage: n + 1}
+		for _, dp := range stage.processors {
+			s.Processors = append(s.Processors, dp.statsReport())
+		}
+		r.Stages = append(r.Stages, s)
+	}
+	for _, dp := range p.deadLetters {
+		r.DeadLetters = append(r.DeadLetters, dp.statsReport())
+	}
+	return r
+}
+
+// statsReport returns the stats gathered for the dataProcessor.
+func (dp *dataProcessor) statsReport() ProcessorStats {
+	s := ProcessorStats{Name: dp.String()}
+	dp.executionStat.report(&s)
+	s.Buffered = dp.buffered()
+	if cp, ok := unwrap(dp.DataProcessor).(CounterProvider); ok {
+		s.Counters = cp.Counters()
+	}
+	s.Routes = dp.routeCounts()
+	if sp, ok := unwrap(dp.DataProcessor).(*subPipeline); ok {
+		s.SubPipeline = sp.pipeline.StatsReport()
+	}
+	if dp.adaptive != nil {
+		s.Concurrency = int(atomic.LoadInt64(&dp.limit))
+	} else if dp.concurrency > 1 {
+		s.Concurrency = dp.concurrency
+	}
+	return s
+}
+
+// String formats the report for output display, as returned by Pipeline.Stats.
+func (r *StatsReport) String() string {
+	var o string
+	switch {
+	case r.Started.IsZero():
+		o = fmt.Sprintf("%s: Not started\r\n", r.Name)
+	case r.Finished.IsZero():
+		o = fmt.Sprintf("%s: Running for %v secs\r\n", r.Name, r.Duration.Seconds())
+	default:
+		o = fmt.Sprintf("%s: Ran in %v secs\r\n", r.Name, r.Duration.Seconds())
+	}
+	for _, stage := range r.Stages {
+		o += fmt.Sprintf("Stage %d)\r\n", stage.Stage)
+		for _, s := range stage.Processors {
+			o += s.String()
+		}
+	}
+	if len(r.DeadLetters) > 0 {
+		o += "Dead letters)\r\n"
+		for _, s := range r.DeadLetters {
+			o += s.String()
+		}
+	}
+	return o
+}
+
+// String formats the stats for output display, as part of StatsReport.String.
+func (s ProcessorStats) String() string {
+	o := fmt.Sprintf("  * %s\r\n", s.Name)
+	o += fmt.Sprintf("     - Total/Avg Execution Time = %f/%fs\r\n", s.TotalExecutionTime.Seconds(), s.AvgExecutionTime.Seconds())
+	o += fmt.Sprintf("     - Payloads Sent/Received = %d/%d\r\n", s.PayloadsSent, s.PayloadsReceived)
+	o += fmt.Sprintf("     - Total/Avg Bytes Sent = %d/%d\r\n", s.BytesSent, s.AvgBytesSent)
+	o += fmt.Sprintf("     - Total/Avg Bytes Received = %d/%d\r\n", s.BytesReceived, s.AvgBytesReceived)
+	if d := s.ExecutionTimes; d.Count > 0 {
+		o += fmt.Sprintf("     - p50/p95/p99/Max Execution Time = %f/%f/%f/%fs\r\n",
+			time.Duration(d.P50).Seconds(), time.Duration(d.P95).Seconds(), time.Duration(d.P99).Seconds(), time.Duration(d.Max).Seconds())
+	}
+	if d := s.PayloadSizesSent; d.Count > 0 {
+		o += fmt.Sprintf("     - p50/p95/p99/Max Bytes Sent = %d/%d/%d/%d\r\n", d.P50, d.P95, d.P99, d.Max)
+	}
+	if d := s.PayloadSizesReceived; d.Count > 0 {
+		o += fmt.Sprintf("     - p50/p95/p99/Max Bytes Received = %d/%d/%d/%d\r\n", d.P50, d.P95, d.P99, d.Max)
+	}
+	if s.Errors > 0 {
+		o += fmt.Sprintf("     - Errors = %d\r\n", s.Errors)
+	}
+	names := []string{}
+	for name := range s.Counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		o += fmt.Sprintf("     - %s = %d\r\n", name, s.Counters[name])
+	}
+	names = []string{}
+	for name := range s.Routes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		o += fmt.Sprintf("     - Route %s = %d\r\n", name, s.Routes[name])
+	}
+	if s.SubPipeline != nil {
+		// indent the inner stats under the SubPipeline
+		for _, line := range strings.SplitAfter(s.SubPipeline.String(), "\r\n") {
+			if line != "" {
+				o += "       " + line
+			}
+		}
+	}
+	return o
+}
@@ -0,0 +1,175 @@
+package ratchet
+
+import (
+	"context"
+	"sync"
+
+	"github.com/dailyburn/ratchet/data"
+)
+
+// SubPipeline returns a DataProcessor that runs the payloads it receives
+// through the given PipelineLayout, so that reusable fragments of a Pipeline
+// (e.g. normalizing rows, then deduplicating them) can be shared:
+//
+//	normalize, _ := ratchet.NewPipelineLayout(
+//	        ratchet.NewPipelineStage(ratchet.Do(normalizer).Outputs(deduper)),
+//	        ratchet.NewPipelineStage(ratchet.Do(deduper)),
+//	)
+//	pipeline := ratchet.NewPipeline(reader, ratchet.SubPipeline(normalize), writer)
+//
+// Each payload is sent to every DataProcessor in the layout's initial stage
+// (instead of the StartSignal), and the data sent by DataProcessors without
+// outputs is sent on by the SubPipeline. Finish waits for the inner
+// DataProcessors to finish. The inner Pipeline processes payloads
+// asynchronously, so an error halting it can't be tied to the payload the
+// SubPipeline is processing at the time: it halts the outer Pipeline,
+// regardless of the SubPipeline's ErrorPolicy. Set an ErrorPolicy on the
+// inner DataProcessors instead, e.g. to send their failed payloads to a dead
+// letter. The inner stats are nested under the SubPipeline in the outer
+// Pipeline's stats. Once the outer Pipeline is done or halted, the
+// SubPipeline can be used again in a new one.
+//
+// Outside of a Pipeline, the inner Pipeline runs until Finish is called (or
+// its context is cancelled), and its output is sent to the Emitter given to
+// the latest ProcessData or Finish call.
+func SubPipeline(layout *PipelineLayout) DataProcessor {
+	p := NewBranchingPipeline(layout)
+	p.Name = "SubPipeline"
+	p.nested = true
+	return Wrap(&subPipeline{pipeline: p})
+}
+
+type subPipeline struct {
+	pipeline  *Pipeline
+	out       outputEmitter // set when the outer Pipeline runs
+	running   bool
+	err       error // the error that halted the inner Pipeline
+	killChan  chan error
+	cancel    context.CancelFunc
+	forwarded chan struct{} // closed once all the inner output has been sent on
+	mu        sync.Mutex
+	emitter   Emitter       // outside of a Pipeline, the Emitter of the latest call
+	reset     chan struct{} // closed once the last outer run has reset it, see stop
+}
+
+// setOutput prepares the SubPipeline for a new run of the outer Pipeline,
+// once the last one has reset it.
+func (sp *subPipeline) setOutput(out outputEmitter) {
+	sp.mu.Lock()
+	reset := sp.reset
+	sp.mu.Unlock()
+	if reset != nil {
+		<-reset
+	}
+	sp.out = out
+}
+
+// stop resets the SubPipeline at the end of a run of the outer Pipeline,
+// once its stages have exited. A halted run doesn't call Finish, so this
+// stops the inner Pipeline, which then starts again on the next run.
+func (sp *subPipeline) stop(exited <-chan struct{}) {
+	reset := make(chan struct{})
+	sp.mu.Lock()
+	sp.reset = reset
+	sp.mu.Unlock()
+	go func() {
+		<-exited
+		if sp.running {
+			sp.cancel()
+			if sp.err == nil {
+				<-sp.killChan
+			}
+			<-sp.forwarded
+		}
+		sp.running = false
+		sp.err = nil
+		close(reset)
+	}()
+}
+
+// start runs the inner Pipeline, sending its output on. Within a Pipeline,
+// the output goes straight to the outer dataProcessor's outputChan (the data
+// holding the trackers of the payloads it was derived from), and the inner
+// Pipeline runs until the outer one is done, regardless of the context of a
+// single call (e.g. its Timeout). Otherwise, it is sent to the latest
+// Emitter, and the inner Pipeline runs until Finish.
+func (sp *subPipeline) start() {
+	ctx := context.Background()
+	forward := func(m message) {
+		sp.mu.Lock()
+		out := sp.emitter
+		sp.mu.Unlock()
+		out.Emit(m.data)
+	}
+	if sp.out.c != nil {
+		ctx = sp.out.ctx
+		forward = func(m message) { sp.out.send(m) }
+	}
+	ctx, sp.cancel = context.WithCancel(ctx)
+	sp.pipeline.input = make(chan message)
+	sp.pipeline.output = make(chan message)
+	sp.killChan = sp.pipeline.RunContext(ctx)
+	sp.forwarded = make(chan struct{})
+	go func() {
+		// Once the outer Pipeline is halted sending fails, but the
+		// output is still drained until the inner Pipeline closes it.
+		for m := range sp.pipeline.output {
+			forward(m)
+		}
+		close(sp.forwarded)
+	}()
+	sp.running = true
+}
+
+// setEmitter sets the Emitter the output is sent to outside of a Pipeline.
+func (sp *subPipeline) setEmitter(out Emitter) {
+	sp.mu.Lock()
+	sp.emitter = out
+	sp.mu.Unlock()
+}
+
+func (sp *subPipeline) ProcessData(ctx context.Context, d data.JSON, out Emitter) error {
+	sp.setEmitter(out)
+	if !sp.running {
+		sp.start()
+	}
+	if sp.err != nil {
+		return &haltError{sp.err}
+	}
+	select {
+	case sp.pipeline.input <- derive(ctx, d, nil):
+		return nil
+	case sp.err = <-sp.killChan:
+		return &haltError{sp.err}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (sp *subPipeline) Finish(ctx context.Context, out Emitter) error {
+	sp.setEmitter(out)
+	if !sp.running {
+		// Run the inner Pipeline even without any data,
+		// so that its DataProcessors are finished.
+		sp.start()
+	}
+	close(sp.pipeline.input)
+	err := sp.err
+	if err == nil {
+		select {
+		case err = <-sp.killChan:
+		case <-ctx.Done():
+			sp.cancel()
+			err = <-sp.killChan
+		}
+	}
+	sp.cancel()
+	<-sp.forwarded
+	sp.running = false
+	sp.err = nil
+	return err
+}
+
+func (sp *subPipeline) String() string {
+	return sp.pipeline.Name
+}
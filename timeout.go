@@ -0,0 +1,187 @@
+package ratchet
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dailyburn/ratchet/data"
+)
+
+// TimeoutError is the error reported when a ProcessData or Finish call takes
+// longer than the timeout set with Timeout. Like any other error, it is
+// handled according to the DataProcessor's ErrorPolicy.
+type TimeoutError struct {
+	Processor string
+	Stage     int
+	Call      string // "ProcessData" or "Finish"
+	Timeout   time.Duration
+	Data      data.JSON // the payload being processed, nil in Finish
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s (stage %d) %s timed out after %v", e.Processor, e.Stage, e.Call, e.Timeout)
+}
+
+// Timeout sets how long each ProcessData and Finish call can take, so that a
+// DataProcessor blocked on e.g. a dead connection can't hang the Pipeline:
+//
+//	ratchet.Do(uploader).Timeout(30*time.Second, 5*time.Minute)
+//
+// Once the timeout passes, the context given to a ContextDataProcessor is
+// cancelled and the call fails with a TimeoutError. A call ignoring its
+// context, such as any call to an old-style DataProcessor, can't be
+// interrupted, so it is left running in the background, and anything it
+// sends afterwards is discarded. So that calls never run at the same time,
+// the next ProcessData or Finish call first waits for the abandoned call to
+// return, for up to its own timeout (or the longer of the two, for a call
+// without one). If it is still running by then, that call fails with a
+// TimeoutError without being made. Zero means no timeout, which is the
+// default.
+func (dp *dataProcessor) Timeout(processData, finish time.Duration) *dataProcessor {
+	dp.processDataTimeout = processData
+	dp.finishTimeout = finish
+	return dp
+}
+
+// call makes a ProcessData or Finish call to f, tracking it for Diagnostics,
+// turning a panic into a PanicError, and giving up after timeout (if any).
+func (dp *dataProcessor) call(ctx context.Context, name string, timeout time.Duration, d data.JSON, out trackingEmitter, f func(context.Context, trackingEmitter) error) (err error) {
+	defer dp.endCall(dp.beginCall(name, d))
+	defer func() { dp.fillPanicError(err, d) }()
+	wait := timeout
+	if wait <= 0 {
+		wait = dp.processDataTimeout
+		if dp.finishTimeout > wait {
+			wait = dp.finishTimeout
+		}
+	}
+	if err := dp.waitAbandoned(ctx, wait); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return &TimeoutError{dp.String(), dp.stage, name, wait, d}
+	}
+	if timeout <= 0 {
+		defer recoverPanic(&err)
+		return f(ctx, out)
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	tctx = context.WithValue(tctx, abandonedKey{}, &dp.abandonedCalls)
+	if oe, ok := out.(outputEmitter); ok {
+		// stop waiting for the next stage once the call is abandoned
+		oe.ctx = tctx
+		out = oe
+	}
+	guard := &guardedEmitter{out: out, ctx: tctx}
+	errc := make(chan error, 1)
+	returned := make(chan struct{})
+	go func() {
+		defer close(returned)
+		var err error
+		defer func() { errc <- err }()
+		defer recoverPanic(&err)
+		err = f(tctx, guard)
+	}()
+	select {
+	case err = <-errc:
+		if err == nil || tctx.Err() == nil {
+			return err
+		}
+	case <-tctx.Done():
+		dp.addAbandoned(returned)
+	}
+
+	guard.abandon()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return &TimeoutError{dp.String(), dp.stage, name, timeout, d}
+}
+
+// abandonedCalls keeps track of the calls abandoned after timing out that
+// are still running, so that the next call can wait for them to return.
+type abandonedCalls struct {
+	mu       sync.Mutex
+	running  int
+	returned chan struct{} // closed once running drops back to zero
+}
+
+// addAbandoned records an abandoned call, which closes returned once it
+// returns.
+func (a *abandonedCalls) addAbandoned(returned <-chan struct{}) {
+	a.mu.Lock()
+	if a.running == 0 {
+		a.returned = make(chan struct{})
+	}
+	a.running++
+	a.mu.Unlock()
+	go func() {
+		<-returned
+		a.mu.Lock()
+		if a.running--; a.running == 0 {
+			close(a.returned)
+		}
+		a.mu.Unlock()
+	}()
+}
+
+type abandonedKey struct{}
+
+// abandon is called by a call with a timeout that returns once its context
+// is done, while the work it started keeps running in the background until
+// done is closed (e.g. an old-style DataProcessor passed through Adapt), so
+// that the next call waits for that work as for an abandoned call.
+func abandon(ctx context.Context, done <-chan struct{}) {
+	if a, ok := ctx.Value(abandonedKey{}).(*abandonedCalls); ok {
+		a.addAbandoned(done)
+	}
+}
+
+// waitAbandoned waits for the abandoned calls to return, for up to timeout.
+func (a *abandonedCalls) waitAbandoned(ctx context.Context, timeout time.Duration) error {
+	a.mu.Lock()
+	running, returned := a.running, a.returned
+	a.mu.Unlock()
+	if running == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	select {
+	case <-returned:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// guardedEmitter emits data for a call with a timeout, until ctx is done.
+type guardedEmitter struct {
+	mu  sync.Mutex
+	out trackingEmitter
+	ctx context.Context
+}
+
+func (e *guardedEmitter) Emit(d data.JSON) error {
+	return e.emitTracked(d, nil)
+}
+
+func (e *guardedEmitter) emitTracked(d data.JSON, h Headers, ts ...*tracker) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.ctx.Err(); err != nil {
+		return err
+	}
+	return e.out.emitTracked(d, h, ts...)
+}
+
+// abandon waits for an Emit in progress to return. Since ctx is done,
+// any later Emit fails.
+func (e *guardedEmitter) abandon() {
+	e.mu.Lock()
+	e.mu.Unlock()
+}
@@ -0,0 +1,297 @@
+package ratchet
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	mrand "math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dailyburn/ratchet/logger"
+)
+
+// Tracing configures a Pipeline to trace each payload through its stages,
+// so that the spans of a single record show which stage made it slow, which
+// the averages of Stats hide:
+//
+//	pipeline.Tracing = &ratchet.Tracing{Exporter: tracing.NewOTLPExporter("http://localhost:4318/v1/traces", "import"), SampleRate: 0.01}
+//
+// Each payload emitted by the initial stage starts a trace, whose root span
+// covers the source producing it (since it emitted the previous one). So
+// does any payload emitted without one to derive from, such as a batch
+// emitted in Finish. Each ProcessData call on a payload derived from it then
+// records a span, a child of the span of the call that emitted the payload.
+// SubPipelines record their spans in the outer Pipeline's traces.
+//
+// The trace context travels in the HeaderTraceParent header, in the W3C
+// format, so payloads sent with Input.EmitEnvelope carrying one join the
+// sender's trace (and keep its sampling decision). TraceParent returns it
+// for the ProcessData call in progress, e.g. for HTTPRequest to pass it on.
+//
+// Spans are exported in batches, every Interval and once the run is done.
+// Errors exporting them are logged, and don't fail the run.
+type Tracing struct {
+	Exporter   SpanExporter
+	SampleRate float64       // fraction of traces recorded, defaults to 1
+	Interval   time.Duration // defaults to 1s
+}
+
+// Span records a ProcessData call on a payload, or for the root span of a
+// trace, the source producing it. IDs are in hex, as in the W3C format.
+type Span struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string // empty for the root span
+	Name         string // the DataProcessor's String()
+	Stage        int
+	Start        time.Time
+	End          time.Time
+	Err          string            // the error returned, if any
+	Attributes   map[string]string // for the root span, the payload's headers
+}
+
+// SpanExporter sends the spans recorded by a Pipeline wherever they are
+// collected. See the tracing package for implementations. ExportSpans isn't
+// called concurrently.
+type SpanExporter interface {
+	ExportSpans(ctx context.Context, spans []Span) error
+}
+
+// TraceParent returns the W3C traceparent of the ProcessData call in
+// progress, for use in ContextDataProcessor.ProcessData (see Tracing). It
+// returns the HeaderTraceParent header of the payload when the Pipeline isn't
+// recording its trace, and "" if it has none.
+func TraceParent(ctx context.Context) string {
+	if cs := spanFrom(ctx); cs != nil && cs.span.TraceID != "" {
+		return formatTraceParent(cs.span.TraceID, cs.span.SpanID, true)
+	}
+	return messageFrom(ctx).headers[HeaderTraceParent]
+}
+
+// maxSpanBatch is the number of spans exported at once.
+const maxSpanBatch = 512
+
+// tracer collects the spans recorded during a run of a Pipeline, exporting
+// them in batches.
+type tracer struct {
+	name   string // the Pipeline's, for logging
+	config Tracing
+
+	mu    sync.Mutex
+	spans []Span
+
+	exportMu sync.Mutex // serializes ExportSpans calls
+	full     chan struct{}
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+func newTracer(name string, config Tracing) *tracer {
+	if config.Interval <= 0 {
+		config.Interval = time.Second
+	}
+	t := &tracer{
+		name:    name,
+		config:  config,
+		full:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// run exports the spans recorded every Interval, or as soon as there
+// is a full batch, until close is called.
+func (t *tracer) run() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(t.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.full:
+		case <-t.stop:
+			return
+		}
+		t.flush()
+	}
+}
+
+func (t *tracer) record(s Span) {
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	full := len(t.spans) >= maxSpanBatch
+	t.mu.Unlock()
+	if full {
+		select {
+		case t.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// flush exports the spans recorded so far.
+func (t *tracer) flush() {
+	t.exportMu.Lock()
+	defer t.exportMu.Unlock()
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mu.Unlock()
+	for len(spans) > 0 {
+		n := len(spans)
+		if n > maxSpanBatch {
+			n = maxSpanBatch
+		}
+		if err := t.config.Exporter.ExportSpans(context.Background(), spans[:n]); err != nil {
+			logger.Error(t.name, ": exporting spans:", err.Error())
+		}
+		spans = spans[n:]
+	}
+}
+
+// close stops the periodic exports, and exports the remaining spans.
+func (t *tracer) close() {
+	if t == nil {
+		return
+	}
+	close(t.stop)
+	<-t.stopped
+	t.flush()
+}
+
+// sample decides whether a new trace is recorded.
+func (t *tracer) sample() bool {
+	rate := t.config.SampleRate
+	return rate <= 0 || rate >= 1 || mrand.Float64() < rate
+}
+
+type spanKey struct{}
+
+// callSpan traces a ProcessData (or Finish) call. Without a traced payload,
+// nothing is recorded for the call itself, but each payload it emits starts
+// a trace (see propagate).
+type callSpan struct {
+	tracer *tracer
+	span   Span // with a TraceID when the payload is traced
+
+	mu   sync.Mutex
+	last time.Time // when the call started, or emitted its last payload
+}
+
+// startSpan returns the context for a ProcessData or Finish call traced with
+// the returned callSpan, which is nil when there is nothing to record: the
+// Pipeline isn't tracing, or the payload's trace isn't sampled (in which
+// case its trace context is passed on as it is).
+func (dp *dataProcessor) startSpan(ctx context.Context) (context.Context, *callSpan) {
+	if dp.tracer == nil {
+		return ctx, nil
+	}
+	cs := &callSpan{tracer: dp.tracer, span: Span{Name: dp.String(), Stage: dp.stage, Start: time.Now()}}
+	cs.last = cs.span.Start
+	if traceID, spanID, sampled, ok := parseTraceParent(messageFrom(ctx).headers[HeaderTraceParent]); ok {
+		if !sampled {
+			return ctx, nil
+		}
+		cs.span.TraceID = traceID
+		cs.span.ParentSpanID = spanID
+		cs.span.SpanID = newTraceID(8)
+	}
+	return context.WithValue(ctx, spanKey{}, cs), cs
+}
+
+// end records the span of a call on a traced payload.
+func (cs *callSpan) end(err error) {
+	if cs == nil || cs.span.TraceID == "" {
+		return
+	}
+	cs.span.End = time.Now()
+	if err != nil {
+		cs.span.Err = err.Error()
+	}
+	cs.tracer.record(cs.span)
+}
+
+// spanFrom returns the callSpan of the call processing with ctx, or nil.
+func spanFrom(ctx context.Context) *callSpan {
+	cs, _ := ctx.Value(spanKey{}).(*callSpan)
+	return cs
+}
+
+// propagate returns h, the headers of a payload emitted during the call,
+// with its trace context. Without a traced payload, the emitted one starts
+// a trace, whose root span is recorded if sampled.
+func (cs *callSpan) propagate(h Headers) Headers {
+	if cs.span.TraceID != "" {
+		return h.with(Headers{HeaderTraceParent: formatTraceParent(cs.span.TraceID, cs.span.SpanID, true)})
+	}
+	now := time.Now()
+	cs.mu.Lock()
+	start := cs.last
+	cs.last = now
+	cs.mu.Unlock()
+	root := Span{
+		TraceID: newTraceID(16),
+		SpanID:  newTraceID(8),
+		Name:    cs.span.Name,
+		Stage:   cs.span.Stage,
+		Start:   start,
+		End:     now,
+	}
+	sampled := cs.tracer.sample()
+	if sampled {
+		for k, v := range h {
+			if k == HeaderTraceParent {
+				continue
+			}
+			if root.Attributes == nil {
+				root.Attributes = map[string]string{}
+			}
+			root.Attributes[k] = v
+		}
+		cs.tracer.record(root)
+	}
+	return h.with(Headers{HeaderTraceParent: formatTraceParent(root.TraceID, root.SpanID, sampled)})
+}
+
+// newTraceID returns a random ID of n bytes, in hex.
+func newTraceID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func formatTraceParent(traceID, spanID string, sampled bool) string {
+	flags := "00"
+	if sampled {
+		flags = "01"
+	}
+	return "00-" + traceID + "-" + spanID + "-" + flags
+}
+
+// parseTraceParent parses a W3C traceparent, returning ok if it is valid.
+func parseTraceParent(s string) (traceID, spanID string, sampled, ok bool) {
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return "", "", false, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return "", "", false, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil || !isTraceID(parts[1]) || !isTraceID(parts[2]) {
+		return "", "", false, false
+	}
+	return parts[1], parts[2], flags[0]&1 == 1, true
+}
+
+// isTraceID returns true if s is a lowercase hex ID that isn't all zeros.
+func isTraceID(s string) bool {
+	if _, err := hex.DecodeString(s); err != nil || strings.ToLower(s) != s {
+		return false
+	}
+	return strings.Trim(s, "0") != ""
+}
@@ -0,0 +1,10 @@
+// Package tracing provides ratchet.SpanExporter implementations, which
+// collect the spans recorded when tracing each payload through a Pipeline:
+//
+//	pipeline.Tracing = &ratchet.Tracing{
+//	        Exporter:   tracing.NewOTLPExporter("http://localhost:4318/v1/traces", "import"),
+//	        SampleRate: 0.01,
+//	}
+//
+// See ratchet.Tracing for details.
+package tracing
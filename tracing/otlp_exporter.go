@@ -0,0 +1,160 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/dailyburn/ratchet"
+)
+
+// OTLPExporter sends spans to an OpenTelemetry collector, using the OTLP/HTTP
+// protocol with JSON encoding. The stage of each span, and the attributes of
+// root spans (the payload's headers), are sent as attributes prefixed with
+// "ratchet.".
+type OTLPExporter struct {
+	URL         string            // the collector's traces endpoint, usually ending in /v1/traces
+	ServiceName string            // sent as the service.name resource attribute
+	Headers     map[string]string // added to each request, e.g. for authentication
+	Client      *http.Client      // defaults to http.DefaultClient
+}
+
+// NewOTLPExporter returns an OTLPExporter sending spans to the given URL,
+// as the given service.
+func NewOTLPExporter(url, serviceName string) *OTLPExporter {
+	return &OTLPExporter{URL: url, ServiceName: serviceName, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// ExportSpans defers to ratchet.SpanExporter.
+func (e *OTLPExporter) ExportSpans(ctx context.Context, spans []ratchet.Span) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", e.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.Headers {
+		req.Header.Set(k, v)
+	}
+	client := e.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("OTLPExporter: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// The OTLP/HTTP JSON encoding of an ExportTraceServiceRequest, as far as
+// it's used. IDs are in hex, and 64-bit integers are strings.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusCodeError  = 2
+)
+
+func (e *OTLPExporter) request(spans []ratchet.Span) otlpRequest {
+	ss := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		ss[i] = otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentSpanID,
+			Name:              s.Name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        []otlpKeyValue{intAttribute("ratchet.stage", int64(s.Stage))},
+		}
+		keys := make([]string, 0, len(s.Attributes))
+		for k := range s.Attributes {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			ss[i].Attributes = append(ss[i].Attributes, stringAttribute("ratchet."+k, s.Attributes[k]))
+		}
+		if s.Err != "" {
+			ss[i].Status = otlpStatus{Code: otlpStatusCodeError, Message: s.Err}
+		}
+	}
+	return otlpRequest{[]otlpResourceSpans{{
+		Resource:   otlpResource{[]otlpKeyValue{stringAttribute("service.name", e.ServiceName)}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{"github.com/dailyburn/ratchet"}, Spans: ss}},
+	}}}
+}
+
+func stringAttribute(key, value string) otlpKeyValue {
+	return otlpKeyValue{key, otlpValue{StringValue: &value}}
+}
+
+func intAttribute(key string, value int64) otlpKeyValue {
+	v := strconv.FormatInt(value, 10)
+	return otlpKeyValue{key, otlpValue{IntValue: &v}}
+}
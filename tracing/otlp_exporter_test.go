@@ -0,0 +1,66 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dailyburn/ratchet"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	var received otlpRequest
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("Expected a JSON request, got %q", ct)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	start := time.Unix(1, 0)
+	spans := []ratchet.Span{
+		{TraceID: "0af7651916cd43dd8448eb211c80319c", SpanID: "b7ad6b7169203331", Name: "IoReader", Stage: 1,
+			Start: start, End: start.Add(time.Second), Attributes: map[string]string{"line": "1"}},
+		{TraceID: "0af7651916cd43dd8448eb211c80319c", SpanID: "00f067aa0ba902b7", ParentSpanID: "b7ad6b7169203331",
+			Name: "SQLWriter", Stage: 2, Start: start, End: start.Add(time.Second), Err: "failed"},
+	}
+	e := NewOTLPExporter(server.URL+"/v1/traces", "import")
+	if err := e.ExportSpans(context.Background(), spans); err != nil {
+		t.Fatal(err)
+	}
+	rs := received.ResourceSpans
+	if len(rs) != 1 || *rs[0].Resource.Attributes[0].Value.StringValue != "import" || len(rs[0].ScopeSpans) != 1 {
+		t.Fatalf("Expected the spans of the import service, got %+v", rs)
+	}
+	ss := rs[0].ScopeSpans[0].Spans
+	if len(ss) != 2 {
+		t.Fatalf("Expected 2 spans, got %+v", ss)
+	}
+	if s := ss[0]; s.TraceID != spans[0].TraceID || s.SpanID != spans[0].SpanID || s.ParentSpanID != "" ||
+		s.StartTimeUnixNano != "1000000000" || s.EndTimeUnixNano != "2000000000" || s.Status.Code != 0 ||
+		len(s.Attributes) != 2 || *s.Attributes[0].Value.IntValue != "1" || s.Attributes[1].Key != "ratchet.line" {
+		t.Errorf("Unexpected root span %+v", s)
+	}
+	if s := ss[1]; s.ParentSpanID != spans[0].SpanID || s.Status.Code != otlpStatusCodeError || s.Status.Message != "failed" {
+		t.Errorf("Unexpected failed span %+v", s)
+	}
+
+	// Without a Client, http.DefaultClient is used.
+	literal := &OTLPExporter{URL: server.URL + "/v1/traces", ServiceName: "import"}
+	if err := literal.ExportSpans(context.Background(), spans); err != nil {
+		t.Fatal(err)
+	}
+
+	status = http.StatusBadRequest
+	if err := e.ExportSpans(context.Background(), spans); err == nil {
+		t.Error("Expected an error when the collector rejects the spans")
+	}
+}
@@ -0,0 +1,30 @@
+package tracing
+
+import (
+	"context"
+	"sync"
+
+	"github.com/dailyburn/ratchet"
+)
+
+// Recorder keeps the spans exported to it in memory, e.g. to check them
+// in tests.
+type Recorder struct {
+	mu    sync.Mutex
+	spans []ratchet.Span
+}
+
+// ExportSpans defers to ratchet.SpanExporter.
+func (r *Recorder) ExportSpans(ctx context.Context, spans []ratchet.Span) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+// Spans returns the spans exported so far, in the order they were.
+func (r *Recorder) Spans() []ratchet.Span {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]ratchet.Span(nil), r.spans...)
+}
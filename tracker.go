@@ -0,0 +1,110 @@
+package ratchet
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/dailyburn/ratchet/data"
+)
+
+// A tracker follows a payload through the Pipeline, e.g. one emitted by a
+// Checkpointer or with Track, counting the messages derived from it that are
+// still to be processed. Once they all have been, done is called.
+//
+// Each message holds the trackers of the payload it was derived from:
+// the data emitted by a ProcessData call holds the trackers of the payload
+// being processed, which are released once the call returns successfully
+// (or handed over to the dead letter). A payload that is never processed,
+// because the Pipeline was halted or ProcessData failed, is never released.
+type tracker struct {
+	pending int64
+	done    func()
+}
+
+// newTracker returns a tracker held once, by its creator.
+func newTracker(done func()) *tracker {
+	return &tracker{pending: 1, done: done}
+}
+
+func holdAll(trackers []*tracker) {
+	for _, t := range trackers {
+		atomic.AddInt64(&t.pending, 1)
+	}
+}
+
+func releaseAll(trackers []*tracker) {
+	for _, t := range trackers {
+		if atomic.AddInt64(&t.pending, -1) == 0 {
+			t.done()
+		}
+	}
+}
+
+type messageKey struct{}
+
+// withMessage returns a context for processing m, so that the data emitted
+// is derived from it (see derive), and Source and HeadersFrom can tell where
+// it came from.
+func withMessage(ctx context.Context, m message) context.Context {
+	if m.from == nil && m.trackers == nil && m.headers == nil {
+		return ctx
+	}
+	m.data = nil
+	return context.WithValue(ctx, messageKey{}, m)
+}
+
+func messageFrom(ctx context.Context) message {
+	m, _ := ctx.Value(messageKey{}).(message)
+	return m
+}
+
+// derive returns a message for d, holding the trackers of the payload being
+// processed with ctx, along with ts. It inherits the headers of the payload,
+// with h added, and the trace context of the call (see Tracing).
+func derive(ctx context.Context, d data.JSON, h Headers, ts ...*tracker) message {
+	m := messageFrom(ctx)
+	trackers := m.trackers
+	if len(ts) > 0 {
+		trackers = append(trackers[:len(trackers):len(trackers)], ts...)
+	}
+	headers := m.headers.with(h)
+	if cs := spanFrom(ctx); cs != nil {
+		headers = cs.propagate(headers)
+	}
+	holdAll(trackers)
+	return message{data: d, headers: headers, trackers: trackers}
+}
+
+// trackingEmitter is implemented by the Emitters given to DataProcessors
+// within a Pipeline.
+type trackingEmitter interface {
+	Emitter
+	// emitTracked emits d, adding h to its headers and also holding ts.
+	emitTracked(d data.JSON, h Headers, ts ...*tracker) error
+}
+
+// outputEmitter emits data on a dataProcessor's outputChan, giving up
+// once ctx is done.
+type outputEmitter struct {
+	c   chan message
+	ctx context.Context
+}
+
+func (e outputEmitter) Emit(d data.JSON) error {
+	return e.emitTracked(d, nil)
+}
+
+func (e outputEmitter) emitTracked(d data.JSON, h Headers, ts ...*tracker) error {
+	return e.send(derive(e.ctx, d, h, ts...))
+}
+
+// send sends m as it is. Like the message itself, its trackers are
+// dropped if ctx is done first.
+func (e outputEmitter) send(m message) error {
+	select {
+	case e.c <- m:
+		return nil
+	case <-e.ctx.Done():
+		return e.ctx.Err()
+	}
+}
@@ -36,7 +36,12 @@ type CSVParameters struct {
 // upstream on outputChan
 func CSVProcess(params *CSVParameters, d data.JSON, outputChan chan data.JSON, killChan chan error) {
 	objects, err := data.ObjectsFromJSON(d)
-	KillPipelineIfErr(err, killChan)
+	if KilledPipeline(err, killChan) {
+		return
+	}
+	if len(objects) == 0 {
+		return
+	}
 
 	if params.Header == nil {
 		for k := range objects[0] {
@@ -74,7 +79,9 @@ func CSVProcess(params *CSVParameters, d data.JSON, outputChan chan data.JSON, k
 		params.Writer.SetWriter(bufio.NewWriter(&b))
 
 		err = params.Writer.WriteAll(rows)
-		KillPipelineIfErr(err, killChan)
+		if KilledPipeline(err, killChan) {
+			return
+		}
 
 		outputChan <- []byte(b.String())
 	} else {
@@ -9,3 +9,15 @@ func KillPipelineIfErr(err error, killChan chan error) {
 		killChan <- err
 	}
 }
+
+// KilledPipeline is the same as KillPipelineIfErr, but returns true if the
+// error was sent to killChan, in which case the caller should stop
+// processing, e.g.:
+//
+//	if util.KilledPipeline(err, killChan) {
+//	        return
+//	}
+func KilledPipeline(err error, killChan chan error) bool {
+	KillPipelineIfErr(err, killChan)
+	return err != nil
+}
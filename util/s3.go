@@ -2,8 +2,10 @@ package util
 
 import (
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
+	"net/url"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -67,6 +69,21 @@ func GetS3Object(client *s3.S3, bucket, objKey string) (*s3.GetObjectOutput, err
 	return client.GetObject(params)
 }
 
+// GetS3ObjectContext is the same as GetS3Object, but the request is
+// canceled once ctx is done.
+func GetS3ObjectContext(ctx context.Context, client *s3.S3, bucket, objKey string) (*s3.GetObjectOutput, error) {
+	logger.Debug("GetS3ObjectContext: ", bucket, "-", objKey)
+	params := &s3.GetObjectInput{
+		Bucket: aws.String(bucket), // Required
+		Key:    aws.String(objKey), // Required
+	}
+
+	req, out := client.GetObjectRequest(params)
+	req.HTTPRequest.Cancel = ctx.Done()
+	err := req.Send()
+	return out, err
+}
+
 // DeleteS3Objects deletes the objects specified by the given object keys
 func DeleteS3Objects(client *s3.S3, bucket string, objKeys []string) (*s3.DeleteObjectsOutput, error) {
 	logger.Debug("DeleteS3Objects: ", bucket, "-", objKeys)
@@ -88,6 +105,18 @@ func DeleteS3Objects(client *s3.S3, bucket string, objKeys []string) (*s3.Delete
 	return client.DeleteObjects(params)
 }
 
+// CopyS3Object copies the object at srcKey to dstKey, within the same bucket
+func CopyS3Object(client *s3.S3, bucket, srcKey, dstKey string) (*s3.CopyObjectOutput, error) {
+	logger.Debug("CopyS3Object: ", bucket, "-", srcKey, "to", dstKey)
+	source := url.URL{Path: bucket + "/" + srcKey}
+	params := &s3.CopyObjectInput{
+		Bucket:     aws.String(bucket),               // Required
+		CopySource: aws.String(source.EscapedPath()), // Required
+		Key:        aws.String(dstKey),               // Required
+	}
+	return client.CopyObject(params)
+}
+
 // WriteS3Object writes the data to the given key, optionally compressing it first
 func WriteS3Object(data []string, config *aws.Config, bucket string, key string, lineSeparator string, compress bool) (string, error) {
 	var reader io.Reader
@@ -1,6 +1,7 @@
 package util
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"sort"
@@ -19,13 +20,20 @@ import (
 // is retrieved from the query. If this happens, the object returned will be a JSON
 // object in the form of {"Error": "description"}.
 func GetDataFromSQLQuery(db *sql.DB, query string, batchSize int, structDest interface{}) (chan data.JSON, error) {
-	stmt, err := db.Prepare(query)
+	return GetDataFromSQLQueryContext(context.Background(), db, query, batchSize, structDest)
+}
+
+// GetDataFromSQLQueryContext is the same as GetDataFromSQLQuery, but the query
+// is aborted once ctx is cancelled. Cancellation during execution is reported
+// like any other error while retrieving the data.
+func GetDataFromSQLQueryContext(ctx context.Context, db *sql.DB, query string, batchSize int, structDest interface{}) (chan data.JSON, error) {
+	stmt, err := db.PrepareContext(ctx, query)
 	if err != nil {
 		return nil, err
 	}
 	defer stmt.Close()
 
-	rows, err := stmt.Query()
+	rows, err := stmt.QueryContext(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -191,6 +199,21 @@ func ExecuteSQLQuery(db *sql.DB, query string) error {
 // where the keys are column names and the
 // the values are SQL values to be inserted into those columns.
 func SQLInsertData(db *sql.DB, d data.JSON, tableName string, onDupKeyUpdate bool, onDupKeyFields []string, batchSize int) error {
+	return sqlInsertData(db, d, tableName, onDupKeyUpdate, onDupKeyFields, batchSize)
+}
+
+// SQLInsertDataTx is the same as SQLInsertData, but the INSERT is
+// executed within the given transaction.
+func SQLInsertDataTx(tx *sql.Tx, d data.JSON, tableName string, onDupKeyUpdate bool, onDupKeyFields []string, batchSize int) error {
+	return sqlInsertData(tx, d, tableName, onDupKeyUpdate, onDupKeyFields, batchSize)
+}
+
+// preparer is implemented by both *sql.DB and *sql.Tx.
+type preparer interface {
+	Prepare(query string) (*sql.Stmt, error)
+}
+
+func sqlInsertData(db preparer, d data.JSON, tableName string, onDupKeyUpdate bool, onDupKeyFields []string, batchSize int) error {
 	objects, err := data.ObjectsFromJSON(d)
 	if err != nil {
 		return err
@@ -213,7 +236,7 @@ func SQLInsertData(db *sql.DB, d data.JSON, tableName string, onDupKeyUpdate boo
 	return insertObjects(db, objects, tableName, onDupKeyUpdate, onDupKeyFields)
 }
 
-func insertObjects(db *sql.DB, objects []map[string]interface{}, tableName string, onDupKeyUpdate bool, onDupKeyFields []string) error {
+func insertObjects(db preparer, objects []map[string]interface{}, tableName string, onDupKeyUpdate bool, onDupKeyFields []string) error {
 	logger.Info("SQLInsertData: building INSERT for len(objects) =", len(objects))
 	insertSQL, vals := buildInsertSQL(objects, tableName, onDupKeyUpdate, onDupKeyFields)
 
@@ -2,11 +2,14 @@ package util
 
 import (
 	"fmt"
+	"sync"
 	"time"
 )
 
 // Timer is a basic mechanism for measuring execution time.
+// It is safe for concurrent use.
 type Timer struct {
+	mu        sync.Mutex
 	startTime time.Time
 	endTime   time.Time
 }
@@ -18,21 +21,35 @@ func StartTimer() (t *Timer) {
 
 // Stop sets the end time for the Timer and returns itself.
 func (t *Timer) Stop() *Timer {
+	t.mu.Lock()
 	t.endTime = time.Now()
+	t.mu.Unlock()
 	return t
 }
 
 // Stopped returns true if Stop() has been called on the timer.
 func (t *Timer) Stopped() bool {
-	zeroTime := time.Time{}
-	return zeroTime != t.endTime
+	return !t.EndTime().IsZero()
+}
+
+// StartTime returns the time the Timer was started.
+func (t *Timer) StartTime() time.Time {
+	return t.startTime
+}
+
+// EndTime returns the time the Timer was stopped, or the zero
+// time if it is still running.
+func (t *Timer) EndTime() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.endTime
 }
 
 // Duration returns either the total executino duration (if Timer stopped)
 // or the duration until time.Now() if timer is still running.
 func (t *Timer) Duration() time.Duration {
-	if t.Stopped() {
-		return t.endTime.Sub(t.startTime)
+	if end := t.EndTime(); !end.IsZero() {
+		return end.Sub(t.startTime)
 	}
 	return time.Now().Sub(t.startTime)
 }
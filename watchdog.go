@@ -0,0 +1,283 @@
+package ratchet
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dailyburn/ratchet/data"
+	"github.com/dailyburn/ratchet/logger"
+)
+
+// StallError is the error reported when no data has moved through a Pipeline
+// for its StallTimeout, while some of its DataProcessors still had work to do.
+type StallError struct {
+	Pipeline    string
+	Idle        time.Duration // how long no data moved for
+	Busy        []string      // the DataProcessors with work to do, and what they were doing
+	Diagnostics string        // see Pipeline.Diagnostics
+}
+
+func (e *StallError) Error() string {
+	return fmt.Sprintf("%s: stalled, no data moved for %v: %s", e.Pipeline, e.Idle.Round(time.Millisecond), strings.Join(e.Busy, ", "))
+}
+
+// The states of a dataProcessor, as shown by Diagnostics.
+const (
+	stateWaiting   = "waiting for input"
+	stateBusy      = "processing"
+	stateDraining  = "waiting for ProcessData calls"
+	stateFinishing = "finishing"
+	stateHalted    = "halted"
+	stateDone      = "done"
+)
+
+// activity tracks what a dataProcessor is doing, for Diagnostics and the
+// watchdog. It is updated by the goroutines running the DataProcessor, so
+// every field is guarded by activityMu.
+type activity struct {
+	activityMu sync.Mutex
+	state      string
+	since      time.Time // when state was entered
+	changes    int64     // state changes so far
+	calls      map[uint64]activeCall
+	nextCall   uint64
+}
+
+// activeCall is a ProcessData or Finish call in progress.
+type activeCall struct {
+	name    string
+	started time.Time
+	d       data.JSON
+}
+
+func (a *activity) setState(state string) {
+	a.activityMu.Lock()
+	a.state = state
+	a.since = time.Now()
+	a.changes++
+	a.activityMu.Unlock()
+}
+
+func (a *activity) beginCall(name string, d data.JSON) uint64 {
+	a.activityMu.Lock()
+	defer a.activityMu.Unlock()
+	if a.calls == nil {
+		a.calls = make(map[uint64]activeCall)
+	}
+	id := a.nextCall
+	a.nextCall++
+	a.calls[id] = activeCall{name, time.Now(), d}
+	return id
+}
+
+func (a *activity) endCall(id uint64) {
+	a.activityMu.Lock()
+	delete(a.calls, id)
+	a.activityMu.Unlock()
+}
+
+// snapshot returns the current state, and the calls in progress
+// from the oldest to the newest.
+func (a *activity) snapshot() (state string, since time.Time, calls []activeCall) {
+	a.activityMu.Lock()
+	defer a.activityMu.Unlock()
+	for _, c := range a.calls {
+		calls = append(calls, c)
+	}
+	sort.Slice(calls, func(i, j int) bool { return calls[i].started.Before(calls[j].started) })
+	return a.state, a.since, calls
+}
+
+// progress returns a number that increases whenever the dataProcessor
+// moves data along, or moves on to another state.
+func (dp *dataProcessor) progress() int64 {
+	dp.executionStat.mu.Lock()
+	n := dp.bytesReceived.count + dp.bytesSent.count + dp.executionTimes.count
+	dp.executionStat.mu.Unlock()
+	dp.activityMu.Lock()
+	n += dp.changes
+	dp.activityMu.Unlock()
+	if sp, ok := unwrap(dp.DataProcessor).(*subPipeline); ok {
+		n += sp.pipeline.progress()
+	}
+	return n
+}
+
+// busy returns a description of what the dataProcessor is doing, or ""
+// if it is waiting for input or done.
+func (dp *dataProcessor) busy() string {
+	state, since, calls := dp.snapshot()
+	buffered := dp.buffered()
+	name := fmt.Sprintf("stage %d %v", dp.stage, dp)
+	if dp.stage == 0 {
+		name = fmt.Sprintf("dead letter %v", dp)
+	}
+	switch {
+	case state == stateBusy || state == stateDraining || state == stateFinishing || len(calls) > 0:
+		return fmt.Sprintf("%s (%s for %v)", name, state, time.Since(since).Round(time.Millisecond))
+	case buffered > 0:
+		return fmt.Sprintf("%s (%d payloads buffered)", name, buffered)
+	}
+	return ""
+}
+
+func (p *Pipeline) processors() []*dataProcessor {
+	dps := []*dataProcessor{}
+	for _, stage := range p.layout.stages {
+		dps = append(dps, stage.processors...)
+	}
+	return append(dps, p.deadLetters...)
+}
+
+func (p *Pipeline) progress() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var n int64
+	for _, dp := range p.processors() {
+		n += dp.progress()
+	}
+	return n
+}
+
+func (p *Pipeline) busy() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	busy := []string{}
+	for _, dp := range p.processors() {
+		if b := dp.busy(); b != "" {
+			busy = append(busy, b)
+		}
+	}
+	return busy
+}
+
+// watch fails the run with a StallError if no data moves for StallTimeout
+// while some DataProcessor has work to do. Time spent with every
+// DataProcessor waiting for input (e.g. for a RunStream Input) doesn't count.
+func (p *Pipeline) watch(ctx context.Context, errChan chan error, done chan struct{}) {
+	interval := p.StallTimeout / 4
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := p.progress()
+	moved := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		case <-ctx.Done():
+			return
+		}
+		n := p.progress()
+		busy := p.busy()
+		if n != last || len(busy) == 0 {
+			last, moved = n, time.Now()
+			continue
+		}
+		if idle := time.Since(moved); idle >= p.StallTimeout {
+			err := &StallError{Pipeline: p.Name, Idle: idle, Busy: busy, Diagnostics: p.Diagnostics()}
+			logger.Error(err.Error(), "\n", err.Diagnostics)
+			select {
+			case errChan <- err:
+			case <-done:
+			case <-ctx.Done():
+			}
+			return
+		}
+	}
+}
+
+// Diagnostics returns a description of what the Pipeline is doing, to help
+// debug a run that is stuck: the state of each DataProcessor, how many
+// payloads are buffered in the channels between them (out of their
+// capacity), the ProcessData and Finish calls in progress (including
+// concurrent ones), and the stacks of every goroutine. It is logged when
+// the Pipeline stalls, see StallTimeout. Payloads are only included when
+// PrintData is set.
+func (p *Pipeline) Diagnostics() string {
+	var b strings.Builder
+	p.diagnose(&b, "")
+	b.WriteString("Goroutines)\n")
+	b.Write(goroutineStacks())
+	return b.String()
+}
+
+func (p *Pipeline) diagnose(b *strings.Builder, indent string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case p.timer == nil:
+		fmt.Fprintf(b, "%s%s: not started\n", indent, p.Name)
+	case p.timer.Stopped():
+		fmt.Fprintf(b, "%s%s: ran for %v\n", indent, p.Name, p.timer.Duration().Round(time.Millisecond))
+	default:
+		fmt.Fprintf(b, "%s%s: running for %v\n", indent, p.Name, p.timer.Duration().Round(time.Millisecond))
+	}
+	for n, stage := range p.layout.stages {
+		fmt.Fprintf(b, "%sStage %d)\n", indent, n+1)
+		for _, dp := range stage.processors {
+			dp.diagnose(b, indent, p.PrintData)
+		}
+	}
+	if len(p.deadLetters) > 0 {
+		fmt.Fprintf(b, "%sDead letters)\n", indent)
+		for _, dp := range p.deadLetters {
+			dp.diagnose(b, indent, p.PrintData)
+		}
+	}
+}
+
+func (dp *dataProcessor) diagnose(b *strings.Builder, indent string, printData bool) {
+	state, since, calls := dp.snapshot()
+	if state == "" {
+		state = "not started"
+	}
+	fmt.Fprintf(b, "%s  * %v: %s", indent, dp, state)
+	if !since.IsZero() {
+		fmt.Fprintf(b, " for %v", time.Since(since).Round(time.Millisecond))
+	}
+	b.WriteString("\n")
+	for i, c := range dp.mergeInChans {
+		fmt.Fprintf(b, "%s     - input from %v: %d/%d buffered\n", indent, dp.mergeFrom[i], len(c), cap(c))
+	}
+	if n := atomic.LoadInt64(&dp.mergeQueued); n > 0 {
+		fmt.Fprintf(b, "%s     - %d payloads queued by the merge\n", indent, n)
+	}
+	for i, c := range dp.branchOutChans {
+		fmt.Fprintf(b, "%s     - output to %v: %d/%d buffered\n", indent, dp.outputs[i], len(c), cap(c))
+	}
+	for _, c := range calls {
+		fmt.Fprintf(b, "%s     - %s running for %v", indent, c.name, time.Since(c.started).Round(time.Millisecond))
+		if c.d != nil {
+			fmt.Fprintf(b, ", payload of %d bytes", len(c.d))
+			if printData {
+				fmt.Fprintf(b, " = %s", c.d)
+			}
+		}
+		b.WriteString("\n")
+	}
+	if sp, ok := unwrap(dp.DataProcessor).(*subPipeline); ok {
+		sp.pipeline.diagnose(b, indent+"       ")
+	}
+}
+
+// goroutineStacks returns the stack traces of every goroutine.
+func goroutineStacks() []byte {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}